@@ -1,25 +1,20 @@
 package backup
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"syscall"
+	"strings"
 	"time"
 
+	"github.com/lgarron/sd-card-backup/metadata"
+	"github.com/lgarron/sd-card-backup/progress"
 	"github.com/lgarron/sd-card-backup/sync"
 )
 
 type fileFilter = func(fileClassification) bool
 
-var classificationBackupOrder = []fileClassification{
-	imageFile,
-	videoFile,
-	rawVideoFile,
-	audioFile,
-	unclassifiedFile,
-}
-
 func filterClassification(want fileClassification) fileFilter {
 	return func(have fileClassification) bool {
 		return want == have
@@ -29,80 +24,256 @@ func filterClassification(want fileClassification) fileFilter {
 type folderOperation struct {
 	Operation     Operation
 	SourceRoot    string
+	CardRoot      string
 	CardName      string
 	FolderMapping folderMapping
 	FileFilter    fileFilter
-	Syncer        sync.Syncer
+	Run           *backupRun
 }
 
-func folderForClassification(classification fileClassification) (string, error) {
-	switch classification {
-	case imageFile:
-		return "Images", nil
-	case videoFile:
-		return "Videos", nil
-	case rawVideoFile:
-		return "RAW Video", nil
-	case audioFile:
-		return "Audio", nil
-	case unclassifiedFile:
-		return "Unsorted", nil
-	default:
-		return "", fmt.Errorf("Unknown classification: %d", classification)
+// captureTime prefers the capture time recorded in the file's metadata, since
+// the birth time on the card can be reset by copying or by some card readers.
+func captureTime(path string) (time.Time, error) {
+	t, err := metadata.CaptureTime(path)
+	if err == nil {
+		return t, nil
 	}
+	return sync.BirthTime(path)
 }
 
-func dateFolderNames(path string) (year string, date string) {
-	stat := syscall.Stat_t{}
-	syscall.Stat(path, &stat)
-	birthTime := time.Unix(int64(stat.Birthtimespec.Sec), int64(stat.Birthtimespec.Nsec))
-	return birthTime.Format("2006"), birthTime.Format("2006-01-02")
+// classifyPath classifies sidecars the same as their primary file.
+func (fo folderOperation) classifyPath(path string) fileClassification {
+	return fo.Run.Classifier.classifyPath(fo.Run.Sidecars.primaryOrSelf(path))
 }
 
-func (fo folderOperation) targetPath(path string, f os.FileInfo) (string, error) {
-	classificationFolder, err := folderForClassification(classifyPath(path))
+// excluded returns whether `path` is in a classification that isn't backed up
+// from the card.
+func (fo folderOperation) excluded(path string) (bool, error) {
+	cc, ok := fo.Operation.cardConfig(fo.CardName)
+	if !ok || len(cc.ExcludeClassifications) == 0 {
+		return false, nil
+	}
+	classificationFolder, err := fo.Run.Classifier.table.folder(fo.classifyPath(path))
+	if err != nil {
+		return false, err
+	}
+	return fo.Operation.excludesClassification(fo.CardName, classificationFolder), nil
+}
+
+func (fo folderOperation) targetPath(path string, classificationFolder string) (string, error) {
+	// Sidecars go into the same date (and camera) folder as their primary
+	// file.
+	t, err := captureTime(fo.Run.Sidecars.primaryOrSelf(path))
 	if err != nil {
 		return "", err
 	}
+	return fo.targetPathAt(path, classificationFolder, t)
+}
 
+// targetPathAt is `targetPath()` for a file whose primary file was captured
+// at `t`.
+func (fo folderOperation) targetPathAt(path string, classificationFolder string, t time.Time) (string, error) {
 	relPath, err := filepath.Rel(fo.SourceRoot, path)
 	if err != nil {
 		return "", err
 	}
+	template, err := fo.Operation.pathTemplate()
+	if err != nil {
+		return "", err
+	}
 
-	year, date := dateFolderNames(path)
-
-	return filepath.Join(
-		fo.Operation.DestinationRoot,
-		classificationFolder,
-		year,
-		date,
-		fo.CardName,
-		fo.FolderMapping.Destination,
-		relPath,
-	), nil
+	values := map[string]string{
+		"class":    classificationFolder,
+		"yyyy":     t.Format("2006"),
+		"mm":       t.Format("01"),
+		"dd":       t.Format("02"),
+		"card":     fo.CardName,
+		"mapping":  fo.FolderMapping.Destination,
+		"relpath":  filepath.ToSlash(relPath),
+		"reldir":   filepath.ToSlash(filepath.Dir(relPath)),
+		"basename": filepath.Base(path),
+	}
+	if template.uses("camera_model") {
+		values["camera_model"] = cameraModelFolderName(fo.Run.Sidecars.primaryOrSelf(path))
+	}
+	return filepath.Join(fo.Operation.DestinationRoot, filepath.FromSlash(template.expand(values))), nil
 }
 
-func (fo folderOperation) syncFile(src string, dest string) error {
-	fmt.Printf("%s", sync.RevealablePath(src, fo.Operation.Options.RevealPathOSC8))
+func (fo folderOperation) syncFile(src string, dest string, classificationFolder string, srcInfo os.FileInfo) (err error) {
+	out, done := fo.Run.fileOutput()
+	var fileProgress *progress.File
+	// Once the file is queued, the syncer calls `OnDone` instead.
+	queued := false
+	defer func() {
+		if queued {
+			return
+		}
+		if err != nil {
+			fmt.Fprint(out, " ❌")
+		}
+		if fileProgress != nil {
+			fileProgress.Done()
+		}
+		done()
+	}()
+
+	fmt.Fprintf(out, "%s", sync.RevealablePath(src, fo.Operation.Options.RevealPathOSC8))
 	if fo.Operation.Options.DryRun {
-		fmt.Println()
-	} else {
-		queueOptions := sync.QueueOptions{
-			RevealPathOSC8: fo.Operation.Options.RevealPathOSC8,
+		fmt.Fprintln(out)
+		return nil
+	}
+
+	journalEntry, err := fo.journalEntry(src, dest, srcInfo)
+	if err != nil {
+		return err
+	}
+
+	if fo.Run.Progress != nil {
+		fileProgress = fo.Run.Progress.StartFile(src, srcInfo.Size())
+	}
+
+	mirrors, err := fo.Run.mirrorPaths(dest)
+	if err != nil {
+		return err
+	}
+
+	prior, resuming := fo.Run.Resume.lookup(journalEntry.Card, journalEntry.SourcePath)
+	if resuming && prior.State == journalFinished && fo.finishedEarlier(prior, journalEntry, append([]string{dest}, mirrors...)) {
+		fmt.Fprint(out, " ⏩ (finished by an interrupted run)")
+		return fo.Run.Journal.record(journalEntry.withState(journalFinished))
+	}
+
+	err = fo.Run.Journal.record(journalEntry.withState(journalPlanned))
+	if err != nil {
+		return err
+	}
+
+	queueOptions := sync.QueueOptions{
+		RevealPathOSC8: fo.Operation.Options.RevealPathOSC8,
+		Output:         out,
+		OnCopied:       fo.recordCopy(classificationFolder),
+		OnStart: func() error {
+			return fo.Run.Journal.record(journalEntry.withState(journalInProgress))
+		},
+		OnDone: func(err error) {
+			if err == nil {
+				// Losing this entry only means that the file is checked again
+				// when resuming.
+				fo.Run.Journal.record(journalEntry.withState(journalFinished))
+			} else {
+				fmt.Fprint(out, " ❌")
+			}
+			if fileProgress != nil {
+				fileProgress.Done()
+			}
+			done()
+		},
+		SourceKey:      fo.CardName,
+		DestinationKey: fo.Operation.DestinationRoot,
+		Mirrors:        mirrors,
+		OnMirrorFailed: fo.Operation.mirrorFailed(fo.Run, out),
+		// A copy that was in progress when an earlier run was interrupted may
+		// have left a destination that passes the heuristic.
+		Verify: resuming && prior.State == journalInProgress,
+	}
+	if fileProgress != nil {
+		queueOptions.OnProgress = fileProgress.Add
+	}
+	if fo.Run.Duplicates != nil {
+		queueOptions.Duplicates = fo.Run.Duplicates
+	}
+	queued = true
+	return fo.Run.Syncer.Queue(src, dest, queueOptions)
+}
+
+func (fo folderOperation) journalEntry(src string, dest string, srcInfo os.FileInfo) (JournalEntry, error) {
+	sourcePath, err := filepath.Rel(fo.CardRoot, src)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	destinationPath, err := filepath.Rel(fo.Operation.DestinationRoot, dest)
+	if err != nil {
+		return JournalEntry{}, err
+	}
+	return JournalEntry{
+		Card:            fo.CardName,
+		SourcePath:      sourcePath,
+		DestinationPath: destinationPath,
+		Size:            srcInfo.Size(),
+		ModTime:         srcInfo.ModTime(),
+	}, nil
+}
+
+func (entry JournalEntry) withState(state journalState) JournalEntry {
+	entry.State = state
+	return entry
+}
+
+// finishedEarlier returns whether an interrupted run finished the same source
+// file, and it is still there in each of `dests`.
+func (fo folderOperation) finishedEarlier(prior JournalEntry, current JournalEntry, dests []string) bool {
+	if prior.DestinationPath != current.DestinationPath || prior.Size != current.Size || !prior.ModTime.Equal(current.ModTime) {
+		return false
+	}
+	for _, dest := range dests {
+		destInfo, err := os.Stat(dest)
+		if err != nil || destInfo.Size() != current.Size {
+			return false
 		}
-		err := fo.Syncer.Queue(src, dest, queueOptions)
+	}
+	return true
+}
+
+// recordCopy is called from the syncer, which may be on another goroutine.
+func (fo folderOperation) recordCopy(classificationFolder string) func(sync.Result) error {
+	return func(result sync.Result) error {
+		sourcePath, err := filepath.Rel(fo.CardRoot, result.Src)
+		if err != nil {
+			return err
+		}
+		root, err := fo.Run.rootFor(result.Dest)
+		if err != nil {
+			return err
+		}
+		destinationPath, err := filepath.Rel(root.Path, result.Dest)
 		if err != nil {
 			return err
 		}
-	}
-	fmt.Println("")
 
-	return nil
+		linkedTo := ""
+		if result.LinkedTo != "" {
+			linkedTo, err = filepath.Rel(root.Path, result.LinkedTo)
+			if err != nil {
+				return err
+			}
+			fo.Run.Duplicates.recordLink(result.Size)
+		} else {
+			root.recordCopy(result.Size)
+		}
+		entry := ManifestEntry{
+			RunID:           fo.Run.ID,
+			Card:            fo.CardName,
+			SourcePath:      sourcePath,
+			DestinationPath: destinationPath,
+			Size:            result.Size,
+			ModTime:         result.ModTime,
+			BirthTime:       result.BirthTime,
+			CopiedAt:        time.Now(),
+			HashAlgorithm:   string(result.HashAlgorithm),
+			Hash:            result.Hash,
+			Classification:  classificationFolder,
+			LinkedTo:        linkedTo,
+		}
+		if fo.Run.Duplicates != nil {
+			fo.Run.Duplicates.add(root.Path, entry)
+		}
+		return root.Manifest.append(entry)
+	}
 }
 
 func (fo folderOperation) visit(path string, f os.FileInfo, err error) error {
-	if !fo.FileFilter(classifyPath(path)) {
+	classification := fo.classifyPath(path)
+	if !fo.FileFilter(classification) {
 		return nil
 	}
 
@@ -114,12 +285,52 @@ func (fo folderOperation) visit(path string, f os.FileInfo, err error) error {
 		return nil
 	}
 
-	targetPath, err := fo.targetPath(path, f)
+	rule, err := fo.filteredOut(path, f)
 	if err != nil {
 		return err
 	}
+	if rule != "" {
+		out, done := fo.Run.fileOutput()
+		fmt.Fprintf(out, "%s ⏩ (excluded by %s)", sync.RevealablePath(path, fo.Operation.Options.RevealPathOSC8), rule)
+		done()
+		return nil
+	}
 
-	return fo.syncFile(path, targetPath)
+	// Sidecars go into the same date (and camera) folder as their primary
+	// file.
+	t, err := captureTime(fo.Run.Sidecars.primaryOrSelf(path))
+	if err != nil {
+		return err
+	}
+
+	if imported := fo.Run.Import; imported != nil && imported.Tracked {
+		position := highWaterMark{CaptureTime: t, DCFNumber: dcfNumber(path)}
+		imported.Seen.raise(position)
+		if fo.Operation.Options.NewOnly && imported.HasPrevious && imported.Previous.includes(position) {
+			// Without looking at the destination.
+			imported.Skipped++
+			if fo.Run.Progress != nil {
+				fo.Run.Progress.StartFile(path, f.Size()).Done()
+			}
+			return nil
+		}
+	}
+
+	classificationFolder, err := fo.Run.Classifier.table.folder(classification)
+	if err != nil {
+		return err
+	}
+
+	targetPath, err := fo.targetPathAt(path, classificationFolder, t)
+	if err != nil {
+		return err
+	}
+	err = fo.Run.claimDestination(targetPath, path)
+	if err != nil {
+		return err
+	}
+
+	return fo.syncFile(path, targetPath, classificationFolder, f)
 }
 
 func folderExists(path string) (bool, error) {
@@ -135,70 +346,140 @@ func folderExists(path string) (bool, error) {
 
 // Backups up:
 //
-//	[op.SDCardMountPoint]/[cardName]/[fm.Source]/[filePath]
+//	[op.SDCardMountPoint]/[c.Volume]/[fm.Source]/[filePath]
 //
 // to:
 //
-//	[op.DestinationRoot]/[classification]/[year]/[year-month-day]/[cardName]/[fm.Destination]/[filePath]
-func (op Operation) backupFolder(cardName string, fm folderMapping, ff fileFilter) error {
-	folderSourceRoot := filepath.Join(op.SDCardMountPoint, cardName, fm.Source)
+//	[op.DestinationRoot]/[classification]/[year]/[year-month-day]/[c.Name]/[fm.Destination]/[filePath]
+//
+// (or the layout in `op.PathTemplate`). For a `fm.Source` pattern,
+// `[filePath]` starts with the matched folders unless they are dropped.
+func (op Operation) backupFolder(run *backupRun, c card, mf mappedFolder, ff fileFilter) error {
 	fo := &folderOperation{
 		Operation:     op,
-		SourceRoot:    folderSourceRoot,
-		CardName:      cardName,
-		FolderMapping: fm,
+		SourceRoot:    mf.RelativeTo,
+		CardRoot:      op.cardRoot(c),
+		CardName:      c.Name,
+		FolderMapping: mf.FolderMapping,
 		FileFilter:    ff,
-		Syncer:        sync.NewMacOSNativeCpUsingFilesizeAndBirthTime(),
+		Run:           run,
 	}
-	err := filepath.Walk(folderSourceRoot, fo.visit)
+	err := filepath.Walk(mf.Path, fo.visit)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// BackupCard backups up the given card.
-func (op Operation) BackupCard(cardName string) error {
-	sdCardPath := filepath.Join(op.SDCardMountPoint, cardName)
+// BackupCard backups up the card mounted at `volume` in `op.SDCardMountPoint`.
+func (op Operation) BackupCard(volume string) (err error) {
+	c, err := op.cardForVolume(volume)
+	if err != nil {
+		return err
+	}
+
+	run, err := op.newBackupRun()
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, run.close()) }()
+
+	err = op.backupCard(run, c)
+	if err != nil {
+		return err
+	}
+	run.printRootSummary()
+	return run.complete()
+}
+
+func (op Operation) backupCard(run *backupRun, c card) error {
+	sdCardPath := op.cardRoot(c)
 	// Check if source folder exists is mounted
 	exists, err := folderExists(sdCardPath)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		// printer.Printf("[%s] Skipping card (unmounted)\n", cardName)
+		// printer.Printf("[%s] Skipping card (unmounted)\n", c.Name)
 		return nil
 	}
 
-	fmt.Printf("[%s] Backing up card\n", cardName)
-
-	for _, fc := range classificationBackupOrder {
-		for _, fm := range op.FolderMapping {
-
-			folderSourceRoot := filepath.Join(op.SDCardMountPoint, cardName, fm.Source)
+	// A secondary root may have been unmounted since the last card.
+	err = op.checkRoots(run)
+	if err != nil {
+		return err
+	}
+	cardOp := op.forCard(c)
+	if cardOp.DestinationRoot != op.DestinationRoot {
+		err = op.openCardRoot(run, cardOp.DestinationRoot)
+		if err != nil {
+			return err
+		}
+	}
 
-			// Check if source folder exists
-			exists, err := folderExists(folderSourceRoot)
+	if c.Volume == c.Name {
+		fmt.Printf("[%s] Backing up card\n", c.Name)
+	} else {
+		fmt.Printf("[%s] Backing up card (mounted at %s)\n", c.Name, sdCardPath)
+	}
+	if run.Progress != nil {
+		totals, ok := run.CardTotals[c.Name]
+		if !ok {
+			totals, err = op.scanCard(run, c)
 			if err != nil {
 				return err
 			}
-			if !exists {
-				continue
-			}
+			run.Progress.AddTotal(totals.Files, totals.Bytes)
+		}
+		run.Progress.StartCard(c.Name, totals.Files, totals.Bytes)
+	}
 
-			err = op.backupFolder(cardName, fm, filterClassification(fc))
+	// Mapped folders that don't exist on the card are skipped.
+	folders, err := cardOp.mappedFolders(c)
+	if err != nil {
+		return err
+	}
+	op.startImport(run, c)
+	for _, fc := range run.Classifier.table.backupOrder() {
+		classificationFolder, err := run.Classifier.table.folder(fc)
+		if err != nil {
+			return err
+		}
+		if op.excludesClassification(c.Name, classificationFolder) {
+			continue
+		}
+		for _, mf := range folders {
+			err = cardOp.backupFolder(run, c, mf, filterClassification(fc))
 			if err != nil {
 				return err
 			}
 		}
 	}
 
+	err = run.Syncer.Flush()
+	if err != nil {
+		return err
+	}
+	err = op.finishImport(run, c)
+	if err != nil {
+		return err
+	}
+	// Files skipped by filter rules from the command line haven't been looked
+	// at, so their entries in earlier journals are kept.
+	if op.Options.Filters.isEmpty() {
+		run.Finished[c.Name] = true
+	}
+
+	if run.Progress != nil {
+		run.Progress.FinishCard()
+	}
 	fmt.Println("")
 	return nil
 }
 
-// BackupAllCards backs up all cards in `op.SDCardNames`.
-func (op Operation) BackupAllCards() error {
+// BackupAllCards backs up all cards in `op.SDCardNames`, as well as any cards
+// with an identity file if `op.DiscoverCards` is set.
+func (op Operation) BackupAllCards() (err error) {
 	// Check if source folder exists
 	exists, err := folderExists(op.SDCardMountPoint)
 	if err != nil {
@@ -219,13 +500,45 @@ func (op Operation) BackupAllCards() error {
 
 	fmt.Printf("--------\n")
 	fmt.Printf("Backing up from:\n  %s\n", op.SDCardMountPoint)
-	fmt.Printf("Backing up to:\n  %s\n", op.DestinationRoot)
+	fmt.Printf("Backing up to:\n")
+	if op.S3 != nil {
+		fmt.Printf("  %s/%s/%s (state in %s)\n", strings.TrimSuffix(op.S3.Endpoint, "/"), op.S3.Bucket, strings.Trim(op.S3.Prefix, "/"), op.DestinationRoot)
+	} else {
+		for _, root := range op.destinationRoots() {
+			fmt.Printf("  %s\n", root)
+		}
+		for _, cc := range op.Cards {
+			if cc.DestinationRoot != "" {
+				fmt.Printf("  %s (%s)\n", cc.DestinationRoot, cc.Name)
+			}
+		}
+	}
 	fmt.Printf("--------\n")
-	for _, s := range op.SDCardNames {
-		err := op.BackupCard(s)
+
+	run, err := op.newBackupRun()
+	if err != nil {
+		return err
+	}
+	defer func() { err = errors.Join(err, run.close()) }()
+
+	cards, err := op.cards()
+	if err != nil {
+		return err
+	}
+
+	if run.Progress != nil {
+		err = op.scanCards(run, cards)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+
+	for _, c := range cards {
+		err := op.backupCard(run, c)
+		if err != nil {
+			return err
+		}
+	}
+	run.printRootSummary()
+	return run.complete()
 }
@@ -0,0 +1,225 @@
+package backup
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Cards can be identified by this file at their root, which is written by
+// `sd-card-backup register-card`.
+const cardIdentityFileName = ".sd-card-backup.json"
+
+// CardIdentity is the contents of the identity file.
+type CardIdentity struct {
+	// Stable, even if the volume is renamed.
+	ID string `json:"id"`
+	// Used instead of the volume name for destination folders.
+	Name string `json:"name"`
+}
+
+// card is a card to back up.
+type card struct {
+	// The folder in `SDCardMountPoint` that the card is mounted at.
+	Volume string
+	// Used for the destination folder, and in the manifest and journals.
+	Name string
+	// From the identity file, if there is one.
+	ID string
+	// Set if the card matched an entry in `Cards`.
+	UUID string
+}
+
+func (op Operation) cardRoot(c card) string {
+	return filepath.Join(op.SDCardMountPoint, c.Volume)
+}
+
+func validateCardName(name string) error {
+	if name == "" {
+		return errors.New("empty card name")
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid card name: %#v", name)
+	}
+	return nil
+}
+
+// ReadCardIdentity reads the identity file of the card mounted at `cardRoot`.
+// Returns an error satisfying `errors.Is(err, os.ErrNotExist)` if the card
+// has no identity file.
+func ReadCardIdentity(cardRoot string) (CardIdentity, error) {
+	path := filepath.Join(cardRoot, cardIdentityFileName)
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return CardIdentity{}, err
+	}
+	identity := CardIdentity{}
+	err = json.Unmarshal(contents, &identity)
+	if err != nil {
+		return CardIdentity{}, fmt.Errorf("invalid card identity file %s: %s", path, err)
+	}
+	if identity.ID == "" {
+		return CardIdentity{}, fmt.Errorf("missing `id` in card identity file: %s", path)
+	}
+	err = validateCardName(identity.Name)
+	if err != nil {
+		return CardIdentity{}, fmt.Errorf("%s in card identity file: %s", err, path)
+	}
+	return identity, nil
+}
+
+func newCardID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RegisterCard writes a new identity file with the given `name` to the card
+// mounted at `cardRoot`. An existing identity file is only replaced if
+// `overwrite` is true.
+func RegisterCard(cardRoot string, name string, overwrite bool) (CardIdentity, error) {
+	err := validateCardName(name)
+	if err != nil {
+		return CardIdentity{}, err
+	}
+	exists, err := folderExists(cardRoot)
+	if err != nil {
+		return CardIdentity{}, err
+	}
+	if !exists {
+		return CardIdentity{}, fmt.Errorf("card is not mounted: %s", cardRoot)
+	}
+
+	id, err := newCardID()
+	if err != nil {
+		return CardIdentity{}, err
+	}
+	identity := CardIdentity{ID: id, Name: name}
+	contents, err := json.MarshalIndent(identity, "", "  ")
+	if err != nil {
+		return CardIdentity{}, err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	path := filepath.Join(cardRoot, cardIdentityFileName)
+	file, err := os.OpenFile(path, flags, 0644)
+	if os.IsExist(err) {
+		return CardIdentity{}, fmt.Errorf("card is already registered: %s", path)
+	}
+	if err != nil {
+		return CardIdentity{}, err
+	}
+	_, err = file.Write(append(contents, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return CardIdentity{}, err
+	}
+	return identity, closeErr
+}
+
+// cardForVolume returns the card mounted at `volume`. A matching entry in
+// `Cards` determines the name of the card. Otherwise, volumes listed in
+// `SDCardNames` keep their volume name (so that their destination folders
+// don't change when they are registered), and other volumes use the name from
+// their identity file.
+func (op Operation) cardForVolume(volume string) (card, error) {
+	c := card{Volume: volume, Name: volume}
+	if op.hasCardUUIDs() {
+		// Volumes that aren't mounted (or whose UUID can't be read) are left
+		// to the other ways of identifying cards.
+		uuid, err := lookupVolumeUUID(op.cardRoot(c))
+		if err == nil {
+			if cc, ok := op.cardConfigForUUID(uuid); ok {
+				c.Name = cc.Name
+				c.UUID = uuid
+			}
+		}
+	}
+
+	identity, err := ReadCardIdentity(op.cardRoot(c))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return card{}, err
+	}
+	c.ID = identity.ID
+	if c.UUID == "" && !op.isListedVolume(volume) {
+		c.Name = identity.Name
+	}
+	return c, nil
+}
+
+func (op Operation) isListedVolume(volume string) bool {
+	for _, name := range op.SDCardNames {
+		if name == volume {
+			return true
+		}
+	}
+	return false
+}
+
+// unlistedVolumes returns the folders in `SDCardMountPoint` that aren't listed
+// in `SDCardNames`.
+func (op Operation) unlistedVolumes() ([]string, error) {
+	entries, err := os.ReadDir(op.SDCardMountPoint)
+	if err != nil {
+		return nil, err
+	}
+	volumes := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() && !op.isListedVolume(entry.Name()) {
+			volumes = append(volumes, entry.Name())
+		}
+	}
+	sort.Strings(volumes)
+	return volumes, nil
+}
+
+// cards returns the cards listed in `SDCardNames` (whether or not they are
+// mounted), followed by any mounted cards that match an entry in `Cards`, or
+// that have an identity file if `DiscoverCards` is set.
+func (op Operation) cards() ([]card, error) {
+	volumes := append([]string{}, op.SDCardNames...)
+	if op.DiscoverCards || op.hasCardUUIDs() {
+		unlisted, err := op.unlistedVolumes()
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, unlisted...)
+	}
+
+	cards := []card{}
+	volumesByName := map[string]string{}
+	for _, volume := range volumes {
+		c, err := op.cardForVolume(volume)
+		if err != nil {
+			return nil, err
+		}
+		identified := c.UUID != "" || (op.DiscoverCards && c.ID != "")
+		if !op.isListedVolume(volume) && !identified {
+			continue
+		}
+		if other, ok := volumesByName[c.Name]; ok {
+			return nil, fmt.Errorf("more than one card is named %s: %s, %s", c.Name, other, c.Volume)
+		}
+		volumesByName[c.Name] = c.Volume
+		cards = append(cards, c)
+	}
+	return cards, nil
+}
@@ -0,0 +1,207 @@
+package backup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRegisterCard(t *testing.T) {
+	cardRoot := t.TempDir()
+
+	_, err := ReadCardIdentity(cardRoot)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing identity file, got %v", err)
+	}
+
+	identity, err := RegisterCard(cardRoot, "HERA", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identity.ID) != 32 {
+		t.Errorf("Unexpected card ID: %#v", identity.ID)
+	}
+
+	read, err := ReadCardIdentity(cardRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != identity {
+		t.Errorf("Expected %+v, got %+v", identity, read)
+	}
+
+	_, err = RegisterCard(cardRoot, "ZEUS", false)
+	if err == nil || !strings.HasPrefix(err.Error(), "card is already registered") {
+		t.Errorf("Expected an error for an already registered card, got %v", err)
+	}
+
+	replaced, err := RegisterCard(cardRoot, "ZEUS", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.ID == identity.ID {
+		t.Errorf("Expected a new card ID")
+	}
+
+	_, err = RegisterCard(cardRoot, "../ZEUS", true)
+	if err == nil {
+		t.Errorf("Expected an error for an invalid card name")
+	}
+}
+
+func TestDiscoverCards(t *testing.T) {
+	mountPoint := t.TempDir()
+	for _, volume := range []string{"HERA", "EOS_DIGITAL", "Untitled", "NO NAME"} {
+		err := os.Mkdir(filepath.Join(mountPoint, volume), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	registrations := map[string]string{
+		"HERA":        "Hera",
+		"EOS_DIGITAL": "R5 Card 1",
+		"Untitled":    "FX3 Card 2",
+	}
+	for volume, name := range registrations {
+		_, err := RegisterCard(filepath.Join(mountPoint, volume), name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op := Operation{
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA", "ZEUS"},
+		DiscoverCards:    true,
+	}
+	cards, err := op.cards()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []card{
+		// Listed cards keep their volume name.
+		{Volume: "HERA", Name: "HERA"},
+		{Volume: "ZEUS", Name: "ZEUS"},
+		{Volume: "EOS_DIGITAL", Name: "R5 Card 1"},
+		{Volume: "Untitled", Name: "FX3 Card 2"},
+	}
+	if len(cards) != len(want) {
+		t.Fatalf("Expected %d cards, got %+v", len(want), cards)
+	}
+	for i, c := range cards {
+		if c.Volume != want[i].Volume || c.Name != want[i].Name {
+			t.Errorf("[%d] Expected %+v, got %+v", i, want[i], c)
+		}
+		if c.Volume != "ZEUS" && c.ID == "" {
+			t.Errorf("[%s] Expected a card ID", c.Volume)
+		}
+	}
+
+	// Without discovery, only the listed cards are backed up.
+	op.DiscoverCards = false
+	cards, err = op.cards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 2 {
+		t.Errorf("Expected 2 cards, got %+v", cards)
+	}
+
+	// Names must be unique.
+	op.DiscoverCards = true
+	op.SDCardNames = []string{"R5 Card 1"}
+	err = os.Mkdir(filepath.Join(mountPoint, "R5 Card 1"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = op.cards()
+	if err == nil || !strings.HasPrefix(err.Error(), "more than one card is named R5 Card 1") {
+		t.Errorf("Expected an error for duplicate card names, got %v", err)
+	}
+}
+
+func TestCardOverrides(t *testing.T) {
+	mountPoint := t.TempDir()
+	archive := t.TempDir()
+	audioArchive := t.TempDir()
+	files := map[string]string{
+		"HERA/DCIM/100CANON/IMG_0001.JPG": "\xFF\xD8\xFF IMG_0001.JPG",
+		"ZOOM/FOLDER01/ZOOM0001.WAV":      "RIFF ZOOM0001.WAV",
+		"ZOOM/FOLDER01/ZOOM0001.TXT":      "notes",
+		// Not in the card's folder mapping.
+		"ZOOM/DCIM/100CANON/IMG_0002.JPG": "\xFF\xD8\xFF IMG_0002.JPG",
+	}
+	for path, contents := range files {
+		path = filepath.Join(mountPoint, path)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op, err := operationFromBytes([]byte(`{
+  "destination_root": "` + archive + `",
+  "sd_card_mount_point": "` + mountPoint + `",
+  "sd_card_names": ["HERA", "ZOOM"],
+  "folder_mapping": [{"source": "DCIM", "destination": "DCIM"}],
+  "cards": [{
+    "name": "ZOOM",
+    "folder_mapping": [{"source": "FOLDER01", "destination": "FOLDER01"}],
+    "destination_root": "` + audioArchive + `",
+    "exclude_classifications": ["Unsorted"]
+  }]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = op.BackupAllCards()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantBackups := map[string][]string{
+		archive:      {"HERA/DCIM/100CANON/IMG_0001.JPG"},
+		audioArchive: {"ZOOM/FOLDER01/ZOOM0001.WAV"},
+	}
+	for root, want := range wantBackups {
+		entries, err := latestManifestEntries(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, entry := range entries {
+			got = append(got, entry.Card+"/"+entry.SourcePath)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("[%s] Expected %#v, got %#v", root, want, got)
+		}
+	}
+
+	verifications, err := op.VerifyCards([]string{"HERA", "ZOOM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifications[0].Safe() {
+		t.Errorf("Expected HERA to be safe to format: %s", verifications[0])
+	}
+	problems := []string{}
+	for _, p := range verifications[1].Problems {
+		problems = append(problems, p.String())
+	}
+	wantProblems := []string{
+		"DCIM/100CANON/IMG_0002.JPG: not in a mapped folder",
+		"FOLDER01/ZOOM0001.TXT: in an excluded classification (Unsorted)",
+	}
+	sort.Strings(problems)
+	if strings.Join(problems, "\n") != strings.Join(wantProblems, "\n") {
+		t.Errorf("Expected %#v, got %#v", wantProblems, problems)
+	}
+}
@@ -1,12 +1,17 @@
 package backup
 
 import (
+	"errors"
+	"fmt"
 	"path/filepath"
 	"strings"
 )
 
+// fileClassification is an index into a `classificationTable`.
 type fileClassification int
 
+// Indices into `builtinClassifications`. Every table starts with
+// `unclassifiedFile`.
 const (
 	unclassifiedFile = iota
 	imageFile
@@ -15,78 +20,260 @@ const (
 	audioFile
 )
 
-// TODO: This is currently conservative. A more robust approach using file(1) or
-// `http.DetectContentType` would be nice, although both are hacky.
+// classification defines a destination folder for files with the given
+// extensions or contents.
+type classification struct {
+	Folder string `json:"folder"`
+	// With a leading period, e.g. `.jpg`. Matched case-insensitively.
+	Extensions []string `json:"extensions"`
+	// Content kinds recognized by `sniffContent`, e.g. `jpeg` or `mp4`.
+	Signatures []contentKind `json:"signatures"`
+}
+
+// classificationTable lists the classifications in the order they are backed
+// up. Index 0 is reserved for unclassified files, which are backed up last.
+type classificationTable []classification
+
+const unclassifiedFolder = "Unsorted"
+
+// Extensions are a cheap first pass. `classifyPath` also looks at the contents
+// of each file (see `sniffContent`), which wins if the two disagree.
 //
 // Also see https://en.wikipedia.org/wiki/Raw_image_format#File_contents
-var imageExtensions = map[string]bool{
-	".arw":  true,
-	".bmp":  true,
-	".cr2":  true,
-	".cr3":  true,
-	".dng":  true,
-	".gif":  true,
-	".jpeg": true,
-	".jpg":  true,
-	".nef":  true,
-	".png":  true,
-	".raw":  true,
-	".tif":  true,
-	".webm": true,
+var builtinClassifications = classificationTable{
+	unclassifiedFile: {
+		Folder: unclassifiedFolder,
+	},
+	imageFile: {
+		Folder: "Images",
+		Extensions: []string{
+			".arw",
+			".bmp",
+			".cr2",
+			".cr3",
+			".dng",
+			".gif",
+			".jpeg",
+			".jpg",
+			".nef",
+			".png",
+			".raw",
+			".tif",
+			".webm",
+		},
+		Signatures: []contentKind{
+			jpegContent,
+			pngContent,
+			gifContent,
+			webpContent,
+			tiffContent,
+			rawTIFFContent,
+			heicContent,
+			crxContent,
+		},
+	},
+	videoFile: {
+		Folder: "Videos",
+		Extensions: []string{
+			".avi",
+			".m4v",
+			".mkv",
+			".mov",
+			".mp4",
+			".mpeg:",
+			".mpg:",
+			".mts",
+			".mxf",
+		},
+		Signatures: []contentKind{
+			mp4Content,
+			movContent,
+			aviContent,
+			matroskaContent,
+			mpegTSContent,
+			mpegPSContent,
+			mxfContent,
+		},
+	},
+	rawVideoFile: {
+		Folder: "RAW Video",
+		Extensions: []string{
+			".crm", // Canon raw movie
+		},
+		Signatures: []contentKind{
+			crxContent,
+		},
+	},
+	audioFile: {
+		Folder: "Audio",
+		Extensions: []string{
+			".aac",
+			".aif",
+			".aiff",
+			".flac",
+			".m4a",
+			".mp3",
+			".ogg",
+			".wav",
+			".wma",
+		},
+		Signatures: []contentKind{
+			m4aContent,
+			wavContent,
+			aiffContent,
+			flacContent,
+			oggContent,
+			mp3Content,
+		},
+	},
+}
+
+// tableFromConfig prepends the unclassified entry to the `classifications`
+// from the config.
+func tableFromConfig(classifications []classification) classificationTable {
+	table := classificationTable{builtinClassifications[unclassifiedFile]}
+	return append(table, classifications...)
+}
+
+func (c classification) validate() error {
+	if c.Folder == "" {
+		return fmt.Errorf("missing `folder` in classification: %+v", c)
+	}
+	if c.Folder == unclassifiedFolder {
+		return fmt.Errorf("reserved `folder` in classification: %s", c.Folder)
+	}
+	if len(c.Extensions) == 0 && len(c.Signatures) == 0 {
+		return fmt.Errorf("classification needs `extensions` or `signatures`: %s", c.Folder)
+	}
+	for _, ext := range c.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("extension must start with a period: %#v", ext)
+		}
+	}
+	for _, signature := range c.Signatures {
+		if !knownContentKinds[signature] {
+			return fmt.Errorf("unknown signature: %#v", signature)
+		}
+	}
+	return nil
+}
+
+func (table classificationTable) validate() error {
+	if len(table) < 2 {
+		return errors.New("empty `classifications`")
+	}
+	folders := map[string]bool{}
+	extensions := map[string]string{}
+	for _, c := range table[1:] {
+		err := c.validate()
+		if err != nil {
+			return err
+		}
+		if folders[c.Folder] {
+			return fmt.Errorf("duplicate classification folder: %s", c.Folder)
+		}
+		folders[c.Folder] = true
+		for _, ext := range c.Extensions {
+			extLower := strings.ToLower(ext)
+			if other, ok := extensions[extLower]; ok {
+				return fmt.Errorf("extension %s is in more than one classification: %s, %s", ext, other, c.Folder)
+			}
+			extensions[extLower] = c.Folder
+		}
+	}
+	return nil
 }
 
-// TODO: This is currently conservative. A more robust approach using file(1) or
-// `http.DetectContentType` would be nice, although both are hacky.
-var videoExtensions = map[string]bool{
-	".avi":   true,
-	".m4v":   true,
-	".mkv":   true,
-	".mov":   true,
-	".mp4":   true,
-	".mpeg:": true,
-	".mpg:":  true,
-	".mts":   true,
-	".mxf":   true,
+// backupOrder returns the classifications in the order in which they should be
+// backed up.
+func (table classificationTable) backupOrder() []fileClassification {
+	order := []fileClassification{}
+	for i := 1; i < len(table); i++ {
+		order = append(order, fileClassification(i))
+	}
+	return append(order, unclassifiedFile)
 }
 
-// TODO: This is currently conservative. A more robust approach using file(1) or
-// `http.DetectContentType` would be nice, although both are hacky.
-var rawVideoExtensions = map[string]bool{
-	".crm": true, // Canon raw movie
+func (table classificationTable) folder(fc fileClassification) (string, error) {
+	if fc < 0 || int(fc) >= len(table) {
+		return "", fmt.Errorf("Unknown classification: %d", fc)
+	}
+	return table[fc].Folder, nil
 }
 
-// TODO: This is currently conservative. A more robust approach using file(1) or
-// `http.DetectContentType` would be nice, although both are hacky.
-var audioExtensions = map[string]bool{
-	".aac":  true,
-	".aif":  true,
-	".aiff": true,
-	".flac": true,
-	".m4a":  true,
-	".mp3":  true,
-	".ogg":  true,
-	".wav":  true,
-	".wma":  true,
+func (table classificationTable) hasFolder(folder string) bool {
+	for _, c := range table {
+		if c.Folder == folder {
+			return true
+		}
+	}
+	return false
 }
 
 // classifyExt classifies `ext`, expecting a leading period. `ext` will be
 // normalized to lowercase first.
-func classifyExt(ext string) fileClassification {
+func (table classificationTable) classifyExt(ext string) fileClassification {
 	extLower := strings.ToLower(ext)
-	switch {
-	case imageExtensions[extLower]:
-		return imageFile
-	case videoExtensions[extLower]:
-		return videoFile
-	case rawVideoExtensions[extLower]:
-		return rawVideoFile
-	case audioExtensions[extLower]:
-		return audioFile
-	default:
-		return unclassifiedFile
+	for i, c := range table {
+		for _, e := range c.Extensions {
+			if strings.ToLower(e) == extLower {
+				return fileClassification(i)
+			}
+		}
+	}
+	return unclassifiedFile
+}
+
+// classifyContent combines the classification by extension with the kind of
+// content. The content wins if they disagree, but the extension is used to
+// pick between the classifications that the content is compatible with
+// (otherwise, the first one in the table wins).
+func (table classificationTable) classifyContent(byExt fileClassification, kind contentKind) fileClassification {
+	if kind == unknownContent {
+		return byExt
+	}
+	compatible := []fileClassification{}
+	for i, c := range table {
+		for _, signature := range c.Signatures {
+			if signature == kind {
+				compatible = append(compatible, fileClassification(i))
+			}
+		}
+	}
+	if len(compatible) == 0 {
+		return byExt
+	}
+	for _, c := range compatible {
+		if c == byExt {
+			return byExt
+		}
 	}
+	return compatible[0]
 }
 
-func classifyPath(path string) fileClassification {
-	return classifyExt(filepath.Ext(path))
+func (table classificationTable) classifyPath(path string) fileClassification {
+	return table.classifyContent(table.classifyExt(filepath.Ext(path)), sniffFile(path))
+}
+
+// classifier caches classifications, since each file is visited once for each
+// classification in the table.
+type classifier struct {
+	table classificationTable
+	cache map[string]fileClassification
+}
+
+func newClassifier(table classificationTable) *classifier {
+	return &classifier{
+		table: table,
+		cache: map[string]fileClassification{},
+	}
+}
+
+func (c *classifier) classifyPath(path string) fileClassification {
+	if classification, ok := c.cache[path]; ok {
+		return classification
+	}
+	classification := c.table.classifyPath(path)
+	c.cache[path] = classification
+	return classification
 }
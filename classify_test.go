@@ -1,6 +1,9 @@
 package backup
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 var classificationCases = []struct {
 	ext                string
@@ -17,9 +20,50 @@ var classificationCases = []struct {
 
 func TestClassifyExt(t *testing.T) {
 	for _, c := range classificationCases {
-		actual := classifyExt(c.ext)
+		actual := builtinClassifications.classifyExt(c.ext)
 		if actual != c.wantClassification {
 			t.Errorf("[%s] Expected %d, got %d", c.ext, c.wantClassification, actual)
 		}
 	}
 }
+
+func TestCustomClassifications(t *testing.T) {
+	op, err := operationFromBytes([]byte(`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "DCIM", "destination": "DCIM"}],
+  "classifications": [
+    {"folder": "BRAW", "extensions": [".braw"]},
+    {"folder": "Photos", "extensions": [".jpg", ".HEIC"], "signatures": ["jpeg", "heic"]}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("Unable to read valid config: %s", err)
+	}
+
+	table := op.classificationTable()
+	cases := []struct {
+		ext        string
+		wantFolder string
+	}{
+		{".braw", "BRAW"},
+		{".heic", "Photos"},
+		{".JPG", "Photos"},
+		{".mp4", "Unsorted"},
+	}
+	for _, c := range cases {
+		folder, err := table.folder(table.classifyExt(c.ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if folder != c.wantFolder {
+			t.Errorf("[%s] Expected %s, got %s", c.ext, c.wantFolder, folder)
+		}
+	}
+
+	wantOrder := []fileClassification{1, 2, unclassifiedFile}
+	if order := table.backupOrder(); !reflect.DeepEqual(order, wantOrder) {
+		t.Errorf("Expected backup order %v, got %v", wantOrder, order)
+	}
+}
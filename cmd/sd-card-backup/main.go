@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	backup "github.com/lgarron/sd-card-backup"
 )
@@ -13,7 +19,49 @@ import (
 var dryRun = flag.Bool("dry-run", false, "Print what would happen, but don't modify the filesystem.")
 var revealPathOSC8 = flag.Bool("reveal-path-URLs", false, "Print `reveal-path://` URLs using OSC 8 hyperlinks.")
 
+var newOnly = flag.Bool("new-only", false, "Skip files that are older than the newest file imported from their card, without looking at the destination.")
+
+var filters = backup.FilterRules{}
+
+func init() {
+	flag.Var((*stringList)(&filters.Include), "include", "Only back up files that match this `pattern` (e.g. *.JPG). Can be repeated.")
+	flag.Var((*stringList)(&filters.Exclude), "exclude", "Don't back up files that match this `pattern` (e.g. *.LRV). Can be repeated.")
+	flag.Int64Var(&filters.MinSize, "min-size", 0, "Don't back up files smaller than this many `bytes` (e.g. 1 to skip empty files).")
+	flag.Int64Var(&filters.MaxSize, "max-size", 0, "Don't back up files larger than this many `bytes`. 0 means no limit.")
+	flag.StringVar(&filters.CapturedAfter, "captured-after", "", "Only back up files captured on or after this `date` (e.g. 2018-04-21, or an RFC 3339 time).")
+	flag.StringVar(&filters.CapturedBefore, "captured-before", "", "Only back up files captured before this `date`.")
+}
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "register-card":
+			registerCard(os.Args[2:])
+			return
+		case "verify-card":
+			verifyCard(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
+		case "watch":
+			watch(os.Args[2:])
+			return
+		}
+	}
+
 	// Try to parse flags before doing anything.
 	flag.Parse()
 
@@ -25,6 +73,13 @@ func main() {
 
 	op.Options.DryRun = *dryRun
 	op.Options.RevealPathOSC8 = *revealPathOSC8
+	err = filters.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid filter: %s\n", err)
+		os.Exit(2)
+	}
+	op.Options.Filters = filters
+	op.Options.NewOnly = *newOnly
 
 	if len(op.CommandToRunBefore) > 0 {
 		if op.Options.DryRun {
@@ -49,3 +104,152 @@ func main() {
 
 	fmt.Println("Done with `sd-card-backup`!")
 }
+
+func registerCard(args []string) {
+	flags := flag.NewFlagSet("register-card", flag.ExitOnError)
+	name := flags.String("name", "", "Name to use for the card's destination folder. Defaults to the volume name.")
+	overwrite := flags.Bool("overwrite", false, "Replace an existing identity file. The card gets a new ID.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: sd-card-backup register-card [flags] VOLUME\n\n")
+		fmt.Fprintf(flags.Output(), "Writes a card identity file to VOLUME, which is either a path or the name of\na volume in `sd_card_mount_point`.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cardRoot := flags.Arg(0)
+	if !strings.ContainsRune(cardRoot, filepath.Separator) {
+		op, err := backup.OperationFromConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read config file: %s\n", err)
+			os.Exit(1)
+		}
+		cardRoot = filepath.Join(op.SDCardMountPoint, cardRoot)
+	}
+	if *name == "" {
+		*name = filepath.Base(cardRoot)
+	}
+
+	identity, err := backup.RegisterCard(cardRoot, *name, *overwrite)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error registering card: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Registered card %s (ID: %s) at:\n  %s\n", identity.Name, identity.ID, cardRoot)
+}
+
+func verifyCard(args []string) {
+	flags := flag.NewFlagSet("verify-card", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: sd-card-backup verify-card [VOLUME ...]\n\n")
+		fmt.Fprintf(flags.Output(), "Checks that every file on the given cards (or all mounted cards) has been\nbacked up, and reports whether each card is safe to format.\n")
+	}
+	flags.Parse(args)
+
+	op, err := backup.OperationFromConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read config file: %s\n", err)
+		os.Exit(1)
+	}
+
+	verifications, err := op.VerifyCards(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying: %s\n", err)
+		os.Exit(1)
+	}
+	if len(verifications) == 0 {
+		fmt.Fprintln(os.Stderr, "No cards are mounted.")
+		os.Exit(1)
+	}
+	for _, verification := range verifications {
+		if !verification.Safe() {
+			os.Exit(1)
+		}
+	}
+}
+
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	workers := flags.Int("workers", 4, "Number of files to verify at the same time.")
+	rateLimit := flags.Float64("rate-limit", 0, "Maximum read rate in MB/s, shared by all workers. 0 means no limit.")
+	maxDuration := flags.Duration("max-duration", 0, "Stop after this long (e.g. `6h`), to resume on the next invocation. 0 means no limit.")
+	restart := flags.Bool("restart", false, "Start a new pass, instead of resuming an unfinished one.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: sd-card-backup verify [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Re-hashes the files in the destination and compares them with the manifest.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	op, err := backup.OperationFromConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read config file: %s\n", err)
+		os.Exit(1)
+	}
+
+	result, err := op.VerifyArchive(backup.VerifyOptions{
+		Workers:        *workers,
+		BytesPerSecond: int64(*rateLimit * 1000 * 1000),
+		MaxDuration:    *maxDuration,
+		Restart:        *restart,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying: %s\n", err)
+		os.Exit(1)
+	}
+	if result.Failed() {
+		os.Exit(1)
+	}
+}
+
+func watch(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	settleDelay := flags.Duration("settle", 5*time.Second, "How long a card must stay mounted before it is backed up.")
+	debounce := flags.Duration("debounce", time.Minute, "Don't back up a card again if it is mounted again within this long of its last backup.")
+	poll := flags.Bool("poll", false, "Poll for cards instead of using inotify (e.g. for network file systems).")
+	pollInterval := flags.Duration("poll-interval", 5*time.Second, "How often to poll for cards, if polling.")
+	watchDryRun := flags.Bool("dry-run", false, "Print what would happen, but don't modify the filesystem.")
+	watchNewOnly := flags.Bool("new-only", false, "Skip files that are older than the newest file imported from their card, without looking at the destination.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: sd-card-backup watch [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Backs up each card when it is mounted in `sd_card_mount_point`, until\ninterrupted (or stopped with SIGTERM).\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	op, err := backup.OperationFromConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not read config file: %s\n", err)
+		os.Exit(1)
+	}
+	op.Options.DryRun = *watchDryRun
+	op.Options.NewOnly = *watchNewOnly
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// A second signal stops immediately. An interrupted backup is resumed
+		// from its journal by the next run.
+		stop()
+	}()
+
+	err = op.Watch(ctx, backup.WatchOptions{
+		SettleDelay:  *settleDelay,
+		Debounce:     *debounce,
+		Poll:         *poll,
+		PollInterval: *pollInterval,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error watching: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Done with `sd-card-backup watch`!")
+}
@@ -20,6 +20,11 @@ func operationFromBytes(b []byte) (*Operation, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Everything that only uses one root (e.g. journals and verification) uses
+	// the primary root.
+	if len(config.DestinationRoots) > 0 {
+		config.DestinationRoot = config.DestinationRoots[0]
+	}
 
 	return &config, nil
 }
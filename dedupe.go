@@ -0,0 +1,140 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	gosync "sync"
+	"time"
+
+	"github.com/lgarron/sd-card-backup/progress"
+	"github.com/lgarron/sd-card-backup/sync"
+)
+
+// duplicateIndex finds files in the destination roots by size and hash, using
+// the manifests and the files copied during the run. It implements
+// `sync.DuplicateFinder`.
+type duplicateIndex struct {
+	run       *backupRun
+	algorithm sync.HashAlgorithm
+	// Files are added by concurrent copies.
+	mutex *gosync.Mutex
+	// Destination paths (relative to the root), by root, size, and hash.
+	files map[string]map[int64]map[string]string
+	// The latest entry for each destination path, by root.
+	recorded    map[string]map[string]ManifestEntry
+	linkedFiles int
+	savedBytes  int64
+}
+
+// newDuplicateIndex indexes the manifests of all active roots. Entries with a
+// different hash algorithm are ignored.
+func newDuplicateIndex(run *backupRun, algorithm sync.HashAlgorithm) (*duplicateIndex, error) {
+	index := &duplicateIndex{
+		run:       run,
+		algorithm: algorithm,
+		mutex:     &gosync.Mutex{},
+		files:     map[string]map[int64]map[string]string{},
+		recorded:  map[string]map[string]ManifestEntry{},
+	}
+	for _, root := range run.allRoots() {
+		if !root.active() {
+			continue
+		}
+		err := index.addRoot(root.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// addRoot indexes the manifest of the given root.
+func (index *duplicateIndex) addRoot(rootPath string) error {
+	entries, err := ReadManifest(rootPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		index.add(rootPath, entry)
+	}
+	return nil
+}
+
+// add keeps the first file recorded with each size and hash, so that later
+// copies all link to the same file.
+func (index *duplicateIndex) add(rootPath string, entry ManifestEntry) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if index.recorded[rootPath] == nil {
+		index.recorded[rootPath] = map[string]ManifestEntry{}
+	}
+	index.recorded[rootPath][entry.DestinationPath] = entry
+	if entry.HashAlgorithm != string(index.algorithm) || entry.Hash == "" {
+		return
+	}
+	if index.files[rootPath] == nil {
+		index.files[rootPath] = map[int64]map[string]string{}
+	}
+	if index.files[rootPath][entry.Size] == nil {
+		index.files[rootPath][entry.Size] = map[string]string{}
+	}
+	if _, ok := index.files[rootPath][entry.Size][entry.Hash]; !ok {
+		index.files[rootPath][entry.Size][entry.Hash] = entry.DestinationPath
+	}
+}
+
+func (index *duplicateIndex) HasSize(dest string, size int64) bool {
+	root, err := index.run.rootFor(dest)
+	if err != nil {
+		return false
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return len(index.files[root.Path][size]) > 0
+}
+
+func (index *duplicateIndex) Find(dest string, size int64, hash string) (string, bool) {
+	root, err := index.run.rootFor(dest)
+	if err != nil {
+		return "", false
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	destinationPath, ok := index.files[root.Path][size][hash]
+	if !ok {
+		return "", false
+	}
+	existing := filepath.Join(root.Path, destinationPath)
+	if existing == dest {
+		return "", false
+	}
+	return existing, true
+}
+
+func (index *duplicateIndex) Recorded(dest string) (int64, time.Time, bool) {
+	root, err := index.run.rootFor(dest)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	destinationPath, err := filepath.Rel(root.Path, dest)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	entry, ok := index.recorded[root.Path][destinationPath]
+	return entry.Size, entry.ModTime, ok
+}
+
+func (index *duplicateIndex) recordLink(size int64) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	index.linkedFiles++
+	index.savedBytes += size
+}
+
+func (index *duplicateIndex) String() string {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	return fmt.Sprintf("🔗 %d duplicate files linked instead of copied, saving %s", index.linkedFiles, progress.FormatBytes(index.savedBytes))
+}
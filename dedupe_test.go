@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDedupeHardLinks(t *testing.T) {
+	mountPoint := t.TempDir()
+	destinationRoot := t.TempDir()
+	// The same photo, copied between cards with a different modification time.
+	for i, volume := range []string{"HERA", "ZEUS"} {
+		path := filepath.Join(mountPoint, volume, "DCIM/100CANON/IMG_0001.JPG")
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte("\xFF\xD8\xFF IMG_0001.JPG"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Date(2018, 4, 21, 10, 30+i, 0, 0, time.UTC)
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op := Operation{
+		DestinationRoot:  destinationRoot,
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA", "ZEUS"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+		Dedupe:           "hardlink",
+	}
+	// The second backup checks that linked files aren't copied again.
+	for i := 0; i < 2; i++ {
+		err := op.BackupAllCards()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ReadManifest(destinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 manifest entries, got %+v", entries)
+	}
+	if entries[0].LinkedTo != "" || entries[1].LinkedTo != entries[0].DestinationPath {
+		t.Errorf("Expected %s to be linked to %s, got %#v", entries[1].DestinationPath, entries[0].DestinationPath, entries[1].LinkedTo)
+	}
+	first, err := os.Stat(filepath.Join(destinationRoot, entries[0].DestinationPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.Stat(filepath.Join(destinationRoot, entries[1].DestinationPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(first, second) {
+		t.Errorf("Expected a hard link")
+	}
+
+	// Later backups compare linked files with the manifest, without reading
+	// them (so this bit rot is left for `verify` to find).
+	err = os.WriteFile(filepath.Join(destinationRoot, entries[0].DestinationPath), []byte("\xFF\xD8\xFF IMG_0009.JPG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = op.BackupCard("ZEUS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = ReadManifest(destinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected the linked file not to be copied again, got %+v", entries)
+	}
+}
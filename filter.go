@@ -0,0 +1,211 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FilterRules decide which files are backed up. They can be set in the config
+// (globally, per card, and per folder mapping) and on the command line. A file
+// is only backed up if it passes all the rules that apply to it.
+type FilterRules struct {
+	// If present, only files that match one of these patterns are backed up.
+	// Patterns without a `/` are matched against the file name, and others
+	// against the path relative to the root of the card (where `**` matches
+	// any number of folders). Matching is case-insensitive.
+	Include []string `json:"include"`
+	// Files that match one of these patterns are not backed up, e.g. `*.LRV`.
+	Exclude []string `json:"exclude"`
+	// In bytes. 0 means no limit.
+	MinSize int64 `json:"min_size"`
+	MaxSize int64 `json:"max_size"`
+	// A date (`2006-01-02`, in local time) or a time (RFC 3339). Files
+	// captured at or after `captured_after`, and before `captured_before`, are
+	// backed up.
+	CapturedAfter  string `json:"captured_after"`
+	CapturedBefore string `json:"captured_before"`
+}
+
+func (rules FilterRules) isEmpty() bool {
+	return len(rules.Include) == 0 && len(rules.Exclude) == 0 && rules.MinSize == 0 && rules.MaxSize == 0 && rules.CapturedAfter == "" && rules.CapturedBefore == ""
+}
+
+func parseFilterTime(s string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func validateFilterPattern(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if strings.Contains(segment, "**") && segment != "**" {
+			return fmt.Errorf("`**` must be a whole folder name in filter pattern: %s", pattern)
+		}
+		_, err := path.Match(segment, "")
+		if err != nil {
+			return fmt.Errorf("invalid filter pattern (%s): %s", err, pattern)
+		}
+	}
+	return nil
+}
+
+// Validate checks the rules, e.g. after setting them from the command line.
+func (rules FilterRules) Validate() error {
+	for _, pattern := range append(append([]string{}, rules.Include...), rules.Exclude...) {
+		err := validateFilterPattern(pattern)
+		if err != nil {
+			return err
+		}
+	}
+	if rules.MinSize < 0 || rules.MaxSize < 0 {
+		return errors.New("negative size in filter rules")
+	}
+	if rules.MaxSize != 0 && rules.MinSize > rules.MaxSize {
+		return fmt.Errorf("`min_size` is larger than `max_size` in filter rules: %d > %d", rules.MinSize, rules.MaxSize)
+	}
+	var after, before time.Time
+	var err error
+	if rules.CapturedAfter != "" {
+		after, err = parseFilterTime(rules.CapturedAfter)
+		if err != nil {
+			return fmt.Errorf("invalid `captured_after` (must be a date or an RFC 3339 time): %s", rules.CapturedAfter)
+		}
+	}
+	if rules.CapturedBefore != "" {
+		before, err = parseFilterTime(rules.CapturedBefore)
+		if err != nil {
+			return fmt.Errorf("invalid `captured_before` (must be a date or an RFC 3339 time): %s", rules.CapturedBefore)
+		}
+	}
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		return fmt.Errorf("`captured_after` must be before `captured_before`: %s, %s", rules.CapturedAfter, rules.CapturedBefore)
+	}
+	return nil
+}
+
+// matchFilterPattern matches `pattern` against `relPath` (relative to the root
+// of the card, with forward slashes).
+func matchFilterPattern(pattern string, relPath string) bool {
+	pattern = strings.ToLower(pattern)
+	relPath = strings.ToLower(relPath)
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(relPath))
+		return matched
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(relPath, "/"), false)
+}
+
+// filteredFile is a file on a card that the rules are checked against. The
+// capture time is only looked up if there is a date rule.
+type filteredFile struct {
+	// Relative to the root of the card.
+	Path        string
+	Size        int64
+	CaptureTime func() (time.Time, error)
+}
+
+// excludedBy returns the rule that excludes `file`, or "" if it passes all the
+// rules. The rules have already been validated.
+func (rules FilterRules) excludedBy(file filteredFile) (string, error) {
+	relPath := filepath.ToSlash(file.Path)
+	if len(rules.Include) > 0 {
+		included := false
+		for _, pattern := range rules.Include {
+			if matchFilterPattern(pattern, relPath) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return fmt.Sprintf("`include` %s", strings.Join(rules.Include, ", ")), nil
+		}
+	}
+	for _, pattern := range rules.Exclude {
+		if matchFilterPattern(pattern, relPath) {
+			return fmt.Sprintf("`exclude` %s", pattern), nil
+		}
+	}
+	if file.Size < rules.MinSize {
+		return fmt.Sprintf("`min_size` %d", rules.MinSize), nil
+	}
+	if rules.MaxSize != 0 && file.Size > rules.MaxSize {
+		return fmt.Sprintf("`max_size` %d", rules.MaxSize), nil
+	}
+	if rules.CapturedAfter == "" && rules.CapturedBefore == "" {
+		return "", nil
+	}
+	t, err := file.CaptureTime()
+	if err != nil {
+		return "", err
+	}
+	if rules.CapturedAfter != "" {
+		after, _ := parseFilterTime(rules.CapturedAfter)
+		if t.Before(after) {
+			return fmt.Sprintf("`captured_after` %s", rules.CapturedAfter), nil
+		}
+	}
+	if rules.CapturedBefore != "" {
+		before, _ := parseFilterTime(rules.CapturedBefore)
+		if !t.Before(before) {
+			return fmt.Sprintf("`captured_before` %s", rules.CapturedBefore), nil
+		}
+	}
+	return "", nil
+}
+
+// filterScope is a set of rules, and where it was set.
+type filterScope struct {
+	Name  string
+	Rules FilterRules
+}
+
+// filterScopes returns the rules that apply to the files of the folder
+// operation.
+func (fo folderOperation) filterScopes() []filterScope {
+	scopes := []filterScope{
+		{"command line", fo.Operation.Options.Filters},
+		{"config", fo.Operation.Filters},
+	}
+	if cc, ok := fo.Operation.cardConfig(fo.CardName); ok {
+		scopes = append(scopes, filterScope{fmt.Sprintf("card %s", fo.CardName), cc.Filters})
+	}
+	scopes = append(scopes, filterScope{fmt.Sprintf("folder mapping %s", fo.FolderMapping.Source), fo.FolderMapping.Filters})
+	return scopes
+}
+
+// filteredOut returns a description of the rule (and where it was set) that
+// excludes the file at `path`, or "" if the file is backed up.
+func (fo folderOperation) filteredOut(path string, info os.FileInfo) (string, error) {
+	relPath, err := filepath.Rel(fo.CardRoot, path)
+	if err != nil {
+		return "", err
+	}
+	file := filteredFile{
+		Path: relPath,
+		Size: info.Size(),
+		// Sidecars go with their primary file, like in `targetPath()`.
+		CaptureTime: func() (time.Time, error) {
+			return captureTime(fo.Run.Sidecars.primaryOrSelf(path))
+		},
+	}
+	for _, scope := range fo.filterScopes() {
+		if scope.Rules.isEmpty() {
+			continue
+		}
+		rule, err := scope.Rules.excludedBy(file)
+		if err != nil {
+			return "", err
+		}
+		if rule != "" {
+			return fmt.Sprintf("%s in %s", rule, scope.Name), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var filterCases = []struct {
+	description string
+	rules       FilterRules
+	path        string
+	size        int64
+	// "" if the file is backed up.
+	want string
+}{
+	{"no rules", FilterRules{}, "DCIM/100GOPRO/GL010123.LRV", 10, ""},
+	{"exclude by name", FilterRules{Exclude: []string{"*.LRV"}}, "DCIM/100GOPRO/GL010123.LRV", 10, "`exclude` *.LRV"},
+	{"exclude is case-insensitive", FilterRules{Exclude: []string{"*.lrv"}}, "DCIM/100GOPRO/GL010123.LRV", 10, "`exclude` *.lrv"},
+	{"exclude by path", FilterRules{Exclude: []string{"DCIM/**/*.THM"}}, "DCIM/100GOPRO/GX010123.THM", 10, "`exclude` DCIM/**/*.THM"},
+	{"path patterns match the whole path", FilterRules{Exclude: []string{"100GOPRO/*"}}, "DCIM/100GOPRO/GX010123.MP4", 10, ""},
+	{"include", FilterRules{Include: []string{"*.MP4", "*.JPG"}}, "DCIM/100GOPRO/GX010123.MP4", 10, ""},
+	{"not included", FilterRules{Include: []string{"*.MP4", "*.JPG"}}, "DCIM/100GOPRO/GL010123.LRV", 10, "`include` *.MP4, *.JPG"},
+	{"empty file", FilterRules{MinSize: 1}, "DCIM/100GOPRO/GX010123.MP4", 0, "`min_size` 1"},
+	{"large file", FilterRules{MaxSize: 1000}, "DCIM/100GOPRO/GX010123.MP4", 1001, "`max_size` 1000"},
+	{"captured after", FilterRules{CapturedAfter: "2018-04-21"}, "DCIM/100GOPRO/GX010123.MP4", 10, ""},
+	{"captured too early", FilterRules{CapturedAfter: "2018-04-22"}, "DCIM/100GOPRO/GX010123.MP4", 10, "`captured_after` 2018-04-22"},
+	{"captured before", FilterRules{CapturedBefore: "2018-04-22"}, "DCIM/100GOPRO/GX010123.MP4", 10, ""},
+	{"captured on the day", FilterRules{CapturedBefore: "2018-04-21"}, "DCIM/100GOPRO/GX010123.MP4", 10, "`captured_before` 2018-04-21"},
+}
+
+func TestFilterRules(t *testing.T) {
+	captureTime := func() (time.Time, error) {
+		return time.Date(2018, 4, 21, 10, 15, 0, 0, time.Local), nil
+	}
+	for _, c := range filterCases {
+		err := c.rules.Validate()
+		if err != nil {
+			t.Fatalf("[%s] %s", c.description, err)
+		}
+		got, err := c.rules.excludedBy(filteredFile{Path: c.path, Size: c.size, CaptureTime: captureTime})
+		if err != nil {
+			t.Fatalf("[%s] %s", c.description, err)
+		}
+		if got != c.want {
+			t.Errorf("[%s] Expected %#v, got %#v", c.description, c.want, got)
+		}
+	}
+}
+
+func TestBackupWithFilters(t *testing.T) {
+	mountPoint := t.TempDir()
+	files := map[string]string{
+		"GOPRO/DCIM/100GOPRO/GX010123.MP4": "\x00\x00\x00\x18ftypmp42 GX010123.MP4",
+		"GOPRO/DCIM/100GOPRO/GL010123.LRV": "\x00\x00\x00\x18ftypmp42 GL010123.LRV",
+		"GOPRO/DCIM/100GOPRO/GX010124.MP4": "",
+	}
+	for path, contents := range files {
+		path = filepath.Join(mountPoint, path)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op := Operation{
+		DestinationRoot:  t.TempDir(),
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"GOPRO"},
+		FolderMapping: []folderMapping{{
+			Source:      "DCIM",
+			Destination: "DCIM",
+			Filters:     FilterRules{Exclude: []string{"*.LRV"}},
+		}},
+		Cards: []cardConfig{{Name: "GOPRO", Filters: FilterRules{MinSize: 1}}},
+	}
+	err := op.BackupCard("GOPRO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := latestManifestEntries(op.DestinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].SourcePath != filepath.FromSlash("DCIM/100GOPRO/GX010123.MP4") {
+		t.Errorf("Expected only GX010123.MP4 to be backed up, got %+v", entries)
+	}
+
+	// Rules from the command line apply as well.
+	op.DestinationRoot = t.TempDir()
+	op.Options.Filters = FilterRules{Include: []string{"*.JPG"}}
+	err = op.BackupCard("GOPRO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = latestManifestEntries(op.DestinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no files to be backed up, got %+v", entries)
+	}
+}
@@ -0,0 +1,247 @@
+package backup
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type matchedPath string
+
+const (
+	// Keep the folders matched by the wildcards in the destination (the
+	// default), e.g. `100CANON/IMG_0001.JPG` for `DCIM/*CANON`.
+	keepMatchedPath matchedPath = "keep"
+	// Back up the files in each matched folder as if it was the `source`, e.g.
+	// `IMG_0001.JPG` for `DCIM/*CANON`.
+	dropMatchedPath matchedPath = "drop"
+)
+
+func (mp matchedPath) validate() error {
+	switch mp {
+	case "", keepMatchedPath, dropMatchedPath:
+		return nil
+	}
+	return fmt.Errorf("unknown `matched_path` in folder mapping (must be `keep` or `drop`): %#v", string(mp))
+}
+
+// sourcePattern returns the segments of the `source` of the folder mapping.
+// Segments can contain the wildcards of `path.Match()`, and a `**` segment
+// matches any number of folders.
+func (fm folderMapping) sourcePattern() []string {
+	source := path.Clean(filepath.ToSlash(fm.Source))
+	if source == "." {
+		// The whole card.
+		return []string{}
+	}
+	return strings.Split(source, "/")
+}
+
+func isWildcardSegment(segment string) bool {
+	return strings.ContainsAny(segment, `*?[\`)
+}
+
+// literalPrefix returns the number of segments before the first segment with
+// a wildcard.
+func literalPrefix(pattern []string) int {
+	for i, segment := range pattern {
+		if isWildcardSegment(segment) {
+			return i
+		}
+	}
+	return len(pattern)
+}
+
+func (fm folderMapping) validateSource() error {
+	if strings.HasPrefix(filepath.ToSlash(fm.Source), "/") {
+		return fmt.Errorf("`source` in folder mapping must be relative to the card: %s", fm.Source)
+	}
+	for _, segment := range fm.sourcePattern() {
+		if segment == ".." {
+			return fmt.Errorf("`source` in folder mapping can't contain `..`: %s", fm.Source)
+		}
+		if strings.Contains(segment, "**") && segment != "**" {
+			return fmt.Errorf("`**` must be a whole folder name in `source`: %s", fm.Source)
+		}
+		_, err := path.Match(segment, "")
+		if err != nil {
+			return fmt.Errorf("invalid pattern in `source` (%s): %s", err, fm.Source)
+		}
+	}
+	return nil
+}
+
+// matchSegments returns whether `name` matches `pattern`, or (if `prefix` is
+// set) could be the start of a path that does.
+func matchSegments(pattern []string, name []string, prefix bool) bool {
+	if len(name) == 0 {
+		if prefix {
+			return true
+		}
+		for _, segment := range pattern {
+			if segment != "**" {
+				return false
+			}
+		}
+		return true
+	}
+	if len(pattern) == 0 {
+		return false
+	}
+	if pattern[0] == "**" {
+		return matchSegments(pattern[1:], name, prefix) || matchSegments(pattern, name[1:], prefix)
+	}
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && matchSegments(pattern[1:], name[1:], prefix)
+}
+
+// sourceFolder is a folder on a card that a folder mapping backs up.
+type sourceFolder struct {
+	// The folder that is backed up.
+	Path string
+	// Paths in the destination are relative to this folder: `Path` itself, or
+	// the part of `source` before the first wildcard if `matched_path` is
+	// `keep`.
+	RelativeTo string
+}
+
+// sourceFolders returns the folders on the card mounted at `cardRoot` that
+// match the `source` of the folder mapping, in lexical order. Folders inside a
+// matched folder are backed up as part of it, even if they also match.
+func (fm folderMapping) sourceFolders(cardRoot string) ([]sourceFolder, error) {
+	pattern := fm.sourcePattern()
+	literal := literalPrefix(pattern)
+	base := filepath.Join(cardRoot, filepath.FromSlash(path.Join(pattern[:literal]...)))
+	exists, err := folderExists(base)
+	if err != nil || !exists {
+		return nil, err
+	}
+	if literal == len(pattern) {
+		return []sourceFolder{{Path: base, RelativeTo: base}}, nil
+	}
+
+	folders := []sourceFolder{}
+	err = filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(base, p)
+		if err != nil {
+			return err
+		}
+		name := []string{}
+		if relPath != "." {
+			name = strings.Split(filepath.ToSlash(relPath), "/")
+		}
+		if len(name) > 0 && matchSegments(pattern[literal:], name, false) {
+			folder := sourceFolder{Path: p, RelativeTo: base}
+			if fm.MatchedPath == dropMatchedPath {
+				folder.RelativeTo = p
+			}
+			folders = append(folders, folder)
+			return filepath.SkipDir
+		}
+		if !matchSegments(pattern[literal:], name, true) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return folders, err
+}
+
+// globTokenLength returns the length of the token (a character, an escaped
+// character, or a character class) at the start of `s`.
+func globTokenLength(s string) int {
+	switch s[0] {
+	case '\\':
+		if len(s) > 1 {
+			return 2
+		}
+	case '[':
+		if end := strings.Index(s[1:], "]"); end >= 0 {
+			return end + 2
+		}
+	}
+	return 1
+}
+
+// segmentsIntersect returns whether some folder name could match both `a` and
+// `b`. Character classes are assumed to match any character.
+func segmentsIntersect(a string, b string) bool {
+	if a == "" && b == "" {
+		return true
+	}
+	if strings.HasPrefix(a, "*") {
+		return segmentsIntersect(a[1:], b) || (b != "" && segmentsIntersect(a, b[globTokenLength(b):]))
+	}
+	if strings.HasPrefix(b, "*") {
+		return segmentsIntersect(b, a)
+	}
+	if a == "" || b == "" {
+		return false
+	}
+	ta := a[:globTokenLength(a)]
+	tb := b[:globTokenLength(b)]
+	compatible := ta == tb || ta == "?" || tb == "?" || strings.HasPrefix(ta, "[") || strings.HasPrefix(tb, "[") ||
+		strings.TrimPrefix(ta, `\`) == strings.TrimPrefix(tb, `\`)
+	return compatible && segmentsIntersect(a[len(ta):], b[len(tb):])
+}
+
+// patternsOverlap returns whether a folder matched by one pattern could be
+// (or contain, or be inside) a folder matched by the other.
+func patternsOverlap(a []string, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	if a[0] == "**" {
+		return patternsOverlap(a[1:], b) || patternsOverlap(a, b[1:])
+	}
+	if b[0] == "**" {
+		return patternsOverlap(b, a)
+	}
+	return segmentsIntersect(a[0], b[0]) && patternsOverlap(a[1:], b[1:])
+}
+
+// validateFolderMappings checks each folder mapping, and that no file on a card
+// can be reached by more than one of them.
+func validateFolderMappings(mappings []folderMapping) error {
+	for i, fm := range mappings {
+		err := fm.validate()
+		if err != nil {
+			return err
+		}
+		for _, other := range mappings[:i] {
+			if patternsOverlap(other.sourcePattern(), fm.sourcePattern()) {
+				return fmt.Errorf("folder mappings can reach the same files: %s, %s", other.Source, fm.Source)
+			}
+		}
+	}
+	return nil
+}
+
+// mappedFolder is a folder on a card, with the folder mapping that backs it up.
+type mappedFolder struct {
+	FolderMapping folderMapping
+	sourceFolder
+}
+
+// mappedFolders returns the folders on `c` that `op.FolderMapping` backs up,
+// in the order of the folder mappings.
+func (op Operation) mappedFolders(c card) ([]mappedFolder, error) {
+	folders := []mappedFolder{}
+	for _, fm := range op.FolderMapping {
+		sourceFolders, err := fm.sourceFolders(op.cardRoot(c))
+		if err != nil {
+			return nil, err
+		}
+		for _, sf := range sourceFolders {
+			folders = append(folders, mappedFolder{FolderMapping: fm, sourceFolder: sf})
+		}
+	}
+	return folders, nil
+}
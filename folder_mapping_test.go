@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var sourceFoldersCases = []struct {
+	source      string
+	matchedPath matchedPath
+	// Matched folder, and the folder that paths are relative to.
+	want []string
+}{
+	{"DCIM", "", []string{"DCIM:DCIM"}},
+	{"DCIM/100CANON", "", []string{"DCIM/100CANON:DCIM/100CANON"}},
+	{"MISSING", "", []string{}},
+	{"DCIM/*CANON", "", []string{"DCIM/100CANON:DCIM", "DCIM/101CANON:DCIM"}},
+	{"DCIM/*CANON", dropMatchedPath, []string{"DCIM/100CANON:DCIM/100CANON", "DCIM/101CANON:DCIM/101CANON"}},
+	{"PRIVATE/**/CLIP", "", []string{"PRIVATE/M4ROOT/CLIP:PRIVATE"}},
+	{"PRIVATE/**/CLIP", dropMatchedPath, []string{"PRIVATE/M4ROOT/CLIP:PRIVATE/M4ROOT/CLIP"}},
+	{"**/CLIP", "", []string{"PRIVATE/M4ROOT/CLIP:."}},
+	{"*/1??CANON", "", []string{"DCIM/100CANON:.", "DCIM/101CANON:."}},
+}
+
+func TestSourceFolders(t *testing.T) {
+	cardRoot := t.TempDir()
+	for _, folder := range []string{"DCIM/100CANON", "DCIM/101CANON", "DCIM/CANONMSC", "PRIVATE/M4ROOT/CLIP", "PRIVATE/M4ROOT/THMBNL"} {
+		err := os.MkdirAll(filepath.Join(cardRoot, folder), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range sourceFoldersCases {
+		fm := folderMapping{Source: c.source, Destination: "to", MatchedPath: c.matchedPath}
+		folders, err := fm.sourceFolders(cardRoot)
+		if err != nil {
+			t.Fatalf("[%s] %s", c.source, err)
+		}
+		got := []string{}
+		for _, sf := range folders {
+			path, err := filepath.Rel(cardRoot, sf.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			relativeTo, err := filepath.Rel(cardRoot, sf.RelativeTo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, filepath.ToSlash(path)+":"+filepath.ToSlash(relativeTo))
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("[%s, %s] Expected %#v, got %#v", c.source, c.matchedPath, c.want, got)
+		}
+	}
+}
+
+var patternsOverlapCases = []struct {
+	a    string
+	b    string
+	want bool
+}{
+	{"DCIM", "PRIVATE", false},
+	{"DCIM", "DCIM", true},
+	{"DCIM", "DCIM/100CANON", true},
+	{".", "DCIM", true},
+	{"DCIM/*CANON", "DCIM/100CANON", true},
+	{"DCIM/*CANON", "DCIM/*NIKON", false},
+	{"DCIM/1*", "DCIM/*NIKON", true},
+	{"DCIM/???CANON", "DCIM/1000CANON", false},
+	{"PRIVATE/**/CLIP", "PRIVATE/M4ROOT/CLIP", true},
+	{"PRIVATE/*/CLIP", "PRIVATE/M4ROOT/THMBNL", false},
+	// e.g. `PRIVATE/M4ROOT/THMBNL/CLIP`.
+	{"PRIVATE/**/CLIP", "PRIVATE/M4ROOT/THMBNL", true},
+	{"PRIVATE/**/CLIP", "DCIM", false},
+	{"**/CLIP", "PRIVATE/M4ROOT", true},
+}
+
+func TestPatternsOverlap(t *testing.T) {
+	for _, c := range patternsOverlapCases {
+		a := folderMapping{Source: c.a}.sourcePattern()
+		b := folderMapping{Source: c.b}.sourcePattern()
+		if got := patternsOverlap(a, b); got != c.want {
+			t.Errorf("[%s, %s] Expected %v, got %v", c.a, c.b, c.want, got)
+		}
+		if got := patternsOverlap(b, a); got != c.want {
+			t.Errorf("[%s, %s] Expected %v, got %v", c.b, c.a, c.want, got)
+		}
+	}
+}
+
+func TestBackupMatchedFolders(t *testing.T) {
+	mountPoint := t.TempDir()
+	for _, path := range []string{"HERA/DCIM/100CANON/IMG_0001.JPG", "HERA/DCIM/101CANON/IMG_0001.JPG"} {
+		path = filepath.Join(mountPoint, path)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte("\xFF\xD8\xFF "+path), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op := Operation{
+		DestinationRoot:  t.TempDir(),
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM/*CANON", Destination: "DCIM"}},
+	}
+	err := op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := latestManifestEntries(op.DestinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 manifest entries, got %d", len(entries))
+	}
+	for i, folder := range []string{"100CANON", "101CANON"} {
+		want := "/HERA/DCIM/" + folder + "/IMG_0001.JPG"
+		if !strings.HasSuffix(entries[i].DestinationPath, want) {
+			t.Errorf("Expected %#v to end with %#v", entries[i].DestinationPath, want)
+		}
+	}
+
+	// Dropping the matched folders maps both files to the same path.
+	op.DestinationRoot = t.TempDir()
+	op.FolderMapping[0].MatchedPath = dropMatchedPath
+	err = op.BackupCard("HERA")
+	if err == nil || !strings.HasPrefix(err.Error(), "more than one file would be backed up to") {
+		t.Errorf("Expected an error for files backed up to the same path, got %v", err)
+	}
+}
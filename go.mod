@@ -1,5 +1,3 @@
 module github.com/lgarron/sd-card-backup
 
 go 1.26
-
-require github.com/mostafah/fsync v0.0.0-20151120150823-6c37e2827238
@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// The newest file imported from each card is recorded in
+// `[destination_root]/.sd-card-backup/high_water_marks.json`, so that
+// `-new-only` can skip older files without looking at the destination.
+const highWaterMarksFileName = "high_water_marks.json"
+
+// DCF (Design rule for Camera File system) folders are called e.g.
+// `100CANON`, and files e.g. `IMG_0001.JPG`.
+var dcfFolderName = regexp.MustCompile(`^([1-9][0-9]{2})[0-9A-Z_]{5}$`)
+var dcfFileName = regexp.MustCompile(`^[0-9A-Z_]{4}([0-9]{4})\.[0-9A-Z]+$`)
+
+// dcfNumber returns the folder and file number of a DCF file (e.g. 1000001 for
+// `100CANON/IMG_0001.JPG`), which increase in the order in which a camera
+// writes files. Returns 0 for other files.
+func dcfNumber(path string) int {
+	folder := dcfFolderName.FindStringSubmatch(filepath.Base(filepath.Dir(path)))
+	file := dcfFileName.FindStringSubmatch(filepath.Base(path))
+	if folder == nil || file == nil {
+		return 0
+	}
+	folderNumber, _ := strconv.Atoi(folder[1])
+	fileNumber, _ := strconv.Atoi(file[1])
+	return folderNumber*10000 + fileNumber
+}
+
+// highWaterMark is the position of the newest file imported from a card.
+type highWaterMark struct {
+	CaptureTime time.Time `json:"capture_time"`
+	// The highest `dcfNumber()`, or 0 if no DCF files were imported.
+	DCFNumber int `json:"dcf_number"`
+}
+
+// includes returns whether the file at `position` is at or below the mark. A
+// file that is newer by either its capture time or its DCF number (e.g.
+// because the camera's clock or file numbering was reset) is not, so that it
+// is still compared with the destination. Neither is a file without a DCF
+// number that was captured at the same time as the mark, since nothing tells
+// it apart from the files that haven't been imported yet.
+func (mark highWaterMark) includes(position highWaterMark) bool {
+	if position.CaptureTime.After(mark.CaptureTime) {
+		return false
+	}
+	if position.DCFNumber == 0 {
+		return position.CaptureTime.Before(mark.CaptureTime)
+	}
+	return position.DCFNumber <= mark.DCFNumber
+}
+
+// raise moves the mark up to include `position`.
+func (mark *highWaterMark) raise(position highWaterMark) {
+	if position.CaptureTime.After(mark.CaptureTime) {
+		mark.CaptureTime = position.CaptureTime
+	}
+	if position.DCFNumber > mark.DCFNumber {
+		mark.DCFNumber = position.DCFNumber
+	}
+}
+
+func (mark highWaterMark) String() string {
+	if mark.DCFNumber == 0 {
+		return mark.CaptureTime.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s, DCF %03d-%04d", mark.CaptureTime.Format(time.RFC3339), mark.DCFNumber/10000, mark.DCFNumber%10000)
+}
+
+func highWaterMarksPath(destinationRoot string) string {
+	return filepath.Join(stateFolder(destinationRoot), highWaterMarksFileName)
+}
+
+// readHighWaterMarks returns the marks by card name.
+func readHighWaterMarks(destinationRoot string) (map[string]highWaterMark, error) {
+	marks := map[string]highWaterMark{}
+	contents, err := os.ReadFile(highWaterMarksPath(destinationRoot))
+	if os.IsNotExist(err) {
+		return marks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, &marks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid high-water marks %s: %s", highWaterMarksPath(destinationRoot), err)
+	}
+	return marks, nil
+}
+
+// writeHighWaterMarks replaces the marks file atomically.
+func writeHighWaterMarks(destinationRoot string, marks map[string]highWaterMark) error {
+	err := makeStateFolder(destinationRoot)
+	if err != nil {
+		return err
+	}
+	path := highWaterMarksPath(destinationRoot)
+	contents, err := json.MarshalIndent(marks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, append(contents, '\n'))
+}
+
+// cardImport tracks the files of the card that is being backed up, to raise
+// its mark once the card is done.
+type cardImport struct {
+	// The mark from earlier runs.
+	Previous    highWaterMark
+	HasPrevious bool
+	// Raised for every file that is backed up (or was already).
+	Seen highWaterMark
+	// Files skipped by `-new-only`.
+	Skipped int
+	// Whether the positions of files are needed (to skip them, or to raise
+	// the mark). Otherwise, `Seen` isn't raised.
+	Tracked bool
+}
+
+// startImport prepares to track the files of `c`.
+func (op Operation) startImport(run *backupRun, c card) {
+	previous, ok := run.HighWaterMarks[c.Name]
+	run.Import = &cardImport{
+		Previous:    previous,
+		HasPrevious: ok,
+		Tracked:     (op.Options.NewOnly && ok) || op.raisesHighWaterMarks(),
+	}
+}
+
+// raisesHighWaterMarks returns whether marks are raised. They aren't for dry
+// runs, or if some files were skipped because of filter rules from the
+// command line (which may be included next time).
+func (op Operation) raisesHighWaterMarks() bool {
+	return !op.Options.DryRun && op.Options.Filters.isEmpty()
+}
+
+// finishImport raises the mark of `c` to include all the files that were
+// backed up (see `raisesHighWaterMarks()`).
+func (op Operation) finishImport(run *backupRun, c card) error {
+	imported := run.Import
+	run.Import = nil
+	if imported == nil {
+		return nil
+	}
+	if imported.Skipped > 0 {
+		fmt.Printf("[%s] ⏩ %d files below the high-water mark (%s) skipped\n", c.Name, imported.Skipped, imported.Previous)
+	}
+	if !op.raisesHighWaterMarks() {
+		return nil
+	}
+	if imported.Seen.CaptureTime.IsZero() && imported.Seen.DCFNumber == 0 {
+		// No files.
+		return nil
+	}
+	mark := imported.Previous
+	mark.raise(imported.Seen)
+	if imported.HasPrevious && mark.CaptureTime.Equal(imported.Previous.CaptureTime) && mark.DCFNumber == imported.Previous.DCFNumber {
+		return nil
+	}
+	run.HighWaterMarks[c.Name] = mark
+	return writeHighWaterMarks(op.DestinationRoot, run.HighWaterMarks)
+}
@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var dcfNumberCases = []struct {
+	path string
+	want int
+}{
+	{"DCIM/100CANON/IMG_0001.JPG", 1000001},
+	{"DCIM/103CANON/IMG_8868.CR2", 1038868},
+	{"DCIM/999_FUJI/DSCF9999.RAF", 9999999},
+	{"DCIM/100GOPRO/GX010123.MP4", 1000123},
+	{"DCIM/CANONMSC/M0001.CTG", 0},
+	{"DCIM/100CANON/img_0001.jpg", 0},
+	{"PRIVATE/M4ROOT/CLIP/C0001.MP4", 0},
+}
+
+func TestDCFNumber(t *testing.T) {
+	for _, c := range dcfNumberCases {
+		if got := dcfNumber(filepath.FromSlash(c.path)); got != c.want {
+			t.Errorf("[%s] Expected %d, got %d", c.path, c.want, got)
+		}
+	}
+}
+
+func TestHighWaterMarkIncludes(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2018, 4, 21, hour, 0, 0, 0, time.UTC)
+	}
+	mark := highWaterMark{CaptureTime: at(12), DCFNumber: 1000100}
+	highWaterMarkCases := []struct {
+		description string
+		position    highWaterMark
+		want        bool
+	}{
+		{"older", highWaterMark{at(10), 1000050}, true},
+		{"the newest file", highWaterMark{at(12), 1000100}, true},
+		{"newer", highWaterMark{at(13), 1000101}, false},
+		{"newer number", highWaterMark{at(10), 1000101}, false},
+		{"newer time (numbering reset)", highWaterMark{at(13), 1000001}, false},
+		{"not DCF", highWaterMark{at(10), 0}, true},
+		{"not DCF, newer", highWaterMark{at(13), 0}, false},
+		{"not DCF, same time", highWaterMark{at(12), 0}, false},
+	}
+	for _, c := range highWaterMarkCases {
+		if got := mark.includes(c.position); got != c.want {
+			t.Errorf("[%s] Expected %v, got %v", c.description, c.want, got)
+		}
+	}
+}
+
+func TestNewOnly(t *testing.T) {
+	mountPoint := t.TempDir()
+	write := func(name string) {
+		path := filepath.Join(mountPoint, "HERA/DCIM/100CANON", name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte("\xFF\xD8\xFF "+name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without metadata, the birth time is used as the capture time.
+		time.Sleep(10 * time.Millisecond)
+	}
+	write("IMG_0004.JPG")
+	write("IMG_0005.JPG")
+
+	op := Operation{
+		DestinationRoot:  t.TempDir(),
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+	err := op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	marks, err := readHighWaterMarks(op.DestinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marks["HERA"].DCFNumber != 1000005 {
+		t.Errorf("Expected the mark to be at IMG_0005.JPG, got %s", marks["HERA"])
+	}
+
+	entries, err := latestManifestEntries(op.DestinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destinations := map[string]string{}
+	for _, entry := range entries {
+		destinations[filepath.Base(entry.SourcePath)] = filepath.Join(op.DestinationRoot, entry.DestinationPath)
+	}
+	// Files below the mark aren't compared with the destination, so this isn't
+	// noticed.
+	err = os.Remove(destinations["IMG_0004.JPG"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("IMG_0006.JPG")
+	// Out of order: a lower number, but captured after the mark.
+	write("IMG_0003.JPG")
+
+	op.Options.NewOnly = true
+	err = op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = latestManifestEntries(op.DestinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := map[string]bool{}
+	for _, entry := range entries {
+		copied[filepath.Base(entry.SourcePath)] = true
+	}
+	for name, want := range map[string]bool{"IMG_0003.JPG": true, "IMG_0006.JPG": true} {
+		if copied[name] != want {
+			t.Errorf("[%s] Expected to be copied: %v", name, want)
+		}
+	}
+	_, err = os.Stat(destinations["IMG_0004.JPG"])
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected IMG_0004.JPG to be skipped, got %v", err)
+	}
+
+	marks, err = readHighWaterMarks(op.DestinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marks["HERA"].DCFNumber != 1000006 {
+		t.Errorf("Expected the mark to be at IMG_0006.JPG, got %s", marks["HERA"])
+	}
+}
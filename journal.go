@@ -0,0 +1,239 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// Each run keeps a journal at
+// `[destination_root]/.sd-card-backup/journals/[run ID].jsonl`, which is
+// removed once the run completes. Journals left behind by interrupted runs are
+// used to resume.
+const journalFolderName = "journals"
+
+const journalExtension = ".jsonl"
+
+type journalState string
+
+const (
+	// The file was found on the card.
+	journalPlanned journalState = "planned"
+	// The file is being copied, so the destination can't be trusted.
+	journalInProgress journalState = "in_progress"
+	// The file was copied, or was already backed up.
+	journalFinished journalState = "finished"
+)
+
+// JournalEntry records a change in the state of a single file.
+type JournalEntry struct {
+	State journalState `json:"state"`
+	Card  string       `json:"card"`
+	// Relative to the root of the card.
+	SourcePath string `json:"source_path"`
+	// Relative to the destination root.
+	DestinationPath string `json:"destination_path"`
+	// Of the source, so that we can tell if the card has changed since (e.g.
+	// it was reformatted and has new files with the same names).
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	At      time.Time `json:"at"`
+}
+
+func journalFolder(destinationRoot string) string {
+	return filepath.Join(stateFolder(destinationRoot), journalFolderName)
+}
+
+// journal appends entries for the current run. Only `journalInProgress`
+// entries are fsynced before continuing, since losing any of the others can
+// only cause extra work when resuming.
+type journal struct {
+	mutex *gosync.Mutex
+	file  *os.File
+}
+
+func openJournal(destinationRoot string, runID string) (*journal, error) {
+	err := makeStateFolder(destinationRoot)
+	if err != nil {
+		return nil, err
+	}
+	folder := journalFolder(destinationRoot)
+	err = os.Mkdir(folder, 0700)
+	if err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(folder, runID+journalExtension), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{mutex: &gosync.Mutex{}, file: file}, nil
+}
+
+func (j *journal) record(entry JournalEntry) error {
+	entry.At = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	_, err = j.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	if entry.State == journalInProgress {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// remove deletes the journal once the run has completed.
+func (j *journal) remove() error {
+	err := j.file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(j.file.Name())
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+type journalKey struct {
+	Card       string
+	SourcePath string
+}
+
+// resumeState holds the latest state of each file in the journals of earlier,
+// interrupted runs.
+type resumeState struct {
+	paths   []string
+	entries map[journalKey]JournalEntry
+}
+
+// readJournals reads the journals of interrupted runs, oldest first, so that
+// later states win.
+func readJournals(destinationRoot string) (*resumeState, error) {
+	rs := &resumeState{entries: map[journalKey]JournalEntry{}}
+	dirEntries, err := os.ReadDir(journalFolder(destinationRoot))
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if dirEntry.Type().IsRegular() && strings.HasSuffix(dirEntry.Name(), journalExtension) {
+			rs.paths = append(rs.paths, filepath.Join(journalFolder(destinationRoot), dirEntry.Name()))
+		}
+	}
+	// Run IDs sort by start time.
+	sort.Strings(rs.paths)
+
+	for _, path := range rs.paths {
+		err := rs.read(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// read skips lines that can't be parsed (e.g. one that was being written
+// during a crash).
+func (rs *resumeState) read(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return readJSONLines(file, func(entry JournalEntry) {
+		rs.entries[journalKey{Card: entry.Card, SourcePath: entry.SourcePath}] = entry
+	})
+}
+
+func (rs *resumeState) lookup(card string, sourcePath string) (JournalEntry, bool) {
+	entry, ok := rs.entries[journalKey{Card: card, SourcePath: sourcePath}]
+	return entry, ok
+}
+
+// inProgress returns the entries of files that were being copied when an
+// earlier run was interrupted.
+func (rs *resumeState) inProgress() []JournalEntry {
+	entries := []JournalEntry{}
+	for _, entry := range rs.entries {
+		if entry.State == journalInProgress {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func (rs *resumeState) count(state journalState) int {
+	n := 0
+	for _, entry := range rs.entries {
+		if entry.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+func (rs *resumeState) summary() string {
+	return fmt.Sprintf("Resuming %d interrupted run(s): %d files finished, %d to re-verify", len(rs.paths), rs.count(journalFinished), rs.count(journalInProgress))
+}
+
+// remove deletes the entries of the earlier runs for `cards`, once the current
+// run has backed them up. Entries for other cards are kept for the next time
+// they are backed up, and journals without any entries left are deleted.
+func (rs *resumeState) remove(cards map[string]bool) error {
+	for _, path := range rs.paths {
+		err := pruneJournal(path, cards)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pruneJournal(path string, cards map[string]bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	kept := []byte{}
+	err = readJSONLines(file, func(entry JournalEntry) {
+		if cards[entry.Card] {
+			return
+		}
+		line, marshalErr := json.Marshal(entry)
+		if marshalErr == nil {
+			kept = append(append(kept, line...), '\n')
+		}
+	})
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	if len(kept) == 0 {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return writeFileAtomically(path, kept)
+}
@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeFromJournals(t *testing.T) {
+	root := t.TempDir()
+
+	first, err := openJournal(root, "20180421T103000Z-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []JournalEntry{
+		{State: journalInProgress, Card: "HERA", SourcePath: "DCIM/IMG_0001.JPG"},
+		{State: journalInProgress, Card: "HERA", SourcePath: "DCIM/IMG_0002.JPG"},
+		{State: journalInProgress, Card: "ZEUS", SourcePath: "DCIM/IMG_0001.JPG"},
+	} {
+		err := first.record(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	first.close()
+
+	second, err := openJournal(root, "20180421T110000Z-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = second.record(JournalEntry{State: journalFinished, Card: "HERA", SourcePath: "DCIM/IMG_0001.JPG"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash in the middle of writing an entry.
+	_, err = second.file.Write([]byte(`{"state":"finished","card":"HERA","source_pa`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.close()
+
+	rs, err := readJournals(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumeCases := []struct {
+		sourcePath string
+		want       journalState
+	}{
+		{"DCIM/IMG_0001.JPG", journalFinished},
+		{"DCIM/IMG_0002.JPG", journalInProgress},
+		{"DCIM/IMG_0003.JPG", ""},
+	}
+	for _, c := range resumeCases {
+		entry, _ := rs.lookup("HERA", c.sourcePath)
+		if entry.State != c.want {
+			t.Errorf("[%s] Expected state %#v, got %#v", c.sourcePath, c.want, entry.State)
+		}
+	}
+
+	// A run that only backed up HERA keeps the entries for ZEUS.
+	err = rs.remove(map[string]bool{"HERA": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining, err := os.ReadDir(filepath.Join(root, stateFolderName, journalFolderName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].Name() != "20180421T103000Z-1.jsonl" {
+		t.Errorf("Expected only the first journal to be kept, got %v", remaining)
+	}
+	rs, err = readJournals(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rs.lookup("HERA", "DCIM/IMG_0002.JPG"); ok {
+		t.Errorf("Expected the entries for HERA to be removed")
+	}
+	if entry, _ := rs.lookup("ZEUS", "DCIM/IMG_0001.JPG"); entry.State != journalInProgress {
+		t.Errorf("Expected the entries for ZEUS to be kept, got %#v", entry.State)
+	}
+}
+
+func TestRemovePartialFilesAfterInterruptedRun(t *testing.T) {
+	mountPoint := t.TempDir()
+	err := os.MkdirAll(filepath.Join(mountPoint, "HERA/DCIM"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := Operation{
+		DestinationRoot:  t.TempDir(),
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+
+	// An interrupted run of another card, in a folder that nothing is copied to
+	// this time.
+	interrupted, err := openJournal(op.DestinationRoot, "20180421T103000Z-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = interrupted.record(JournalEntry{State: journalInProgress, Card: "ZEUS", SourcePath: "DCIM/IMG_0001.JPG", DestinationPath: filepath.FromSlash("ZEUS/2018/IMG_0001.JPG")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted.close()
+	partial := filepath.Join(op.DestinationRoot, "ZEUS/2018/IMG_0001.JPG.sd-card-backup.partial")
+	err = os.MkdirAll(filepath.Dir(partial), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(partial, []byte("\xFF\xD8"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial file to be removed, got %v", err)
+	}
+}
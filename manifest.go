@@ -0,0 +1,141 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"time"
+)
+
+const manifestFileName = "manifest.jsonl"
+
+// ManifestEntry records a single file copied by `sd-card-backup`.
+//
+// The manifest is stored at `[destination_root]/.sd-card-backup/manifest.jsonl`
+// with one JSON-encoded entry per line, so that other tools can read it
+// without depending on this package.
+type ManifestEntry struct {
+	RunID string `json:"run_id"`
+	Card  string `json:"card"`
+	// Relative to the root of the card.
+	SourcePath string `json:"source_path"`
+	// Relative to the destination root.
+	DestinationPath string    `json:"destination_path"`
+	Size            int64     `json:"size"`
+	ModTime         time.Time `json:"mod_time"`
+	BirthTime       time.Time `json:"birth_time"`
+	CopiedAt        time.Time `json:"copied_at"`
+	HashAlgorithm   string    `json:"hash_algorithm"`
+	Hash            string    `json:"hash"`
+	Classification  string    `json:"classification"`
+	// Set if the file was linked to (or cloned from) this existing file in
+	// the archive, relative to the destination root, instead of copied.
+	LinkedTo string `json:"linked_to,omitempty"`
+}
+
+func manifestPath(destinationRoot string) string {
+	return filepath.Join(stateFolder(destinationRoot), manifestFileName)
+}
+
+// manifest appends entries to the manifest file. Each entry is written with a
+// single `write(2)` and fsynced before the next file is copied, so a crash can
+// lose at most the (incomplete) last line.
+type manifest struct {
+	// Entries may be appended by concurrent copies.
+	mutex *gosync.Mutex
+	file  *os.File
+}
+
+func openManifest(destinationRoot string) (*manifest, error) {
+	err := makeStateFolder(destinationRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(manifestPath(destinationRoot), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// If we crashed in the middle of writing an entry, terminate it so that the
+	// next entry starts on its own line.
+	complete, err := endsWithNewline(file)
+	if err == nil && !complete {
+		_, err = file.Write([]byte("\n"))
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &manifest{mutex: &gosync.Mutex{}, file: file}, nil
+}
+
+func endsWithNewline(file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		return true, nil
+	}
+	last := make([]byte, 1)
+	_, err = file.ReadAt(last, info.Size()-1)
+	if err != nil {
+		return false, err
+	}
+	return last[0] == '\n', nil
+}
+
+func (m *manifest) append(entry ManifestEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, err = m.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return m.file.Sync()
+}
+
+func (m *manifest) close() error {
+	return m.file.Close()
+}
+
+// ReadManifest returns all entries recorded for `destinationRoot`, oldest
+// first. Lines that can't be parsed (e.g. one that was being written during a
+// crash) are skipped.
+func ReadManifest(destinationRoot string) ([]ManifestEntry, error) {
+	file, err := os.Open(manifestPath(destinationRoot))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return readManifestEntries(file)
+}
+
+func readManifestEntries(r io.Reader) ([]ManifestEntry, error) {
+	entries := []ManifestEntry{}
+	err := readJSONLines(r, func(entry ManifestEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// newRunID returns an ID that sorts by the start time of the run.
+func newRunID(start time.Time) string {
+	return fmt.Sprintf("%s-%d", start.UTC().Format("20060102T150405Z"), os.Getpid())
+}
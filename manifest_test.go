@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestManifestAppendAfterCrash(t *testing.T) {
+	root := t.TempDir()
+
+	m, err := openManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := ManifestEntry{RunID: "1", Card: "KUBO", SourcePath: "DCIM/103CANON/IMG_8868.CR2", Size: 25}
+	err = m.append(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash in the middle of writing the next entry.
+	_, err = m.file.Write([]byte(`{"run_id":"1","card":"KU`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.close()
+
+	m, err = openManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := ManifestEntry{RunID: "2", Card: "NIXIE", SourcePath: "DCIM/101MSDCF/DSC07203.JPG", Size: 12}
+	err = m.append(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.close()
+
+	entries, err := ReadManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ManifestEntry{first, second}
+	if !reflect.DeepEqual(expected, entries) {
+		t.Errorf("Unexpected manifest entries.\n%#v\n%#v", expected, entries)
+	}
+}
+
+func TestOpenManifestMissingDestination(t *testing.T) {
+	_, err := openManifest("/nonexistent/destination/root")
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected missing destination root to be an error, got: %v", err)
+	}
+}
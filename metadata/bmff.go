@@ -0,0 +1,172 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// ISO base media file format (ISO/IEC 14496-12), used by MP4, QuickTime, CR3,
+// HEIF, …
+
+// Older QuickTime files don't start with `ftyp`.
+var bmffFirstBoxTypes = map[string]bool{
+	"ftyp": true,
+	"moov": true,
+	"mdat": true,
+	"wide": true,
+	"free": true,
+	"skip": true,
+}
+
+func isBMFFHeader(header []byte) bool {
+	return len(header) >= 8 && bmffFirstBoxTypes[string(header[4:8])]
+}
+
+type box struct {
+	Type string
+	// Offset of the box (including its header) in the file.
+	Offset int64
+	// Offset of the box contents, after the header.
+	ContentOffset int64
+	// End of the box.
+	End int64
+}
+
+// errStopWalking can be returned from a `walkBoxes` callback to stop early.
+var errStopWalking = errors.New("stop walking boxes")
+
+// walkBoxes calls `visit` for each box between `start` and `end`, without
+// descending into them.
+func walkBoxes(r io.ReaderAt, start int64, end int64, visit func(b box) error) error {
+	header := make([]byte, 16)
+	offset := start
+	for offset+8 <= end {
+		_, err := r.ReadAt(header[:8], offset)
+		if err != nil {
+			return err
+		}
+		b := box{
+			Type:          string(header[4:8]),
+			Offset:        offset,
+			ContentOffset: offset + 8,
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		switch size {
+		case 0:
+			// The box extends to the end of its container.
+			size = end - offset
+		case 1:
+			_, err := r.ReadAt(header[8:16], offset+8)
+			if err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			b.ContentOffset += 8
+		}
+		if size < b.ContentOffset-offset || offset+size > end {
+			return errors.New("invalid box size")
+		}
+		b.End = offset + size
+
+		err = visit(b)
+		if errors.Is(err, errStopWalking) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset = b.End
+	}
+	return nil
+}
+
+// findBox returns the first box along `path` (e.g. `moov`, `mvhd`).
+func findBox(r io.ReaderAt, start int64, end int64, path ...string) (box, bool) {
+	found := box{}
+	ok := false
+	walkBoxes(r, start, end, func(b box) error {
+		if b.Type != path[0] {
+			return nil
+		}
+		if len(path) == 1 {
+			found, ok = b, true
+		} else {
+			found, ok = findBox(r, b.ContentOffset, b.End, path[1:]...)
+		}
+		return errStopWalking
+	})
+	return found, ok
+}
+
+// Canon stores CR3 metadata in a `uuid` box inside `moov`.
+var canonUUID = []byte{0x85, 0xc0, 0xb6, 0x87, 0x82, 0x0f, 0x11, 0xe0, 0x81, 0x11, 0xf4, 0xce, 0x46, 0x2b, 0x6a, 0x48}
+
+// cr3Box returns a box (e.g. `CMT1`) in the Canon `uuid` box of a CR3 file.
+func cr3Box(r io.ReaderAt, moov box, boxType string) (box, bool) {
+	found := box{}
+	ok := false
+	walkBoxes(r, moov.ContentOffset, moov.End, func(b box) error {
+		if b.Type != "uuid" {
+			return nil
+		}
+		uuid := make([]byte, len(canonUUID))
+		_, readErr := r.ReadAt(uuid, b.ContentOffset)
+		if readErr != nil || !bytes.Equal(uuid, canonUUID) {
+			return nil
+		}
+		found, ok = findBox(r, b.ContentOffset+int64(len(canonUUID)), b.End, boxType)
+		return errStopWalking
+	})
+	return found, ok
+}
+
+// cr3CaptureTime reads the Exif IFD that CR3 files store as a TIFF structure
+// in the `CMT2` box.
+func cr3CaptureTime(r io.ReaderAt, size int64, moov box) (time.Time, error) {
+	cmt2, ok := cr3Box(r, moov, "CMT2")
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return tiffCaptureTime(r, cmt2.ContentOffset)
+}
+
+// bmffCameraModel reads the camera model from the IFD0 that CR3 files store in
+// the `CMT1` box. Other ISO-BMFF files don't have a standard place for it.
+func bmffCameraModel(r io.ReaderAt, size int64) (string, error) {
+	moov, ok := findBox(r, 0, size, "moov")
+	if !ok {
+		return "", ErrNoCameraModel
+	}
+	cmt1, ok := cr3Box(r, moov, "CMT1")
+	if !ok {
+		return "", ErrNoCameraModel
+	}
+	return tiffCameraModel(r, cmt1.ContentOffset)
+}
+
+// Sources of capture times in ISO-BMFF files, most precise first. Times that
+// record the camera's wall clock (or UTC offset) are preferred over the `mvhd`
+// creation time, which is supposed to be in UTC but often isn't.
+var bmffCaptureTimeSources = []func(r io.ReaderAt, size int64, moov box) (time.Time, error){
+	cr3CaptureTime,
+	xmlCaptureTime,
+	udtaCaptureTime,
+	mvhdCaptureTime,
+}
+
+func bmffCaptureTime(r io.ReaderAt, size int64) (time.Time, error) {
+	moov, ok := findBox(r, 0, size, "moov")
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	for _, source := range bmffCaptureTimeSources {
+		captureTime, err := source(r, size, moov)
+		if err == nil {
+			return captureTime, nil
+		}
+	}
+	return time.Time{}, ErrNotFound
+}
@@ -0,0 +1,334 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var jpegMagic = []byte{0xFF, 0xD8, 0xFF}
+
+// TIFF-based RAW formats (CR2, NEF, ARW, DNG, …) use the plain TIFF magic
+// numbers. Olympus (ORF) and Panasonic (RW2) use their own, but the same IFD
+// structure.
+var tiffMagics = [][]byte{
+	[]byte("II*\x00"),
+	[]byte("MM\x00*"),
+	[]byte("IIRO"),
+	[]byte("IIRS"),
+	[]byte("IIU\x00"),
+}
+
+func isTIFFHeader(header []byte) bool {
+	for _, magic := range tiffMagics {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	tagModel               = 0x0110
+	tagExifIFDPointer      = 0x8769
+	tagDateTimeOriginal    = 0x9003
+	tagDateTimeDigitized   = 0x9004
+	tagOffsetTimeOriginal  = 0x9011
+	tagOffsetTimeDigitized = 0x9012
+	tagSubSecTimeOriginal  = 0x9291
+	tagSubSecTimeDigitized = 0x9292
+)
+
+const (
+	tiffTypeASCII = 2
+	tiffTypeLong  = 4
+)
+
+// The largest IFD we are willing to read, to avoid huge allocations on corrupt
+// files.
+const maxIFDEntries = 1000
+
+type ifdEntry struct {
+	Type  uint16
+	Count uint32
+	// The raw 4-byte value/offset field.
+	Value [4]byte
+}
+
+type tiffReader struct {
+	r     io.ReaderAt
+	base  int64
+	order binary.ByteOrder
+}
+
+func newTIFFReader(r io.ReaderAt, base int64) (*tiffReader, error) {
+	header := make([]byte, 8)
+	_, err := r.ReadAt(header, base)
+	if err != nil {
+		return nil, err
+	}
+	t := &tiffReader{r: r, base: base}
+	switch string(header[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+func (t *tiffReader) firstIFDOffset() (uint32, error) {
+	b := make([]byte, 4)
+	_, err := t.r.ReadAt(b, t.base+4)
+	if err != nil {
+		return 0, err
+	}
+	return t.order.Uint32(b), nil
+}
+
+func (t *tiffReader) readIFD(offset uint32) (map[uint16]ifdEntry, error) {
+	countBytes := make([]byte, 2)
+	_, err := t.r.ReadAt(countBytes, t.base+int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	count := t.order.Uint16(countBytes)
+	if count > maxIFDEntries {
+		return nil, fmt.Errorf("IFD has too many entries: %d", count)
+	}
+
+	raw := make([]byte, 12*int(count))
+	_, err = t.r.ReadAt(raw, t.base+int64(offset)+2)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[uint16]ifdEntry{}
+	for i := 0; i < int(count); i++ {
+		e := raw[12*i : 12*(i+1)]
+		entry := ifdEntry{
+			Type:  t.order.Uint16(e[2:4]),
+			Count: t.order.Uint32(e[4:8]),
+		}
+		copy(entry.Value[:], e[8:12])
+		entries[t.order.Uint16(e[0:2])] = entry
+	}
+	return entries, nil
+}
+
+func (t *tiffReader) long(entry ifdEntry) (uint32, bool) {
+	if entry.Type != tiffTypeLong || entry.Count != 1 {
+		return 0, false
+	}
+	return t.order.Uint32(entry.Value[:]), true
+}
+
+// ascii returns the value of an ASCII entry without its NUL terminator.
+func (t *tiffReader) ascii(entry ifdEntry) (string, bool) {
+	if entry.Type != tiffTypeASCII || entry.Count == 0 || entry.Count > 256 {
+		return "", false
+	}
+	b := make([]byte, entry.Count)
+	if entry.Count <= 4 {
+		copy(b, entry.Value[:entry.Count])
+	} else {
+		_, err := t.r.ReadAt(b, t.base+int64(t.order.Uint32(entry.Value[:])))
+		if err != nil {
+			return "", false
+		}
+	}
+	return strings.TrimRight(string(b), "\x00 "), true
+}
+
+// tiffCaptureTime reads the capture time from the TIFF structure starting at
+// `base`. The date tags are usually in the Exif IFD, but some files (e.g. the
+// `CMT2` box of a CR3) store the Exif IFD as the first IFD.
+func tiffCaptureTime(r io.ReaderAt, base int64) (time.Time, error) {
+	t, err := newTIFFReader(r, base)
+	if err != nil {
+		return time.Time{}, err
+	}
+	offset, err := t.firstIFDOffset()
+	if err != nil {
+		return time.Time{}, err
+	}
+	ifd0, err := t.readIFD(offset)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if captureTime, err := t.exifIFDCaptureTime(ifd0); err == nil {
+		return captureTime, nil
+	}
+
+	exifEntry, ok := ifd0[tagExifIFDPointer]
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	exifOffset, ok := t.long(exifEntry)
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	exifIFD, err := t.readIFD(exifOffset)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.exifIFDCaptureTime(exifIFD)
+}
+
+// tiffCameraModel reads the camera model from the first IFD of the TIFF
+// structure starting at `base`.
+func tiffCameraModel(r io.ReaderAt, base int64) (string, error) {
+	t, err := newTIFFReader(r, base)
+	if err != nil {
+		return "", err
+	}
+	offset, err := t.firstIFDOffset()
+	if err != nil {
+		return "", err
+	}
+	ifd0, err := t.readIFD(offset)
+	if err != nil {
+		return "", err
+	}
+	entry, ok := ifd0[tagModel]
+	if !ok {
+		return "", ErrNoCameraModel
+	}
+	model, ok := t.ascii(entry)
+	model = strings.TrimSpace(model)
+	if !ok || model == "" {
+		return "", ErrNoCameraModel
+	}
+	return model, nil
+}
+
+func (t *tiffReader) exifIFDCaptureTime(ifd map[uint16]ifdEntry) (time.Time, error) {
+	for _, tags := range [][3]uint16{
+		{tagDateTimeOriginal, tagOffsetTimeOriginal, tagSubSecTimeOriginal},
+		{tagDateTimeDigitized, tagOffsetTimeDigitized, tagSubSecTimeDigitized},
+	} {
+		dateTimeEntry, ok := ifd[tags[0]]
+		if !ok {
+			continue
+		}
+		dateTime, ok := t.ascii(dateTimeEntry)
+		if !ok {
+			continue
+		}
+		offset := ""
+		if offsetEntry, ok := ifd[tags[1]]; ok {
+			offset, _ = t.ascii(offsetEntry)
+		}
+		subSec := ""
+		if subSecEntry, ok := ifd[tags[2]]; ok {
+			subSec, _ = t.ascii(subSecEntry)
+		}
+		captureTime, err := parseExifDateTime(dateTime, subSec, offset)
+		if err == nil {
+			return captureTime, nil
+		}
+	}
+	return time.Time{}, ErrNotFound
+}
+
+// parseExifDateTime parses a `DateTimeOriginal` like `2018:04:21 10:30:00`,
+// with an optional `SubSecTimeOriginal` like `25` and `OffsetTimeOriginal`
+// like `+02:00`.
+func parseExifDateTime(dateTime string, subSec string, offset string) (time.Time, error) {
+	loc := time.Local
+	if offset != "" {
+		offsetTime, err := time.Parse("-07:00", offset)
+		if err != nil {
+			return time.Time{}, err
+		}
+		_, seconds := offsetTime.Zone()
+		loc = time.FixedZone(offset, seconds)
+	}
+
+	layout := "2006:01:02 15:04:05"
+	value := dateTime
+	if subSec != "" && strings.Trim(subSec, "0123456789") == "" {
+		layout += "." + strings.Repeat("0", len(subSec))
+		value += "." + subSec
+	}
+	captureTime, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Cameras without a clock set write all zeros (or spaces), which parsing
+	// already rejects, but some also write the year 0 or 1970.
+	if captureTime.Year() < 1980 {
+		return time.Time{}, fmt.Errorf("implausible capture time: %s", dateTime)
+	}
+	return captureTime, nil
+}
+
+// Marker bytes that start a segment without a length.
+func jpegMarkerIsStandalone(marker byte) bool {
+	return marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8)
+}
+
+const (
+	jpegMarkerAPP1 = 0xE1
+	jpegMarkerSOS  = 0xDA
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegCaptureTime reads the capture time from the Exif APP1 segment.
+func jpegCaptureTime(r io.ReaderAt) (time.Time, error) {
+	base, err := jpegTIFFOffset(r)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tiffCaptureTime(r, base)
+}
+
+// jpegTIFFOffset finds the Exif APP1 segment, which comes before the image
+// data, and returns the offset of its TIFF structure.
+func jpegTIFFOffset(r io.ReaderAt) (int64, error) {
+	offset := int64(2)
+	marker := make([]byte, 4)
+	for {
+		_, err := r.ReadAt(marker[:2], offset)
+		if err != nil {
+			return 0, ErrNotFound
+		}
+		if marker[0] != 0xFF {
+			return 0, ErrNotFound
+		}
+		if marker[1] == 0xFF {
+			// Fill byte.
+			offset++
+			continue
+		}
+		if jpegMarkerIsStandalone(marker[1]) {
+			offset += 2
+			continue
+		}
+		if marker[1] == jpegMarkerSOS {
+			return 0, ErrNotFound
+		}
+
+		_, err = r.ReadAt(marker[2:4], offset+2)
+		if err != nil {
+			return 0, ErrNotFound
+		}
+		length := int64(binary.BigEndian.Uint16(marker[2:4]))
+
+		if marker[1] == jpegMarkerAPP1 {
+			header := make([]byte, len(exifHeader))
+			_, err = r.ReadAt(header, offset+4)
+			if err == nil && bytes.Equal(header, exifHeader) {
+				return offset + 4 + int64(len(exifHeader)), nil
+			}
+		}
+		offset += 2 + length
+	}
+}
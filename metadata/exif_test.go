@@ -0,0 +1,189 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testIFDEntry struct {
+	tag   uint16
+	value string
+}
+
+// testTIFF builds a little-endian TIFF structure with the given ASCII entries
+// in an Exif IFD (or directly in IFD0, for `exifInIFD0`).
+func testTIFF(entries []testIFDEntry, exifInIFD0 bool) []byte {
+	le := binary.LittleEndian
+	b := []byte("II*\x00")
+	b = le.AppendUint32(b, 8)
+
+	ifdOffset := uint32(8)
+	if !exifInIFD0 {
+		// IFD0 with a single pointer to the Exif IFD.
+		b = le.AppendUint16(b, 1)
+		b = le.AppendUint16(b, tagExifIFDPointer)
+		b = le.AppendUint16(b, tiffTypeLong)
+		b = le.AppendUint32(b, 1)
+		b = le.AppendUint32(b, 8+18)
+		b = le.AppendUint32(b, 0)
+		ifdOffset += 18
+	}
+
+	dataOffset := ifdOffset + 2 + 12*uint32(len(entries)) + 4
+	data := []byte{}
+	b = le.AppendUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		value := append([]byte(e.value), 0)
+		b = le.AppendUint16(b, e.tag)
+		b = le.AppendUint16(b, tiffTypeASCII)
+		b = le.AppendUint32(b, uint32(len(value)))
+		if len(value) <= 4 {
+			// Short values are stored inline.
+			b = append(b, append(value, make([]byte, 4-len(value))...)...)
+			continue
+		}
+		b = le.AppendUint32(b, dataOffset+uint32(len(data)))
+		data = append(data, value...)
+	}
+	b = le.AppendUint32(b, 0)
+	return append(b, data...)
+}
+
+func testJPEG(tiff []byte) []byte {
+	b := []byte{0xFF, 0xD8}
+	// An APP0 (JFIF) segment before the Exif segment.
+	b = append(b, 0xFF, 0xE0, 0x00, 0x07)
+	b = append(b, []byte("JFIF\x00")...)
+	b = append(b, 0xFF, jpegMarkerAPP1)
+	b = binary.BigEndian.AppendUint16(b, uint16(2+len(exifHeader)+len(tiff)))
+	b = append(b, exifHeader...)
+	b = append(b, tiff...)
+	return append(b, 0xFF, jpegMarkerSOS, 0x00, 0x02, 0xFF, 0xD9)
+}
+
+func testBox(boxType string, contents ...[]byte) []byte {
+	size := 8
+	for _, c := range contents {
+		size += len(c)
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(size))
+	b = append(b, []byte(boxType)...)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func testCR3(tiff []byte) []byte {
+	ftyp := testBox("ftyp", []byte("crx \x00\x00\x00\x01crx isom"))
+	moov := testBox("moov",
+		testBox("uuid", canonUUID, testBox("CNCV", []byte("CanonCR3_001/00.09.00/00.00.00")), testBox("CMT2", tiff)),
+		testBox("trak"),
+	)
+	return append(ftyp, moov...)
+}
+
+func writeTestFile(t *testing.T, name string, contents []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, contents, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var withOffset = []testIFDEntry{
+	{tagDateTimeOriginal, "2018:04:21 23:30:00"},
+	{tagOffsetTimeOriginal, "+02:00"},
+}
+
+var withoutOffset = []testIFDEntry{
+	{tagDateTimeOriginal, "2018:01:31 08:15:42"},
+	{tagSubSecTimeOriginal, "25"},
+}
+
+var captureTimeCases = []struct {
+	name     string
+	contents []byte
+	want     time.Time
+}{
+	{"IMG_8868.CR2", testTIFF(withOffset, false), time.Date(2018, 4, 21, 23, 30, 0, 0, time.FixedZone("", 2*60*60))},
+	{"DSC07203.JPG", testJPEG(testTIFF(withoutOffset, false)), time.Date(2018, 1, 31, 8, 15, 42, 250000000, time.Local)},
+	{"IMG_0001.CR3", testCR3(testTIFF(withOffset, true)), time.Date(2018, 4, 21, 23, 30, 0, 0, time.FixedZone("", 2*60*60))},
+}
+
+func TestCaptureTime(t *testing.T) {
+	for _, c := range captureTimeCases {
+		path := writeTestFile(t, c.name, c.contents)
+		captureTime, err := CaptureTime(path)
+		if err != nil {
+			t.Errorf("[%s] Unexpected error: %s", c.name, err)
+			continue
+		}
+		if !captureTime.Equal(c.want) {
+			t.Errorf("[%s] Expected %s, got %s", c.name, c.want, captureTime)
+		}
+		// The date folder is based on the wall clock time of the camera.
+		if captureTime.Format("2006-01-02") != c.want.Format("2006-01-02") {
+			t.Errorf("[%s] Expected date %s, got %s", c.name, c.want.Format("2006-01-02"), captureTime.Format("2006-01-02"))
+		}
+	}
+}
+
+var notFoundCases = []struct {
+	name     string
+	contents []byte
+}{
+	{"NOTES.TXT", []byte("not a media file")},
+	{"EMPTY.JPG", []byte{}},
+	{"NOEXIF.JPG", testJPEG(testTIFF([]testIFDEntry{}, false))},
+	{"UNSET.JPG", testJPEG(testTIFF([]testIFDEntry{{tagDateTimeOriginal, "0000:00:00 00:00:00"}}, false))},
+}
+
+func TestCaptureTimeNotFound(t *testing.T) {
+	for _, c := range notFoundCases {
+		path := writeTestFile(t, c.name, c.contents)
+		_, err := CaptureTime(path)
+		if err != ErrNotFound {
+			t.Errorf("[%s] Expected ErrNotFound, got: %v", c.name, err)
+		}
+	}
+}
+
+var cameraModelCases = []struct {
+	name     string
+	contents []byte
+	want     string
+}{
+	{"IMG_8868.CR2", testTIFF([]testIFDEntry{{tagModel, "Canon EOS 5D Mark III"}}, true), "Canon EOS 5D Mark III"},
+	{"DSC07203.JPG", testJPEG(testTIFF([]testIFDEntry{{tagModel, "ILCE-7M3 "}}, true)), "ILCE-7M3"},
+	{"IMG_0001.CR3", append(
+		testBox("ftyp", []byte("crx \x00\x00\x00\x01crx isom")),
+		testBox("moov", testBox("uuid", canonUUID, testBox("CMT1", testTIFF([]testIFDEntry{{tagModel, "Canon EOS R5"}}, true))))...,
+	), "Canon EOS R5"},
+}
+
+func TestCameraModel(t *testing.T) {
+	for _, c := range cameraModelCases {
+		path := writeTestFile(t, c.name, c.contents)
+		model, err := CameraModel(path)
+		if err != nil {
+			t.Errorf("[%s] Unexpected error: %s", c.name, err)
+			continue
+		}
+		if model != c.want {
+			t.Errorf("[%s] Expected %#v, got %#v", c.name, c.want, model)
+		}
+	}
+
+	for _, c := range notFoundCases {
+		path := writeTestFile(t, c.name, c.contents)
+		_, err := CameraModel(path)
+		if err != ErrNoCameraModel {
+			t.Errorf("[%s] Expected ErrNoCameraModel, got: %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Package metadata reads capture times (and camera models) embedded in media
+// files.
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNotFound means that the file has no capture time that we know how to
+// read.
+var ErrNotFound = errors.New("no capture time found")
+
+// ErrNoCameraModel means that the file has no camera model that we know how to
+// read.
+var ErrNoCameraModel = errors.New("no camera model found")
+
+const headerSize = 16
+
+// CaptureTime returns the time at which the media in `path` was captured.
+//
+// If the file records its UTC offset, the returned time is in that offset.
+// Otherwise, it is in `time.Local`. Either way, formatting the time gives the
+// wall clock time of the camera.
+func CaptureTime(path string) (time.Time, error) {
+	f, format, size, err := openMedia(path, ErrNotFound)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	switch format {
+	case jpegFormat:
+		return jpegCaptureTime(f)
+	case tiffFormat:
+		return tiffCaptureTime(f, 0)
+	default:
+		return bmffCaptureTime(f, size)
+	}
+}
+
+// CameraModel returns the model of the camera that captured the media in
+// `path` (e.g. `Canon EOS R5`), as recorded in its Exif metadata.
+func CameraModel(path string) (string, error) {
+	f, format, size, err := openMedia(path, ErrNoCameraModel)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	switch format {
+	case jpegFormat:
+		base, err := jpegTIFFOffset(f)
+		if err != nil {
+			return "", ErrNoCameraModel
+		}
+		return tiffCameraModel(f, base)
+	case tiffFormat:
+		return tiffCameraModel(f, 0)
+	default:
+		return bmffCameraModel(f, size)
+	}
+}
+
+type fileFormat int
+
+const (
+	jpegFormat fileFormat = iota
+	tiffFormat
+	bmffFormat
+)
+
+// openMedia opens the file at `path` and detects its format. Returns
+// `notFound` if it isn't a format that we can read.
+func openMedia(path string, notFound error) (*os.File, fileFormat, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		f.Close()
+		if errors.Is(err, io.EOF) {
+			return nil, 0, 0, notFound
+		}
+		return nil, 0, 0, err
+	}
+	header = header[:n]
+
+	format := jpegFormat
+	switch {
+	case bytes.HasPrefix(header, jpegMagic):
+		format = jpegFormat
+	case isTIFFHeader(header):
+		format = tiffFormat
+	case isBMFFHeader(header):
+		format = bmffFormat
+	default:
+		f.Close()
+		return nil, 0, 0, notFound
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, 0, err
+	}
+	return f, format, info.Size(), nil
+}
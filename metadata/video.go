@@ -0,0 +1,176 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The largest vendor XML document we are willing to read.
+const maxXMLSize = 64 * 1024
+
+// metaChildrenOffset returns where the children of a `meta` box start. In
+// MP4, `meta` is a full box (with 4 bytes of version and flags before its
+// children), but in QuickTime it is a plain container.
+func metaChildrenOffset(r io.ReaderAt, meta box) int64 {
+	b := make([]byte, 4)
+	_, err := r.ReadAt(b, meta.ContentOffset+4)
+	if err == nil && string(b) == "hdlr" {
+		return meta.ContentOffset
+	}
+	return meta.ContentOffset + 4
+}
+
+// metaBoxes returns the `meta` boxes that may contain vendor metadata: at the
+// top level (Sony XAVC), in `moov`, and in `moov/udta`.
+func metaBoxes(r io.ReaderAt, size int64, moov box) []box {
+	metas := []box{}
+	if meta, ok := findBox(r, 0, size, "meta"); ok {
+		metas = append(metas, meta)
+	}
+	if meta, ok := findBox(r, moov.ContentOffset, moov.End, "meta"); ok {
+		metas = append(metas, meta)
+	}
+	if meta, ok := findBox(r, moov.ContentOffset, moov.End, "udta", "meta"); ok {
+		metas = append(metas, meta)
+	}
+	return metas
+}
+
+var xmlCreationDate = regexp.MustCompile(`<CreationDate\s+value="([^"]+)"`)
+
+// xmlCaptureTime reads the `CreationDate` from the XML (`NonRealTimeMeta`) that
+// Sony cameras embed in an `xml ` box. It includes the UTC offset.
+func xmlCaptureTime(r io.ReaderAt, size int64, moov box) (time.Time, error) {
+	for _, meta := range metaBoxes(r, size, moov) {
+		xmlBox, ok := findBox(r, metaChildrenOffset(r, meta), meta.End, "xml ")
+		if !ok {
+			continue
+		}
+		// Skip the full box version and flags.
+		start := xmlBox.ContentOffset + 4
+		length := xmlBox.End - start
+		if length <= 0 || length > maxXMLSize {
+			continue
+		}
+		xml := make([]byte, length)
+		_, err := r.ReadAt(xml, start)
+		if err != nil {
+			continue
+		}
+		match := xmlCreationDate.FindSubmatch(xml)
+		if match == nil {
+			continue
+		}
+		captureTime, err := parseVideoDate(string(match[1]))
+		if err == nil {
+			return captureTime, nil
+		}
+	}
+	return time.Time{}, ErrNotFound
+}
+
+// `©day`
+const udtaDayType = "\xa9day"
+
+// udtaCaptureTime reads the `©day` date, either as a QuickTime user data text
+// in `moov/udta`, or as an iTunes-style item in `moov/udta/meta/ilst`.
+func udtaCaptureTime(r io.ReaderAt, size int64, moov box) (time.Time, error) {
+	if day, ok := findBox(r, moov.ContentOffset, moov.End, "udta", udtaDayType); ok {
+		// 16-bit length and 16-bit language code, followed by the text.
+		if value, err := readBoxString(r, day.ContentOffset+4, day.End); err == nil {
+			if captureTime, err := parseVideoDate(value); err == nil {
+				return captureTime, nil
+			}
+		}
+	}
+
+	for _, meta := range metaBoxes(r, size, moov) {
+		data, ok := findBox(r, metaChildrenOffset(r, meta), meta.End, "ilst", udtaDayType, "data")
+		if !ok {
+			continue
+		}
+		// 32-bit type indicator and 32-bit locale, followed by the text.
+		value, err := readBoxString(r, data.ContentOffset+8, data.End)
+		if err != nil {
+			continue
+		}
+		if captureTime, err := parseVideoDate(value); err == nil {
+			return captureTime, nil
+		}
+	}
+	return time.Time{}, ErrNotFound
+}
+
+func readBoxString(r io.ReaderAt, start int64, end int64) (string, error) {
+	if end <= start || end-start > 256 {
+		return "", errors.New("invalid string length")
+	}
+	b := make([]byte, end-start)
+	_, err := r.ReadAt(b, start)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\x00 "), nil
+}
+
+var videoDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// parseVideoDate parses the date formats found in vendor metadata. Dates
+// without a UTC offset are assumed to be in `time.Local`.
+func parseVideoDate(value string) (time.Time, error) {
+	for _, layout := range videoDateLayouts {
+		captureTime, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if captureTime.Year() < 1980 {
+			return time.Time{}, fmt.Errorf("implausible capture time: %s", value)
+		}
+		return captureTime, nil
+	}
+	return time.Time{}, fmt.Errorf("unknown date format: %s", value)
+}
+
+// MP4 times count seconds from 1904-01-01 UTC, which is this many seconds
+// before the Unix epoch.
+const mp4EpochOffset = 2082844800
+
+// mvhdCaptureTime reads the creation time of the movie header. This is
+// supposed to be in UTC, so we convert it to `time.Local`.
+func mvhdCaptureTime(r io.ReaderAt, size int64, moov box) (time.Time, error) {
+	mvhd, ok := findBox(r, moov.ContentOffset, moov.End, "mvhd")
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	b := make([]byte, 12)
+	_, err := r.ReadAt(b, mvhd.ContentOffset)
+	if err != nil {
+		return time.Time{}, ErrNotFound
+	}
+
+	var seconds uint64
+	switch version := b[0]; version {
+	case 0:
+		seconds = uint64(binary.BigEndian.Uint32(b[4:8]))
+	case 1:
+		seconds = binary.BigEndian.Uint64(b[4:12])
+	default:
+		return time.Time{}, ErrNotFound
+	}
+
+	captureTime := time.Unix(int64(seconds)-mp4EpochOffset, 0)
+	if seconds == 0 || captureTime.Year() < 1980 {
+		return time.Time{}, ErrNotFound
+	}
+	return captureTime.In(time.Local), nil
+}
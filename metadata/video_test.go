@@ -0,0 +1,92 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func testMVHD(t time.Time) []byte {
+	b := []byte{0, 0, 0, 0}
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Unix()+mp4EpochOffset))
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Unix()+mp4EpochOffset))
+	return testBox("mvhd", b, make([]byte, 88))
+}
+
+const sonyXML = `<?xml version="1.0" encoding="UTF-8"?>
+<NonRealTimeMeta xmlns="urn:schemas-professionalDisc:nonRealTimeMeta:ver.2.00">
+	<Duration value="330"/>
+	<CreationDate value="2018-02-09T23:58:40+01:00"/>
+</NonRealTimeMeta>`
+
+func testMP4(boxes ...[]byte) []byte {
+	b := testBox("ftyp", []byte("XAVC\x00\x00\x01\x00XAVCmp42iso2"))
+	for _, box := range boxes {
+		b = append(b, box...)
+	}
+	return b
+}
+
+// 2018-02-09 22:58:40 UTC, i.e. just before midnight in the camera's time zone.
+var sonyMVHDTime = time.Date(2018, 2, 9, 22, 58, 40, 0, time.UTC)
+
+var videoCaptureTimeCases = []struct {
+	name     string
+	contents []byte
+	want     time.Time
+	wantDate string
+}{
+	{
+		"C0026.MP4",
+		testMP4(
+			testBox("moov", testMVHD(sonyMVHDTime)),
+			testBox("meta", []byte{0, 0, 0, 0}, testBox("hdlr", make([]byte, 25)), testBox("xml ", []byte{0, 0, 0, 0}, []byte(sonyXML))),
+			testBox("mdat", make([]byte, 32)),
+		),
+		sonyMVHDTime,
+		"2018-02-09",
+	},
+	{
+		"IMG_0042.MOV",
+		append(
+			testBox("wide"),
+			testBox("moov",
+				testMVHD(sonyMVHDTime),
+				testBox("udta", testBox(udtaDayType, []byte{0, 24, 0x55, 0xc4}, []byte("2018-02-10T06:58:40+0800"))),
+			)...,
+		),
+		sonyMVHDTime,
+		"2018-02-10",
+	},
+	{
+		"MVI_0001.MP4",
+		testMP4(testBox("moov", testMVHD(sonyMVHDTime))),
+		sonyMVHDTime,
+		sonyMVHDTime.In(time.Local).Format("2006-01-02"),
+	},
+}
+
+func TestVideoCaptureTime(t *testing.T) {
+	for _, c := range videoCaptureTimeCases {
+		path := writeTestFile(t, c.name, c.contents)
+		captureTime, err := CaptureTime(path)
+		if err != nil {
+			t.Errorf("[%s] Unexpected error: %s", c.name, err)
+			continue
+		}
+		if !captureTime.Equal(c.want) {
+			t.Errorf("[%s] Expected %s, got %s", c.name, c.want, captureTime)
+		}
+		if captureTime.Format("2006-01-02") != c.wantDate {
+			t.Errorf("[%s] Expected date %s, got %s", c.name, c.wantDate, captureTime.Format("2006-01-02"))
+		}
+	}
+}
+
+func TestVideoCaptureTimeUnset(t *testing.T) {
+	path := writeTestFile(t, "GX010123.MP4", testMP4(testBox("moov", testMVHD(time.Unix(-mp4EpochOffset, 0)))))
+	_, err := CaptureTime(path)
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got: %v", err)
+	}
+}
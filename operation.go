@@ -3,16 +3,33 @@ package backup
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lgarron/sd-card-backup/sync"
 )
 
 type folderMapping struct {
+	// Relative to the root of the card. Can be a pattern, e.g. `DCIM/*CANON`
+	// or `PRIVATE/**/CLIP`.
 	Source      string `json:"source"`
 	Destination string `json:"destination"`
+	// Whether the folders matched by a pattern are kept in the destination.
+	// Defaults to `keep`.
+	MatchedPath matchedPath `json:"matched_path"`
+	// In addition to the global and per-card rules.
+	Filters FilterRules `json:"filters"`
 }
 
 type CommandLineOptions struct {
 	DryRun         bool
 	RevealPathOSC8 bool
+	// In addition to the rules in the config.
+	Filters FilterRules
+	// Skip files at or below the high-water mark of their card.
+	NewOnly bool
 }
 
 // Operation defines the config file format for the `sd-card-backup`
@@ -22,11 +39,227 @@ type Operation struct {
 	SDCardMountPoint string          `json:"sd_card_mount_point"`
 	SDCardNames      []string        `json:"sd_card_names"`
 	FolderMapping    []folderMapping `json:"folder_mapping"`
+	// The layout of files in the destination root. Defaults to
+	// `defaultPathTemplate`.
+	PathTemplate string `json:"path_template"`
+	// Instead of `destination_root`, to write every file to more than one
+	// root. The first root is the primary one, and becomes `DestinationRoot`.
+	DestinationRoots []string `json:"destination_roots"`
+	// What to do when a root other than the first is missing or full.
+	SecondaryRoots secondaryRootPolicy `json:"secondary_roots"`
+	// `hardlink` or `reflink` files whose contents are already in the
+	// destination, instead of copying them again.
+	Dedupe string `json:"dedupe"`
+	// Upload to an S3-compatible bucket instead of copying into
+	// `destination_root`, which then only holds the manifest and journals.
+	S3 *s3Destination `json:"s3"`
+	// Also back up any volume in `SDCardMountPoint` with a card identity file.
+	DiscoverCards bool `json:"discover_cards"`
+	// Cards identified by filesystem UUID, whatever their volume name.
+	Cards []cardConfig `json:"cards"`
+	// One of `sha256` (default), `md5`, or `crc32c`.
+	HashAlgorithm string `json:"hash_algorithm"`
+	// Replaces `builtinClassifications` if present, in backup order.
+	Classifications []classification `json:"classifications"`
+	// Replaces `builtinSidecarExtensions` if present.
+	SidecarExtensions []string `json:"sidecar_extensions"`
+	// Copies files one at a time if absent.
+	Concurrency *concurrency `json:"concurrency"`
+	// Apply to every card. Cards and folder mappings can add their own.
+	Filters FilterRules `json:"filters"`
 	// TODO: the following should be a tuple, but Go is inadequate for that.
 	CommandToRunBefore []string `json:"command_to_run_before"` // Contains a command and arguments as entries.
 	Options            CommandLineOptions
 }
 
+// concurrency limits how many files are copied at the same time, overall and
+// per card or destination. Limits of 0 mean "no limit other than `workers`".
+type concurrency struct {
+	Workers        int `json:"workers"`
+	PerCard        int `json:"per_card"`
+	PerDestination int `json:"per_destination"`
+	// Per-card limits, by card name. Override `per_card`.
+	Cards map[string]int `json:"cards"`
+	// Per-destination limits, by destination root. Override `per_destination`.
+	Destinations map[string]int `json:"destinations"`
+}
+
+func (c concurrency) validate() error {
+	if c.Workers < 1 {
+		return fmt.Errorf("`workers` in `concurrency` must be at least 1: %d", c.Workers)
+	}
+	if c.PerCard < 0 || c.PerDestination < 0 {
+		return errors.New("negative limit in `concurrency`")
+	}
+	for name, limit := range c.Cards {
+		if limit < 0 {
+			return fmt.Errorf("negative `concurrency` limit for card: %s", name)
+		}
+	}
+	for root, limit := range c.Destinations {
+		if limit < 0 {
+			return fmt.Errorf("negative `concurrency` limit for destination: %s", root)
+		}
+	}
+	return nil
+}
+
+func (c concurrency) poolOptions() sync.PoolOptions {
+	return sync.PoolOptions{
+		Workers:                 c.Workers,
+		SourceLimits:            c.Cards,
+		DefaultSourceLimit:      c.PerCard,
+		DestinationLimits:       c.Destinations,
+		DefaultDestinationLimit: c.PerDestination,
+	}
+}
+
+// cardConfig identifies a card by filesystem UUID or volume serial number (as
+// shown by `blkid` or `diskutil info`), and gives it a name for the
+// destination. It can also override the global settings for the card with
+// that name.
+type cardConfig struct {
+	Name string `json:"name"`
+	// Optional for cards that are identified some other way (by
+	// `sd_card_names`, or by their identity file).
+	UUID string `json:"uuid"`
+	// Replaces the global `folder_mapping` if present.
+	FolderMapping []folderMapping `json:"folder_mapping"`
+	// Replaces the global `destination_root` if present.
+	DestinationRoot string `json:"destination_root"`
+	// Classification folders (e.g. `Videos`) that aren't backed up from this
+	// card.
+	ExcludeClassifications []string `json:"exclude_classifications"`
+	// In addition to the global rules.
+	Filters FilterRules `json:"filters"`
+}
+
+func (cc cardConfig) validate(o Operation) error {
+	err := validateCardName(cc.Name)
+	if err != nil {
+		return fmt.Errorf("%s in `cards`", err)
+	}
+	if cc.UUID == "" && !o.DiscoverCards && !o.isListedVolume(cc.Name) {
+		// Nothing else would back up the card.
+		return fmt.Errorf("missing `uuid` for card: %s", cc.Name)
+	}
+	if cc.FolderMapping != nil {
+		if len(cc.FolderMapping) == 0 {
+			return fmt.Errorf("empty `folder_mapping` for card: %s", cc.Name)
+		}
+		err := validateFolderMappings(cc.FolderMapping)
+		if err != nil {
+			return fmt.Errorf("%s (for card: %s)", err, cc.Name)
+		}
+	}
+	if cc.DestinationRoot != "" {
+		if len(o.DestinationRoots) > 1 || o.S3 != nil {
+			return fmt.Errorf("`destination_root` for card %s can't be combined with `destination_roots` or `s3`", cc.Name)
+		}
+		for _, root := range o.destinationRoots() {
+			if pathsOverlap(cc.DestinationRoot, root) && filepath.Clean(cc.DestinationRoot) != filepath.Clean(root) {
+				return fmt.Errorf("`destination_root` for card %s can't be inside another destination root (or contain one): %s", cc.Name, cc.DestinationRoot)
+			}
+		}
+	}
+	err = cc.Filters.Validate()
+	if err != nil {
+		return fmt.Errorf("%s (for card: %s)", err, cc.Name)
+	}
+	table := o.classificationTable()
+	for _, folder := range cc.ExcludeClassifications {
+		if !table.hasFolder(folder) {
+			return fmt.Errorf("unknown classification in `exclude_classifications` for card %s: %s", cc.Name, folder)
+		}
+	}
+	return nil
+}
+
+// pathsOverlap returns whether one of the paths is inside the other (or they
+// are the same).
+func pathsOverlap(a string, b string) bool {
+	a = filepath.Clean(a)
+	b = filepath.Clean(b)
+	separator := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, strings.TrimSuffix(b, separator)+separator) || strings.HasPrefix(b, strings.TrimSuffix(a, separator)+separator)
+}
+
+// s3Destination is a bucket to upload to. Credentials are read from the
+// `AWS_ACCESS_KEY_ID` and `AWS_SECRET_ACCESS_KEY` environment variables.
+type s3Destination struct {
+	// e.g. `http://localhost:9000` for MinIO.
+	Endpoint string `json:"endpoint"`
+	// Defaults to `us-east-1`.
+	Region string `json:"region"`
+	Bucket string `json:"bucket"`
+	// Prepended to every key, if not empty.
+	Prefix string `json:"prefix"`
+	// Files larger than this are uploaded in parts. Defaults to 16.
+	PartSizeMiB int64 `json:"part_size_mib"`
+}
+
+func (d s3Destination) validate() error {
+	endpoint, err := url.Parse(d.Endpoint)
+	if d.Endpoint == "" || err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return fmt.Errorf("invalid `endpoint` in `s3` (must be an http or https URL): %#v", d.Endpoint)
+	}
+	if d.Bucket == "" {
+		return errors.New("missing `bucket` in `s3`")
+	}
+	if d.PartSizeMiB != 0 && d.PartSizeMiB*1024*1024 < sync.MinS3PartSize {
+		return fmt.Errorf("`part_size_mib` in `s3` must be at least 5: %d", d.PartSizeMiB)
+	}
+	return nil
+}
+
+func (d s3Destination) syncer(syncerOptions sync.SyncerOptions, root string) (sync.Syncer, error) {
+	accessKeyID := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKeyID == "" || secretAccessKey == "" {
+		return nil, errors.New("`s3` needs the `AWS_ACCESS_KEY_ID` and `AWS_SECRET_ACCESS_KEY` environment variables")
+	}
+	region := d.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return sync.NewS3Syncer(syncerOptions, sync.S3Options{
+		Endpoint:        d.Endpoint,
+		Region:          region,
+		Bucket:          d.Bucket,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		Prefix:          strings.Trim(d.Prefix, "/"),
+		Root:            root,
+		PartSize:        d.PartSizeMiB * 1024 * 1024,
+	})
+}
+
+type rootPolicy string
+
+const (
+	// Stop the run with an error (the default).
+	failRun rootPolicy = "fail"
+	// Print a warning, and stop writing to the root for the rest of the run.
+	skipRoot rootPolicy = "skip"
+)
+
+func (p rootPolicy) validate() error {
+	switch p {
+	case "", failRun, skipRoot:
+		return nil
+	}
+	return fmt.Errorf("unknown policy in `secondary_roots` (must be `fail` or `skip`): %#v", string(p))
+}
+
+func (p rootPolicy) skips() bool {
+	return p == skipRoot
+}
+
+type secondaryRootPolicy struct {
+	Missing rootPolicy `json:"missing"`
+	Full    rootPolicy `json:"full"`
+}
+
 func (fm folderMapping) validate() error {
 	if fm.Source == "" {
 		return fmt.Errorf("missing `source` in folder mapping: %+v", fm)
@@ -34,21 +267,61 @@ func (fm folderMapping) validate() error {
 	if fm.Destination == "" {
 		return fmt.Errorf("missing `destination` in folder mapping: %+v", fm)
 	}
-	return nil
+	err := fm.validateSource()
+	if err != nil {
+		return err
+	}
+	err = fm.Filters.Validate()
+	if err != nil {
+		return fmt.Errorf("%s (for folder mapping: %s)", err, fm.Source)
+	}
+	return fm.MatchedPath.validate()
 }
 
 func (o Operation) validate() error {
 	// TODO: condense calculations similar to table-driven tests.
-	if o.DestinationRoot == "" {
-		return errors.New("missing `destination_root`")
+	if o.DestinationRoot != "" && o.DestinationRoots != nil {
+		return errors.New("only one of `destination_root` and `destination_roots` can be set")
+	}
+	if o.DestinationRoot == "" && len(o.DestinationRoots) == 0 {
+		return errors.New("missing `destination_root` (or `destination_roots`)")
+	}
+	roots := map[string]bool{}
+	for _, root := range o.DestinationRoots {
+		if root == "" {
+			return errors.New("contains empty destination root")
+		}
+		if roots[filepath.Clean(root)] {
+			return fmt.Errorf("duplicate root in `destination_roots`: %s", root)
+		}
+		roots[filepath.Clean(root)] = true
+	}
+	for _, p := range []rootPolicy{o.SecondaryRoots.Missing, o.SecondaryRoots.Full} {
+		err := p.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if o.S3 != nil {
+		err := o.S3.validate()
+		if err != nil {
+			return err
+		}
+		if len(o.DestinationRoots) > 1 {
+			return errors.New("`s3` can't be combined with more than one destination root")
+		}
+		if o.Dedupe != "" {
+			return errors.New("`dedupe` is not supported for `s3` destinations")
+		}
 	}
 	if o.SDCardMountPoint == "" {
 		return errors.New("missing `sd_card_mount_point`")
 	}
-	if o.SDCardNames == nil {
+	identifiesCards := o.DiscoverCards || len(o.Cards) > 0
+	if o.SDCardNames == nil && !identifiesCards {
 		return errors.New("missing `sd_card_names`")
 	}
-	if len(o.SDCardNames) == 0 {
+	if len(o.SDCardNames) == 0 && !identifiesCards {
 		return errors.New("empty `sd_card_names`")
 	}
 	for _, c := range o.SDCardNames {
@@ -56,17 +329,174 @@ func (o Operation) validate() error {
 			return errors.New("contains empty card name")
 		}
 	}
+	if o.Classifications != nil {
+		err := tableFromConfig(o.Classifications).validate()
+		if err != nil {
+			return err
+		}
+	}
+	names := map[string]bool{}
+	uuids := map[string]bool{}
+	for _, cc := range o.Cards {
+		err := cc.validate(o)
+		if err != nil {
+			return err
+		}
+		if names[cc.Name] {
+			return fmt.Errorf("duplicate card name in `cards`: %s", cc.Name)
+		}
+		names[cc.Name] = true
+		if cc.UUID == "" {
+			continue
+		}
+		if uuids[strings.ToUpper(cc.UUID)] {
+			return fmt.Errorf("duplicate `uuid` in `cards`: %s", cc.UUID)
+		}
+		uuids[strings.ToUpper(cc.UUID)] = true
+	}
 	if o.FolderMapping == nil {
 		return errors.New("missing `folder_mapping`")
 	}
 	if len(o.FolderMapping) == 0 {
 		return errors.New("empty `folder_mapping`")
 	}
-	for _, fm := range o.FolderMapping {
-		err := fm.validate()
+	err := validateFolderMappings(o.FolderMapping)
+	if err != nil {
+		return err
+	}
+	if o.PathTemplate != "" {
+		template, err := parsePathTemplate(o.PathTemplate)
+		if err != nil {
+			return err
+		}
+		err = template.validate(o)
+		if err != nil {
+			return err
+		}
+		for _, cc := range o.Cards {
+			if cc.FolderMapping == nil {
+				continue
+			}
+			err = template.validate(o.forCardName(cc.Name))
+			if err != nil {
+				return fmt.Errorf("%s (for card: %s)", err, cc.Name)
+			}
+		}
+	}
+	_, err = sync.ParseHashAlgorithm(o.HashAlgorithm)
+	if err != nil {
+		return fmt.Errorf("invalid `hash_algorithm`: %s", err)
+	}
+	_, err = sync.ParseDedupeMode(o.Dedupe)
+	if err != nil {
+		return fmt.Errorf("invalid `dedupe`: %s", err)
+	}
+	err = o.Filters.Validate()
+	if err != nil {
+		return err
+	}
+	for _, ext := range o.SidecarExtensions {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("sidecar extension must start with a period: %#v", ext)
+		}
+	}
+	if o.Concurrency != nil {
+		err := o.Concurrency.validate()
 		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// destinationRoots returns all the destination roots, starting with
+// `DestinationRoot`.
+func (o Operation) destinationRoots() []string {
+	if len(o.DestinationRoots) == 0 {
+		return []string{o.DestinationRoot}
+	}
+	return o.DestinationRoots
+}
+
+// hasCardUUIDs returns whether any entry in `Cards` identifies a card by UUID.
+func (o Operation) hasCardUUIDs() bool {
+	for _, cc := range o.Cards {
+		if cc.UUID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// cardConfig returns the entry in `Cards` for the card with the given name.
+func (o Operation) cardConfig(name string) (cardConfig, bool) {
+	for _, cc := range o.Cards {
+		if cc.Name == name {
+			return cc, true
+		}
+	}
+	return cardConfig{}, false
+}
+
+// forCard returns the operation with the overrides in `Cards` for `c` applied.
+func (o Operation) forCard(c card) Operation {
+	return o.forCardName(c.Name)
+}
+
+func (o Operation) forCardName(name string) Operation {
+	cc, ok := o.cardConfig(name)
+	if !ok {
+		return o
+	}
+	if cc.FolderMapping != nil {
+		o.FolderMapping = cc.FolderMapping
+	}
+	if cc.DestinationRoot != "" {
+		o.DestinationRoot = filepath.Clean(cc.DestinationRoot)
+	}
+	return o
+}
+
+// excludesClassification returns whether files in `classificationFolder` are
+// not backed up from the card with the given name.
+func (o Operation) excludesClassification(cardName string, classificationFolder string) bool {
+	cc, _ := o.cardConfig(cardName)
+	for _, folder := range cc.ExcludeClassifications {
+		if folder == classificationFolder {
+			return true
+		}
+	}
+	return false
+}
+
+// cardDestinationRoots returns the destination roots set for individual cards
+// that aren't also global roots, without duplicates.
+func (o Operation) cardDestinationRoots() []string {
+	seen := map[string]bool{}
+	for _, root := range o.destinationRoots() {
+		seen[filepath.Clean(root)] = true
+	}
+	roots := []string{}
+	for _, cc := range o.Cards {
+		if cc.DestinationRoot == "" || seen[filepath.Clean(cc.DestinationRoot)] {
+			continue
+		}
+		seen[filepath.Clean(cc.DestinationRoot)] = true
+		roots = append(roots, cc.DestinationRoot)
+	}
+	return roots
+}
+
+func (o Operation) sidecarExtensions() []string {
+	if o.SidecarExtensions == nil {
+		return builtinSidecarExtensions
+	}
+	return o.SidecarExtensions
+}
+
+func (o Operation) classificationTable() classificationTable {
+	if o.Classifications == nil {
+		return builtinClassifications
+	}
+	return tableFromConfig(o.Classifications)
+}
@@ -112,6 +112,293 @@ var validationErrors = []struct {
   "folder_mapping": [{"source": "from"}]
 }`,
 		"missing `destination` in folder mapping"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "hash_algorithm": "crc64"
+}`,
+		"invalid `hash_algorithm`"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "classifications": []
+}`,
+		"empty `classifications`"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "classifications": [{"extensions": [".jpg"]}]
+}`,
+		"missing `folder` in classification"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "classifications": [{"folder": "Images", "signatures": ["jpg"]}]
+}`,
+		"unknown signature"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "classifications": [
+    {"folder": "Images", "extensions": [".jpg"]},
+    {"folder": "Thumbnails", "extensions": [".JPG"]}
+  ]
+}`,
+		"extension .JPG is in more than one classification"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "concurrency": {"per_card": 2}
+}`,
+		"`workers` in `concurrency` must be at least 1"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "concurrency": {"workers": 4, "cards": {"HERA": -1}}
+}`,
+		"negative `concurrency` limit for card: HERA"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "cards": [{"name": "HERA"}]
+}`,
+		"missing `uuid` for card: HERA"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "cards": [
+    {"name": "HERA", "uuid": "1234-ABCD"},
+    {"name": "ZEUS", "uuid": "1234-abcd"}
+  ]
+}`,
+		"duplicate `uuid` in `cards`: 1234-abcd"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [
+    {"source": "DCIM/*CANON", "destination": "DCIM"},
+    {"source": "DCIM/100CANON", "destination": "CANON"}
+  ]
+}`,
+		"folder mappings can reach the same files: DCIM/*CANON, DCIM/100CANON"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "DCIM/[1-", "destination": "DCIM"}]
+}`,
+		"invalid pattern in `source`"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "PRIVATE/M4**/CLIP", "destination": "CLIP"}]
+}`,
+		"`**` must be a whole folder name in `source`: PRIVATE/M4**/CLIP"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "../DCIM", "destination": "DCIM"}]
+}`,
+		"`source` in folder mapping can't contain `..`: ../DCIM"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "DCIM/*CANON", "destination": "DCIM", "matched_path": "flatten"}]
+}`,
+		"unknown `matched_path` in folder mapping (must be `keep` or `drop`): \"flatten\""},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "filters": {"min_size": 100, "max_size": 10}
+}`,
+		"`min_size` is larger than `max_size` in filter rules: 100 > 10"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "cards": [{"name": "HERA", "filters": {"captured_after": "last week"}}]
+}`,
+		"invalid `captured_after` (must be a date or an RFC 3339 time): last week (for card: HERA)"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "DCIM", "destination": "DCIM", "filters": {"exclude": ["*.[LT"]}}]
+}`,
+		"invalid filter pattern (syntax error in pattern): *.[LT (for folder mapping: DCIM)"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "filters": {"captured_after": "2018-04-22", "captured_before": "2018-04-21"}
+}`,
+		"`captured_after` must be before `captured_before`: 2018-04-22, 2018-04-21"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "cards": [{"name": "HERA", "folder_mapping": []}]
+}`,
+		"empty `folder_mapping` for card: HERA"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "cards": [{"name": "HERA", "folder_mapping": [{"source": "FOLDER01"}]}]
+}`,
+		"missing `destination` in folder mapping"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "cards": [{"name": "HERA", "destination_root": "/test/Audio"}]
+}`,
+		"`destination_root` for card HERA can't be inside another destination root"},
+	{`{
+  "destination_roots": ["/test", "/mirror"],
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "cards": [{"name": "HERA", "destination_root": "/audio"}]
+}`,
+		"`destination_root` for card HERA can't be combined with `destination_roots` or `s3`"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "cards": [{"name": "HERA", "exclude_classifications": ["Movies"]}]
+}`,
+		"unknown classification in `exclude_classifications` for card HERA: Movies"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "path_template": "{class}/{yyyy}/{relpath}",
+  "cards": [{"name": "HERA", "folder_mapping": [
+    {"source": "FOLDER01", "destination": "FOLDER01"},
+    {"source": "MULTI", "destination": "MULTI"}
+  ]}]
+}`,
+		"`path_template` must contain `{mapping}` when there is more than one folder mapping (for card: HERA)"},
+	{`{
+  "destination_root": "/test",
+  "destination_roots": ["/test", "/mirror"],
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}]
+}`,
+		"only one of `destination_root` and `destination_roots` can be set"},
+	{`{
+  "destination_roots": ["/test", "/test/"],
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}]
+}`,
+		"duplicate root in `destination_roots`: /test/"},
+	{`{
+  "destination_roots": ["/test", "/mirror"],
+  "secondary_roots": {"full": "ignore"},
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}]
+}`,
+		"unknown policy in `secondary_roots`"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "s3": {"endpoint": "localhost:9000", "bucket": "photos"}
+}`,
+		"invalid `endpoint` in `s3`"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "s3": {"endpoint": "http://localhost:9000", "bucket": "photos", "part_size_mib": 1}
+}`,
+		"`part_size_mib` in `s3` must be at least 5"},
+	{`{
+  "destination_roots": ["/test", "/mirror"],
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "s3": {"endpoint": "http://localhost:9000", "bucket": "photos"}
+}`,
+		"`s3` can't be combined with more than one destination root"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "path_template": "{class}/{yyyy}/{week}/{relpath}"
+}`,
+		"unknown placeholder in `path_template`: {week}"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "path_template": "{camera_model}/{yyyy}/{mm}/{basename}"
+}`,
+		"`path_template` must contain `{relpath}` (or `{reldir}` and `{basename}`)"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "path_template": "{relpath}/{yyyy}"
+}`,
+		"`path_template` must end with `{relpath}` or `{basename}`"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA", "ZEUS"],
+  "folder_mapping": [{"source": "from", "destination": "to"}],
+  "path_template": "{class}/{yyyy}/{mm}/{relpath}"
+}`,
+		"`path_template` must contain `{card}` when more than one card can be backed up"},
+	{`{
+  "destination_root": "/test",
+  "sd_card_mount_point": "/Volumes",
+  "sd_card_names": ["HERA"],
+  "folder_mapping": [
+    {"source": "DCIM", "destination": "DCIM"},
+    {"source": "PRIVATE", "destination": "PRIVATE"}
+  ],
+  "path_template": "{class}/{yyyy}/{mm}/{relpath}"
+}`,
+		"`path_template` must contain `{mapping}` when there is more than one folder mapping"},
 }
 
 func TestValidationErrors(t *testing.T) {
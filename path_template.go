@@ -0,0 +1,165 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lgarron/sd-card-backup/metadata"
+)
+
+// defaultPathTemplate is the layout used if `path_template` isn't set.
+const defaultPathTemplate = "{class}/{yyyy}/{yyyy}-{mm}-{dd}/{card}/{mapping}/{relpath}"
+
+// Used for `{camera_model}` if a file doesn't record its camera model.
+const unknownCameraModel = "Unknown Camera"
+
+var pathTemplatePlaceholders = map[string]bool{
+	// The classification folder, e.g. `Images`.
+	"class": true,
+	// The capture date.
+	"yyyy": true,
+	"mm":   true,
+	"dd":   true,
+	"card": true,
+	// The `destination` of the folder mapping.
+	"mapping": true,
+	// The path relative to the `source` of the folder mapping, e.g.
+	// `100CANON/IMG_0001.JPG`.
+	"relpath": true,
+	// The folder part of `{relpath}`, e.g. `100CANON`.
+	"reldir":       true,
+	"camera_model": true,
+	// The file name, e.g. `IMG_0001.JPG`.
+	"basename": true,
+}
+
+// pathTemplate is a parsed `path_template`. Placeholders are stored as the
+// name in braces, and everything else as literal text.
+type pathTemplate struct {
+	parts []string
+}
+
+func parsePathTemplate(s string) (pathTemplate, error) {
+	if strings.HasPrefix(s, "/") {
+		return pathTemplate{}, fmt.Errorf("`path_template` must be relative to the destination root: %s", s)
+	}
+	t := pathTemplate{}
+	for s != "" {
+		start := strings.Index(s, "{")
+		if start < 0 {
+			t.parts = append(t.parts, s)
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, s[:start])
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return pathTemplate{}, fmt.Errorf("unterminated placeholder in `path_template`: %s", s[start:])
+		}
+		placeholder := s[start : start+end+1]
+		if !pathTemplatePlaceholders[strings.Trim(placeholder, "{}")] {
+			return pathTemplate{}, fmt.Errorf("unknown placeholder in `path_template`: %s", placeholder)
+		}
+		t.parts = append(t.parts, placeholder)
+		s = s[start+end+1:]
+	}
+	for _, part := range t.parts {
+		if strings.HasPrefix(part, "{") {
+			continue
+		}
+		if strings.Contains(part, "}") {
+			return pathTemplate{}, fmt.Errorf("unexpected `}` in `path_template`: %s", part)
+		}
+		for _, segment := range strings.Split(part, "/") {
+			if segment == ".." {
+				return pathTemplate{}, errors.New("`path_template` can't contain `..`")
+			}
+		}
+	}
+	return t, nil
+}
+
+func (t pathTemplate) uses(placeholder string) bool {
+	for _, part := range t.parts {
+		if part == "{"+placeholder+"}" {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that every file that `op` backs up is mapped to a unique
+// path. Files are identified by their card, folder mapping, and path relative
+// to the mapping (their class and capture date only depend on the file).
+func (t pathTemplate) validate(op Operation) error {
+	// The syncers rely on files keeping their name.
+	last := ""
+	if len(t.parts) > 0 {
+		last = t.parts[len(t.parts)-1]
+	}
+	if last != "{relpath}" && last != "{basename}" {
+		return errors.New("`path_template` must end with `{relpath}` or `{basename}`")
+	}
+	if len(t.parts) > 1 && !strings.HasSuffix(t.parts[len(t.parts)-2], "/") {
+		return fmt.Errorf("`path_template` must have a `/` before %s", last)
+	}
+	if !t.uses("relpath") && !(t.uses("reldir") && t.uses("basename")) {
+		return errors.New("`path_template` must contain `{relpath}` (or `{reldir}` and `{basename}`), so that files in different folders on a card don't collide")
+	}
+	if !t.uses("mapping") && len(op.FolderMapping) > 1 {
+		return errors.New("`path_template` must contain `{mapping}` when there is more than one folder mapping")
+	}
+	if !t.uses("card") && (op.DiscoverCards || len(op.cardNames()) > 1) {
+		return errors.New("`path_template` must contain `{card}` when more than one card can be backed up")
+	}
+	return nil
+}
+
+func (t pathTemplate) expand(values map[string]string) string {
+	var b strings.Builder
+	for _, part := range t.parts {
+		if strings.HasPrefix(part, "{") {
+			b.WriteString(values[strings.Trim(part, "{}")])
+		} else {
+			b.WriteString(part)
+		}
+	}
+	return b.String()
+}
+
+// cardNames returns the names of the cards in `SDCardNames` and `Cards`.
+func (op Operation) cardNames() map[string]bool {
+	names := map[string]bool{}
+	for _, name := range op.SDCardNames {
+		names[name] = true
+	}
+	for _, cc := range op.Cards {
+		names[cc.Name] = true
+	}
+	return names
+}
+
+// pathTemplate returns the parsed `PathTemplate`, or the default layout.
+func (op Operation) pathTemplate() (pathTemplate, error) {
+	if op.PathTemplate == "" {
+		return parsePathTemplate(defaultPathTemplate)
+	}
+	return parsePathTemplate(op.PathTemplate)
+}
+
+// cameraModelFolderName returns the camera model of `path`, usable as a
+// folder name.
+func cameraModelFolderName(path string) string {
+	model, err := metadata.CameraModel(path)
+	if err != nil {
+		return unknownCameraModel
+	}
+	model = strings.NewReplacer("/", "-", `\`, "-").Replace(model)
+	model = strings.TrimLeft(model, ".")
+	if model == "" {
+		return unknownCameraModel
+	}
+	return model
+}
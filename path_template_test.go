@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lgarron/sd-card-backup/sync"
+)
+
+var targetPathCases = []struct {
+	template string
+	// `YYYY`, `MM` and `DD` are replaced with the capture date.
+	want string
+}{
+	{"", "Images/YYYY/YYYY-MM-DD/HERA/DCIM/100CANON/IMG_0001.JPG"},
+	{"{class}/{yyyy}/{mm}/{card}/{mapping}/{relpath}", "Images/YYYY/MM/HERA/DCIM/100CANON/IMG_0001.JPG"},
+	{"{camera_model}/{yyyy}-{mm}-{dd}/{card}/{reldir}/{basename}", "Unknown Camera/YYYY-MM-DD/HERA/100CANON/IMG_0001.JPG"},
+}
+
+func TestTargetPath(t *testing.T) {
+	mountPoint := t.TempDir()
+	path := filepath.Join(mountPoint, "HERA/DCIM/100CANON/IMG_0001.JPG")
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte("not really a JPEG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without metadata, the birth time is used as the capture time.
+	birthTime, err := sync.BirthTime(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := strings.NewReplacer(
+		"YYYY", birthTime.Format("2006"),
+		"MM", birthTime.Format("01"),
+		"DD", birthTime.Format("02"),
+	)
+
+	for _, c := range targetPathCases {
+		op := Operation{
+			DestinationRoot:  "/dest",
+			SDCardMountPoint: mountPoint,
+			PathTemplate:     c.template,
+		}
+		fo := folderOperation{
+			Operation:     op,
+			SourceRoot:    filepath.Join(mountPoint, "HERA/DCIM"),
+			CardRoot:      filepath.Join(mountPoint, "HERA"),
+			CardName:      "HERA",
+			FolderMapping: folderMapping{Source: "DCIM", Destination: "DCIM"},
+			Run:           op.newReadOnlyRun(),
+		}
+		got, err := fo.targetPath(path, "Images")
+		if err != nil {
+			t.Fatalf("[%s] %s", c.template, err)
+		}
+		want := filepath.Join("/dest", date.Replace(c.want))
+		if got != want {
+			t.Errorf("[%s] Expected %#v, got %#v", c.template, want, got)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+// Package progress tracks how many bytes have been copied for each file, card,
+// and run, and reports the throughput and an ETA.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the status line is redrawn on a terminal.
+const ttyInterval = 250 * time.Millisecond
+
+// How often a status line is printed when the output is not a terminal.
+const plainInterval = 10 * time.Second
+
+// Throughput is averaged over this window.
+const throughputWindow = 10 * time.Second
+
+// The longest file name shown in the status line.
+const maxNameLength = 40
+
+type counts struct {
+	Files      int
+	Bytes      int64
+	TotalFiles int
+	TotalBytes int64
+}
+
+func (c counts) percent() float64 {
+	if c.TotalBytes == 0 {
+		return 100
+	}
+	return 100 * float64(c.Bytes) / float64(c.TotalBytes)
+}
+
+type sample struct {
+	at     time.Time
+	copied int64
+}
+
+// Tracker collects progress from any number of goroutines, and periodically
+// prints a status line to `out`.
+type Tracker struct {
+	mutex *sync.Mutex
+	out   io.Writer
+	tty   bool
+	now   func() time.Time
+
+	run      counts
+	card     counts
+	cardName string
+	// Bytes actually copied (as opposed to skipped), for the throughput.
+	copied    int64
+	samples   []sample
+	current   string
+	statusing bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// IsTerminal returns whether `f` is a terminal (character device).
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// NewTracker prints a live status line if `tty` is true, and plain lines at
+// regular intervals otherwise. Call `Close()` when done.
+func NewTracker(out io.Writer, tty bool) *Tracker {
+	t := newTracker(out, tty)
+	interval := plainInterval
+	if tty {
+		interval = ttyInterval
+	}
+	go t.tick(interval)
+	return t
+}
+
+func newTracker(out io.Writer, tty bool) *Tracker {
+	return &Tracker{
+		mutex: &sync.Mutex{},
+		out:   out,
+		tty:   tty,
+		now:   time.Now,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+func (t *Tracker) tick(interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.mutex.Lock()
+			t.printStatus()
+			t.mutex.Unlock()
+		}
+	}
+}
+
+// Close stops printing the status line.
+func (t *Tracker) Close() {
+	close(t.stop)
+	<-t.done
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clearStatus()
+}
+
+// AddTotal adds files found by a pre-scan to the totals for the run.
+func (t *Tracker) AddTotal(files int, bytes int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.run.TotalFiles += files
+	t.run.TotalBytes += bytes
+}
+
+// StartCard resets the card totals to the given pre-scan totals.
+func (t *Tracker) StartCard(name string, files int, bytes int64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.cardName = name
+	t.card = counts{TotalFiles: files, TotalBytes: bytes}
+	t.samples = nil
+}
+
+// FinishCard clears the status line and prints a summary for the card.
+func (t *Tracker) FinishCard() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clearStatus()
+	fmt.Fprintf(t.out, "[%s] %d files (%s) processed\n", t.cardName, t.card.Files, FormatBytes(t.card.Bytes))
+	t.cardName = ""
+	t.current = ""
+}
+
+// Print prints `s` above the status line.
+func (t *Tracker) Print(s string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clearStatus()
+	io.WriteString(t.out, s)
+	if t.tty {
+		t.printStatus()
+	}
+}
+
+// File tracks the progress of a single file.
+type File struct {
+	tracker *Tracker
+	size    int64
+	written int64
+}
+
+// StartFile shows `name` as the current file.
+func (t *Tracker) StartFile(name string, size int64) *File {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.current = name
+	return &File{tracker: t, size: size}
+}
+
+// Add records that `n` more bytes of the file have been copied.
+func (f *File) Add(n int64) {
+	t := f.tracker
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f.written += n
+	t.copied += n
+	t.add(n)
+}
+
+// Done counts the rest of the file (e.g. all of it, if it was skipped) as
+// processed.
+func (f *File) Done() {
+	t := f.tracker
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if rest := f.size - f.written; rest > 0 {
+		t.add(rest)
+	}
+	t.run.Files++
+	t.card.Files++
+}
+
+func (t *Tracker) add(n int64) {
+	t.run.Bytes += n
+	t.card.Bytes += n
+}
+
+// throughput returns the number of bytes copied per second over the last
+// `throughputWindow`.
+func (t *Tracker) throughput() float64 {
+	now := t.now()
+	t.samples = append(t.samples, sample{at: now, copied: t.copied})
+	for len(t.samples) > 2 && now.Sub(t.samples[1].at) > throughputWindow {
+		t.samples = t.samples[1:]
+	}
+	first := t.samples[0]
+	elapsed := now.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(t.copied-first.copied) / elapsed
+}
+
+func (t *Tracker) status() string {
+	throughput := t.throughput()
+	parts := []string{
+		fmt.Sprintf("[%s] %s / %s (%.0f%%)", t.cardName, FormatBytes(t.card.Bytes), FormatBytes(t.card.TotalBytes), t.card.percent()),
+	}
+	if t.run.TotalBytes != t.card.TotalBytes {
+		parts = append(parts, fmt.Sprintf("run %s / %s (%.0f%%)", FormatBytes(t.run.Bytes), FormatBytes(t.run.TotalBytes), t.run.percent()))
+	}
+	parts = append(parts, FormatBytes(int64(throughput))+"/s")
+	if throughput > 0 {
+		remaining := float64(t.run.TotalBytes - t.run.Bytes)
+		parts = append(parts, "ETA "+FormatDuration(time.Duration(remaining/throughput*float64(time.Second))))
+	}
+	if t.tty && t.current != "" {
+		parts = append(parts, shorten(t.current))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// Expects the mutex to be held.
+func (t *Tracker) printStatus() {
+	if t.cardName == "" {
+		return
+	}
+	if t.tty {
+		fmt.Fprintf(t.out, "\r\x1b[K%s", t.status())
+		t.statusing = true
+	} else {
+		fmt.Fprintf(t.out, "%s\n", t.status())
+	}
+}
+
+// Expects the mutex to be held.
+func (t *Tracker) clearStatus() {
+	if t.statusing {
+		io.WriteString(t.out, "\r\x1b[K")
+		t.statusing = false
+	}
+}
+
+func shorten(name string) string {
+	runes := []rune(name)
+	if len(runes) <= maxNameLength {
+		return name
+	}
+	return "…" + string(runes[len(runes)-maxNameLength+1:])
+}
+
+// FormatBytes uses decimal units, like the rest of `sd-card-backup`.
+func FormatBytes(bytes int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// FormatDuration rounds to the second, e.g. `1h02m03s`, `2m03s`, or `3s`.
+func FormatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := int(d / time.Hour)
+	m := int(d % time.Hour / time.Minute)
+	s := int(d % time.Minute / time.Second)
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%dh%02dm%02ds", h, m, s)
+	case m > 0:
+		return fmt.Sprintf("%dm%02ds", m, s)
+	default:
+		return fmt.Sprintf("%ds", s)
+	}
+}
@@ -0,0 +1,75 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+var formatBytesCases = []struct {
+	bytes int64
+	want  string
+}{
+	{0, "0 B"},
+	{999, "999 B"},
+	{1000, "1.0 kB"},
+	{1234567, "1.2 MB"},
+	{120 * 1000 * 1000 * 1000, "120.0 GB"},
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, c := range formatBytesCases {
+		if got := FormatBytes(c.bytes); got != c.want {
+			t.Errorf("[%d] Expected %#v, got %#v", c.bytes, c.want, got)
+		}
+	}
+}
+
+var formatDurationCases = []struct {
+	duration time.Duration
+	want     string
+}{
+	{1400 * time.Millisecond, "1s"},
+	{2*time.Minute + 3*time.Second, "2m03s"},
+	{time.Hour + 2*time.Minute + 3*time.Second, "1h02m03s"},
+}
+
+func TestFormatDuration(t *testing.T) {
+	for _, c := range formatDurationCases {
+		if got := FormatDuration(c.duration); got != c.want {
+			t.Errorf("[%s] Expected %#v, got %#v", c.duration, c.want, got)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	out := &bytes.Buffer{}
+	tracker := newTracker(out, false)
+	now := time.Date(2018, 4, 21, 10, 30, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	tracker.AddTotal(3, 400*1000*1000)
+	tracker.StartCard("HERA", 2, 200*1000*1000)
+	tracker.status()
+
+	// A skipped file counts as processed, but not towards the throughput.
+	skipped := tracker.StartFile("C0001.MP4", 50*1000*1000)
+	skipped.Done()
+
+	copied := tracker.StartFile("C0002.MP4", 150*1000*1000)
+	now = now.Add(2 * time.Second)
+	copied.Add(50 * 1000 * 1000)
+
+	want := "[HERA] 100.0 MB / 200.0 MB (50%) · run 100.0 MB / 400.0 MB (25%) · 25.0 MB/s · ETA 12s"
+	if got := tracker.status(); got != want {
+		t.Errorf("Expected %#v, got %#v", want, got)
+	}
+
+	copied.Add(100 * 1000 * 1000)
+	copied.Done()
+	tracker.FinishCard()
+	if !strings.HasSuffix(out.String(), "[HERA] 2 files (200.0 MB) processed\n") {
+		t.Errorf("Unexpected summary: %#v", out.String())
+	}
+}
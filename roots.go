@@ -0,0 +1,233 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"syscall"
+
+	"github.com/lgarron/sd-card-backup/progress"
+	"github.com/lgarron/sd-card-backup/sync"
+)
+
+// destinationRoot tracks a single destination root during a run. The first
+// root of a run is the primary root, and the others are secondary roots.
+type destinationRoot struct {
+	Path string
+	// `nil` for dry runs.
+	Manifest *manifest
+	// Secondary roots can be skipped (according to `Operation.SecondaryRoots`)
+	// for the rest of the run.
+	mutex   *gosync.Mutex
+	skipped string
+	copied  int
+	bytes   int64
+}
+
+func newDestinationRoot(path string) *destinationRoot {
+	return &destinationRoot{Path: path, mutex: &gosync.Mutex{}}
+}
+
+// active returns whether files are still written to the root.
+func (root *destinationRoot) active() bool {
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	return root.skipped == ""
+}
+
+// skip stops writing to the root for the rest of the run. Returns `false` if it
+// was already skipped.
+func (root *destinationRoot) skip(reason string) bool {
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	if root.skipped != "" {
+		return false
+	}
+	root.skipped = reason
+	return true
+}
+
+func (root *destinationRoot) recordCopy(size int64) {
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	root.copied++
+	root.bytes += size
+}
+
+func (root *destinationRoot) String() string {
+	root.mutex.Lock()
+	defer root.mutex.Unlock()
+	if root.skipped != "" {
+		return fmt.Sprintf("⚠️ %s: skipped (%s) after copying %d files (%s)", root.Path, root.skipped, root.copied, progress.FormatBytes(root.bytes))
+	}
+	return fmt.Sprintf("✅ %s: %d files (%s) copied", root.Path, root.copied, progress.FormatBytes(root.bytes))
+}
+
+// in returns whether `path` is inside the root.
+func (root *destinationRoot) in(path string) bool {
+	return path == root.Path || strings.HasPrefix(path, root.Path+string(filepath.Separator))
+}
+
+// secondaryRoots returns the secondary roots that files are still written to.
+func (run *backupRun) secondaryRoots() []*destinationRoot {
+	roots := []*destinationRoot{}
+	for _, root := range run.Roots[1:] {
+		if root.active() {
+			roots = append(roots, root)
+		}
+	}
+	return roots
+}
+
+// allRoots returns the roots of the run, followed by the roots of individual
+// cards.
+func (run *backupRun) allRoots() []*destinationRoot {
+	return append(append([]*destinationRoot{}, run.Roots...), run.CardRoots...)
+}
+
+// rootFor returns the root that `path` is in.
+func (run *backupRun) rootFor(path string) (*destinationRoot, error) {
+	for _, root := range run.allRoots() {
+		if root.in(path) {
+			return root, nil
+		}
+	}
+	return nil, fmt.Errorf("not in a destination root: %s", path)
+}
+
+// mirrorPaths returns the paths in the active secondary roots that correspond
+// to `dest` in the primary root. Files in the root of an individual card
+// aren't mirrored.
+func (run *backupRun) mirrorPaths(dest string) ([]string, error) {
+	if !run.Roots[0].in(dest) {
+		return nil, nil
+	}
+	relPath, err := filepath.Rel(run.Roots[0].Path, dest)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, root := range run.secondaryRoots() {
+		paths = append(paths, filepath.Join(root.Path, relPath))
+	}
+	return paths, nil
+}
+
+// checkRoots makes sure that all the roots are (still) there, so that we never
+// create a destination root that isn't mounted. Missing secondary roots fail
+// the run or are skipped, according to `op.SecondaryRoots.Missing`.
+func (op Operation) checkRoots(run *backupRun) error {
+	for i, root := range run.Roots {
+		if i > 0 && !root.active() {
+			continue
+		}
+		exists, err := folderExists(root.Path)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if i == 0 || !op.SecondaryRoots.Missing.skips() {
+			return fmt.Errorf("destination folder does not exist: %s", root.Path)
+		}
+		if root.skip("missing") {
+			run.print(fmt.Sprintf("⚠️ Skipping destination root for the rest of the run (missing): %s\n", root.Path))
+		}
+	}
+	return nil
+}
+
+// openCardRoot adds the destination root of an individual card to the run
+// (unless it was added for an earlier card), and makes sure that it is (still)
+// there.
+func (op Operation) openCardRoot(run *backupRun, path string) error {
+	exists, err := folderExists(path)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("destination folder does not exist: %s", path)
+	}
+	for _, root := range run.allRoots() {
+		if filepath.Clean(root.Path) == filepath.Clean(path) {
+			return nil
+		}
+	}
+
+	root := newDestinationRoot(path)
+	if !op.Options.DryRun {
+		root.Manifest, err = openManifest(path)
+		if err != nil {
+			return err
+		}
+	}
+	if !op.Options.DryRun {
+		err = run.removePartialFiles(root)
+		if err != nil {
+			return err
+		}
+	}
+	run.CardRoots = append(run.CardRoots, root)
+	if run.Duplicates != nil {
+		return run.Duplicates.addRoot(path)
+	}
+	return nil
+}
+
+// removePartialFiles removes the partial files left in `root` by copies that
+// were interrupted. A copy is recorded as in progress in the journal before its
+// partial file is created, so these are the only places to look.
+func (run *backupRun) removePartialFiles(root *destinationRoot) error {
+	if run.Resume == nil {
+		return nil
+	}
+	removed := 0
+	for _, entry := range run.Resume.inProgress() {
+		err := os.Remove(sync.PartialPath(filepath.Join(root.Path, entry.DestinationPath)))
+		if err == nil {
+			removed++
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if removed > 0 {
+		run.print(fmt.Sprintf("Removed %d partial file(s) left by interrupted runs from: %s\n", removed, root.Path))
+	}
+	return nil
+}
+
+// mirrorFailed decides whether a failure to write to a secondary root fails the
+// file, according to `op.SecondaryRoots.Full`.
+func (op Operation) mirrorFailed(run *backupRun, out io.Writer) func(dest string, err error) error {
+	return func(dest string, err error) error {
+		if !errors.Is(err, syscall.ENOSPC) || !op.SecondaryRoots.Full.skips() {
+			return err
+		}
+		root, rootErr := run.rootFor(dest)
+		if rootErr != nil {
+			return errors.Join(err, rootErr)
+		}
+		if root.skip("full") {
+			fmt.Fprintf(out, "\n⚠️ Skipping destination root for the rest of the run (full): %s", root.Path)
+		}
+		return nil
+	}
+}
+
+// printRootSummary prints what was copied to each root (if there is more than
+// one), and how much space deduplication saved.
+func (run *backupRun) printRootSummary() {
+	if roots := run.allRoots(); len(roots) >= 2 {
+		for _, root := range roots {
+			run.print(root.String() + "\n")
+		}
+	}
+	if run.Duplicates != nil {
+		run.print(run.Duplicates.String() + "\n")
+	}
+}
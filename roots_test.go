@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestBackupToSecondaryRoots(t *testing.T) {
+	mountPoint := t.TempDir()
+	primary := t.TempDir()
+	mirror := t.TempDir()
+	missing := filepath.Join(t.TempDir(), "unmounted")
+	path := filepath.Join(mountPoint, "HERA/DCIM/100CANON/IMG_0001.JPG")
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte("\xFF\xD8\xFF IMG_0001.JPG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := Operation{
+		DestinationRoot:  primary,
+		DestinationRoots: []string{primary, missing, mirror},
+		SecondaryRoots:   secondaryRootPolicy{Missing: skipRoot},
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+	err = op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{primary, mirror} {
+		entries, err := latestManifestEntries(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("[%s] Expected 1 manifest entry, got %d", root, len(entries))
+		}
+		_, err = os.Stat(filepath.Join(root, entries[0].DestinationPath))
+		if err != nil {
+			t.Errorf("[%s] Expected the file to be backed up: %s", root, err)
+		}
+	}
+	_, err = os.Stat(missing)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the missing root not to be created")
+	}
+
+	// Missing secondary roots fail the run by default.
+	op.SecondaryRoots = secondaryRootPolicy{}
+	err = op.BackupCard("HERA")
+	if err == nil {
+		t.Errorf("Expected an error for the missing root")
+	}
+}
+
+func TestMirrorFailed(t *testing.T) {
+	full := fmt.Errorf("write: %w", syscall.ENOSPC)
+	mirrorFailedCases := []struct {
+		policy    rootPolicy
+		err       error
+		wantError bool
+	}{
+		{"", full, true},
+		{failRun, full, true},
+		{skipRoot, full, false},
+		// Only full roots are skipped.
+		{skipRoot, syscall.EACCES, true},
+	}
+	for _, c := range mirrorFailedCases {
+		op := Operation{SecondaryRoots: secondaryRootPolicy{Full: c.policy}}
+		run := &backupRun{Roots: []*destinationRoot{newDestinationRoot("/primary"), newDestinationRoot("/mirror")}}
+		err := op.mirrorFailed(run, io.Discard)("/mirror/Images/IMG_0001.JPG", c.err)
+		if (err != nil) != c.wantError {
+			t.Errorf("[%s, %s] Expected an error: %v, got %v", c.policy, c.err, c.wantError, err)
+		}
+		if run.Roots[1].active() != c.wantError {
+			t.Errorf("[%s, %s] Expected the root to be skipped: %v", c.policy, c.err, !c.wantError)
+		}
+		paths, err := run.mirrorPaths("/primary/Images/IMG_0001.JPG")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths) != 0 && !c.wantError {
+			t.Errorf("[%s, %s] Expected no mirrors once skipped, got %#v", c.policy, c.err, paths)
+		}
+	}
+}
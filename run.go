@@ -0,0 +1,246 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	gosync "sync"
+	"time"
+
+	"github.com/lgarron/sd-card-backup/progress"
+	"github.com/lgarron/sd-card-backup/sync"
+)
+
+// backupRun holds the state shared by all the cards backed up during a single
+// invocation.
+type backupRun struct {
+	ID     string
+	Syncer sync.Syncer
+	// The primary root first. Each root has its own manifest.
+	Roots []*destinationRoot
+	// Roots set for individual cards in `Operation.Cards`, added when a card
+	// that uses them is backed up (between cards, so never during a copy).
+	CardRoots []*destinationRoot
+	// On the primary root. `nil` for dry runs.
+	Journal    *journal
+	Resume     *resumeState
+	Classifier *classifier
+	Sidecars   *sidecarIndex
+	// Whether files are copied concurrently (see `Operation.Concurrency`).
+	Concurrent  bool
+	outputMutex *gosync.Mutex
+	// `nil` for dry runs.
+	Progress *progress.Tracker
+	// Pre-scan totals, by card name.
+	CardTotals map[string]scanTotals
+	// `nil` unless `Operation.Dedupe` is set.
+	Duplicates *duplicateIndex
+	// By card name, from earlier runs (and raised as cards are backed up).
+	HighWaterMarks map[string]highWaterMark
+	// The card that is being backed up.
+	Import *cardImport
+	// The cards that have been backed up completely, by name.
+	Finished map[string]bool
+	// The source of each destination path so far, to catch files that would be
+	// backed up to the same path (e.g. from folders matched by a pattern with
+	// `matched_path: drop`). Only used while walking the cards.
+	sources map[string]string
+}
+
+func (op Operation) newBackupRun() (*backupRun, error) {
+	hashAlgorithm, err := sync.ParseHashAlgorithm(op.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	dedupe, err := sync.ParseDedupeMode(op.Dedupe)
+	if err != nil {
+		return nil, err
+	}
+	syncerOptions := sync.SyncerOptions{
+		HashAlgorithm: hashAlgorithm,
+		Dedupe:        dedupe,
+	}
+	var syncer sync.Syncer
+	if op.S3 != nil {
+		syncer, err = op.S3.syncer(syncerOptions, op.DestinationRoot)
+	} else {
+		syncer, err = sync.NewSyncer(syncerOptions)
+	}
+	if err != nil {
+		return nil, err
+	}
+	concurrent := op.Concurrency != nil && op.Concurrency.Workers > 1
+	if concurrent {
+		syncer = sync.NewPool(syncer, op.Concurrency.poolOptions())
+	}
+
+	run := &backupRun{
+		ID:          newRunID(time.Now()),
+		Syncer:      syncer,
+		Classifier:  newClassifier(op.classificationTable()),
+		Sidecars:    newSidecarIndex(op.sidecarExtensions()),
+		Concurrent:  concurrent,
+		outputMutex: &gosync.Mutex{},
+		CardTotals:  map[string]scanTotals{},
+		Finished:    map[string]bool{},
+	}
+
+	for _, path := range op.destinationRoots() {
+		run.Roots = append(run.Roots, newDestinationRoot(path))
+	}
+	err = op.checkRoots(run)
+	if err != nil {
+		return nil, err
+	}
+	run.HighWaterMarks, err = readHighWaterMarks(op.DestinationRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if !op.Options.DryRun {
+		for _, root := range run.Roots {
+			if !root.active() {
+				continue
+			}
+			root.Manifest, err = openManifest(root.Path)
+			if err != nil {
+				run.close()
+				return nil, err
+			}
+		}
+		if dedupe != sync.NoDedupe {
+			run.Duplicates, err = newDuplicateIndex(run, hashAlgorithm)
+			if err != nil {
+				run.close()
+				return nil, err
+			}
+		}
+		run.Resume, err = readJournals(op.DestinationRoot)
+		if err != nil {
+			run.close()
+			return nil, err
+		}
+		if len(run.Resume.paths) > 0 {
+			fmt.Println(run.Resume.summary())
+		}
+		for _, root := range run.Roots {
+			if !root.active() {
+				continue
+			}
+			err = run.removePartialFiles(root)
+			if err != nil {
+				run.close()
+				return nil, err
+			}
+		}
+		run.Journal, err = openJournal(op.DestinationRoot, run.ID)
+		if err != nil {
+			run.close()
+			return nil, err
+		}
+		if !sync.VerifiesFromDisk && op.S3 == nil {
+			fmt.Println("⚠️ On this platform, copies may be verified from memory rather than from the destination disk")
+		}
+		run.Progress = progress.NewTracker(os.Stdout, progress.IsTerminal(os.Stdout))
+	}
+
+	return run, nil
+}
+
+// newReadOnlyRun returns a run for commands that only read the card and the
+// destination, without a syncer, manifest, or journal.
+func (op Operation) newReadOnlyRun() *backupRun {
+	return &backupRun{
+		ID:          newRunID(time.Now()),
+		Classifier:  newClassifier(op.classificationTable()),
+		Sidecars:    newSidecarIndex(op.sidecarExtensions()),
+		outputMutex: &gosync.Mutex{},
+		CardTotals:  map[string]scanTotals{},
+	}
+}
+
+// complete removes the journal, once all cards have been backed up, along with
+// the entries of earlier journals for those cards.
+func (run *backupRun) complete() error {
+	if run.Journal == nil {
+		return nil
+	}
+	err := run.Journal.remove()
+	run.Journal = nil
+	if err != nil {
+		return err
+	}
+	return run.Resume.remove(run.Finished)
+}
+
+// close waits for the files that are still being copied (e.g. if a card
+// failed partway through), and then closes the journal, manifests, and progress
+// output that they use. Returns the errors of both.
+func (run *backupRun) close() error {
+	errs := []error{}
+	if run.Syncer != nil {
+		errs = append(errs, run.Syncer.Flush())
+	}
+	if run.Progress != nil {
+		run.Progress.Close()
+	}
+	if run.Journal != nil {
+		run.Journal.close()
+	}
+	for _, root := range run.allRoots() {
+		if root.Manifest != nil {
+			errs = append(errs, root.Manifest.close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// claimDestination records that `src` is backed up to `dest`, or returns an
+// error if another file already is.
+func (run *backupRun) claimDestination(dest string, src string) error {
+	if run.sources == nil {
+		run.sources = map[string]string{}
+	}
+	if other, ok := run.sources[dest]; ok && other != src {
+		return fmt.Errorf("more than one file would be backed up to %s: %s, %s", dest, other, src)
+	}
+	run.sources[dest] = src
+	return nil
+}
+
+// print prints `s` without interleaving it with the output for files.
+func (run *backupRun) print(s string) {
+	if run.Progress != nil {
+		run.Progress.Print(s)
+		return
+	}
+	run.outputMutex.Lock()
+	defer run.outputMutex.Unlock()
+	fmt.Print(s)
+}
+
+// fileOutput returns where to print the progress for a single file, and a
+// function to call when the file is done. When copying concurrently or showing
+// a status line, the output for each file is buffered so that lines don't
+// interleave.
+func (run *backupRun) fileOutput() (io.Writer, func()) {
+	if run.Progress != nil {
+		buffer := &bytes.Buffer{}
+		return buffer, func() {
+			buffer.WriteString("\n")
+			run.Progress.Print(buffer.String())
+		}
+	}
+	if !run.Concurrent {
+		return os.Stdout, func() { fmt.Println("") }
+	}
+	buffer := &bytes.Buffer{}
+	return buffer, func() {
+		run.outputMutex.Lock()
+		defer run.outputMutex.Unlock()
+		buffer.WriteString("\n")
+		buffer.WriteTo(os.Stdout)
+	}
+}
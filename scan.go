@@ -0,0 +1,80 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// scanTotals count the files that a backup will look at, so that progress can
+// be reported against them.
+type scanTotals struct {
+	Files int
+	Bytes int64
+}
+
+// scanCard totals the files in all the mapped folders of the card, the same way
+// that `backupCard` visits them.
+func (op Operation) scanCard(run *backupRun, c card) (scanTotals, error) {
+	totals := scanTotals{}
+	cardOp := op.forCard(c)
+	folders, err := cardOp.mappedFolders(c)
+	if err != nil {
+		return totals, err
+	}
+	for _, mf := range folders {
+		fo := folderOperation{
+			Operation:     cardOp,
+			SourceRoot:    mf.RelativeTo,
+			CardRoot:      op.cardRoot(c),
+			CardName:      c.Name,
+			FolderMapping: mf.FolderMapping,
+			Run:           run,
+		}
+		err = filepath.Walk(mf.Path, func(path string, f os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if f.IsDir() {
+				return nil
+			}
+			excluded, err := fo.excluded(path)
+			if err != nil {
+				return err
+			}
+			rule, err := fo.filteredOut(path, f)
+			if err != nil {
+				return err
+			}
+			if !excluded && rule == "" {
+				totals.Files++
+				totals.Bytes += f.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return totals, err
+		}
+	}
+	return totals, nil
+}
+
+// scanCards pre-scans all mounted cards, so that the run totals are known
+// before the first card is backed up.
+func (op Operation) scanCards(run *backupRun, cards []card) error {
+	for _, c := range cards {
+		exists, err := folderExists(op.cardRoot(c))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		totals, err := op.scanCard(run, c)
+		if err != nil {
+			return err
+		}
+		run.CardTotals[c.Name] = totals
+		run.Progress.AddTotal(totals.Files, totals.Bytes)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanCard(t *testing.T) {
+	mountPoint := t.TempDir()
+	files := map[string]string{
+		"HERA/DCIM/100CANON/IMG_0001.JPG": "12345",
+		"HERA/DCIM/100CANON/IMG_0001.xmp": "123",
+		"HERA/PRIVATE/M4ROOT/C0001.MP4":   "1234567",
+		"HERA/MISC/ignored.txt":           "ignored",
+	}
+	for path, contents := range files {
+		fullPath := filepath.Join(mountPoint, path)
+		err := os.MkdirAll(filepath.Dir(fullPath), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fullPath, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op := Operation{
+		SDCardMountPoint: mountPoint,
+		FolderMapping: []folderMapping{
+			{Source: "DCIM", Destination: "DCIM"},
+			{Source: "PRIVATE", Destination: "PRIVATE"},
+			{Source: "AVCHD", Destination: "AVCHD"},
+		},
+	}
+	totals, err := op.scanCard(op.newReadOnlyRun(), card{Volume: "HERA", Name: "HERA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := scanTotals{Files: 3, Bytes: 15}
+	if totals != want {
+		t.Errorf("Expected %+v, got %+v", want, totals)
+	}
+}
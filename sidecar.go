@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Files that cameras (and editors) write next to the media they describe.
+var builtinSidecarExtensions = []string{
+	".xmp", // Metadata (Lightroom, darktable, …)
+	".thm", // Thumbnails
+	".lrv", // GoPro low-resolution video
+	".xml", // Sony clip metadata
+	".srt", // DJI telemetry subtitles
+}
+
+// Sony clip metadata for `C0026.MP4` is called `C0026M01.XML`.
+var sonyClipMetadataStem = regexp.MustCompile(`^(.+)M\d\d$`)
+
+// GoPro low-resolution video for `GX010123.MP4` is called `GL010123.LRV`.
+var goProLowResolutionStem = regexp.MustCompile(`^GL(\d{6})$`)
+
+// sidecarIndex finds the primary file for each sidecar, so that sidecars can be
+// backed up into the same classification and date folders.
+type sidecarIndex struct {
+	extensions map[string]bool
+	// Sorted file names, by folder.
+	folders map[string][]string
+}
+
+func newSidecarIndex(extensions []string) *sidecarIndex {
+	extensionSet := map[string]bool{}
+	for _, ext := range extensions {
+		extensionSet[strings.ToLower(ext)] = true
+	}
+	return &sidecarIndex{
+		extensions: extensionSet,
+		folders:    map[string][]string{},
+	}
+}
+
+func (si *sidecarIndex) isSidecar(path string) bool {
+	return si.extensions[strings.ToLower(filepath.Ext(path))]
+}
+
+func (si *sidecarIndex) fileNames(dir string) []string {
+	if names, ok := si.folders[dir]; ok {
+		return names
+	}
+	names := []string{}
+	entries, err := os.ReadDir(dir)
+	if err == nil {
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+	si.folders[dir] = names
+	return names
+}
+
+func stem(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// sidecarStemCandidates returns the names that the primary file (without its
+// extension) may have, in order of preference.
+func sidecarStemCandidates(sidecarName string) []string {
+	s := stem(sidecarName)
+	candidates := []string{s}
+	if match := sonyClipMetadataStem.FindStringSubmatch(s); match != nil {
+		candidates = append(candidates, match[1])
+	}
+	if match := goProLowResolutionStem.FindStringSubmatch(strings.ToUpper(s)); match != nil {
+		candidates = append(candidates, "GX"+match[1], "GH"+match[1])
+	}
+	return candidates
+}
+
+// primaryFor returns the primary file that the sidecar at `path` belongs to,
+// or "" if `path` isn't a sidecar or there is no primary file.
+func (si *sidecarIndex) primaryFor(path string) string {
+	if !si.isSidecar(path) {
+		return ""
+	}
+	dir, sidecarName := filepath.Split(path)
+	names := si.fileNames(filepath.Clean(dir))
+
+	for _, candidate := range sidecarStemCandidates(sidecarName) {
+		for _, name := range names {
+			if name == sidecarName || si.isSidecar(name) {
+				continue
+			}
+			// `IMG_1234.CR2.xmp` belongs to `IMG_1234.CR2`, and
+			// `IMG_1234.xmp` to `IMG_1234.[ext]`.
+			if strings.EqualFold(name, candidate) || strings.EqualFold(stem(name), candidate) {
+				return filepath.Join(dir, name)
+			}
+		}
+	}
+	return ""
+}
+
+// primaryOrSelf returns the path that determines the classification and date
+// of the file at `path`.
+func (si *sidecarIndex) primaryOrSelf(path string) string {
+	if primary := si.primaryFor(path); primary != "" {
+		return primary
+	}
+	return path
+}
@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSidecarPrimaryFor(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"C0026.MP4",
+		"C0026M01.XML",
+		"DJI_0001.MP4",
+		"DJI_0001.SRT",
+		"GX010123.MP4",
+		"GL010123.LRV",
+		"GX010123.THM",
+		"IMG_1234.CR2",
+		"IMG_1234.CR2.xmp",
+		"IMG_5678.JPG",
+		"IMG_5678.xmp",
+		"MEDIAPRO.XML",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name        string
+		wantPrimary string
+	}{
+		{"C0026M01.XML", "C0026.MP4"},
+		{"DJI_0001.SRT", "DJI_0001.MP4"},
+		{"GL010123.LRV", "GX010123.MP4"},
+		{"GX010123.THM", "GX010123.MP4"},
+		{"IMG_1234.CR2.xmp", "IMG_1234.CR2"},
+		{"IMG_5678.xmp", "IMG_5678.JPG"},
+		{"MEDIAPRO.XML", ""},
+		{"C0026.MP4", ""},
+	}
+
+	si := newSidecarIndex(builtinSidecarExtensions)
+	for _, c := range cases {
+		primary := si.primaryFor(filepath.Join(dir, c.name))
+		want := ""
+		if c.wantPrimary != "" {
+			want = filepath.Join(dir, c.wantPrimary)
+		}
+		if primary != want {
+			t.Errorf("[%s] Expected %#v, got %#v", c.name, want, primary)
+		}
+	}
+}
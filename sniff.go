@@ -0,0 +1,211 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// contentKind identifies a file format from its contents (magic bytes).
+type contentKind string
+
+const (
+	unknownContent contentKind = ""
+	jpegContent    contentKind = "jpeg"
+	pngContent     contentKind = "png"
+	gifContent     contentKind = "gif"
+	webpContent    contentKind = "webp"
+	// TIFF and TIFF-based RAW formats: CR2, NEF, ARW, DNG, …
+	tiffContent contentKind = "tiff"
+	// Olympus ORF and Panasonic RW2, which are TIFF-like with their own magic.
+	rawTIFFContent contentKind = "raw-tiff"
+	// ISO-BMFF brands.
+	heicContent contentKind = "heic"
+	// Canon CR3 images and CRM movies share the `crx ` brand.
+	crxContent contentKind = "crx"
+	mp4Content contentKind = "mp4"
+	movContent contentKind = "mov"
+	m4aContent contentKind = "m4a"
+	// Other video containers.
+	aviContent      contentKind = "avi"
+	matroskaContent contentKind = "matroska"
+	mpegTSContent   contentKind = "mpeg-ts"
+	mpegPSContent   contentKind = "mpeg-ps"
+	mxfContent      contentKind = "mxf"
+	// Audio.
+	wavContent  contentKind = "wav"
+	aiffContent contentKind = "aiff"
+	flacContent contentKind = "flac"
+	oggContent  contentKind = "ogg"
+	mp3Content  contentKind = "mp3"
+)
+
+var knownContentKinds = map[contentKind]bool{
+	jpegContent:     true,
+	pngContent:      true,
+	gifContent:      true,
+	webpContent:     true,
+	tiffContent:     true,
+	rawTIFFContent:  true,
+	heicContent:     true,
+	crxContent:      true,
+	mp4Content:      true,
+	movContent:      true,
+	m4aContent:      true,
+	aviContent:      true,
+	matroskaContent: true,
+	mpegTSContent:   true,
+	mpegPSContent:   true,
+	mxfContent:      true,
+	wavContent:      true,
+	aiffContent:     true,
+	flacContent:     true,
+	oggContent:      true,
+	mp3Content:      true,
+}
+
+// Enough for three MPEG-TS packets (with M2TS timestamps).
+const sniffLength = 512
+
+var bmffBrands = map[string]contentKind{
+	"heic": heicContent,
+	"heix": heicContent,
+	"hevc": heicContent,
+	"heim": heicContent,
+	"heis": heicContent,
+	"mif1": heicContent,
+	"msf1": heicContent,
+	"avif": heicContent,
+	"crx ": crxContent,
+	"qt  ": movContent,
+	"M4A ": m4aContent,
+	"M4B ": m4aContent,
+	"isom": mp4Content,
+	"iso2": mp4Content,
+	"iso4": mp4Content,
+	"iso5": mp4Content,
+	"iso6": mp4Content,
+	"mp41": mp4Content,
+	"mp42": mp4Content,
+	"avc1": mp4Content,
+	"XAVC": mp4Content,
+	"M4V ": mp4Content,
+	"MSNV": mp4Content,
+	"mmp4": mp4Content,
+	"3gp4": mp4Content,
+	"3gp5": mp4Content,
+	"3g2a": mp4Content,
+	"dash": mp4Content,
+	"f4v ": mp4Content,
+}
+
+// QuickTime files from before `ftyp` start directly with one of these boxes.
+var quickTimeFirstBoxes = map[string]bool{
+	"moov": true,
+	"mdat": true,
+	"wide": true,
+}
+
+var mxfMagic = []byte{0x06, 0x0E, 0x2B, 0x34, 0x02, 0x05, 0x01, 0x01, 0x0D, 0x01, 0x02}
+
+// Second bytes of common MPEG audio (layer III) and ADTS frame headers.
+var mpegAudioSyncBytes = map[byte]bool{
+	0xFB: true,
+	0xFA: true,
+	0xF3: true,
+	0xF2: true,
+	0xE3: true,
+	0xE2: true,
+	0xF1: true,
+	0xF9: true,
+}
+
+func isMPEGTS(header []byte, packetSize int, syncOffset int) bool {
+	for i := 0; i < 3; i++ {
+		offset := syncOffset + i*packetSize
+		if offset >= len(header) || header[offset] != 0x47 {
+			return false
+		}
+	}
+	return true
+}
+
+// sniffContent identifies the format of a file from its first `sniffLength`
+// bytes.
+func sniffContent(header []byte) contentKind {
+	hasPrefix := func(prefix string) bool {
+		return bytes.HasPrefix(header, []byte(prefix))
+	}
+	hasAt := func(offset int, s string) bool {
+		return len(header) >= offset+len(s) && string(header[offset:offset+len(s)]) == s
+	}
+
+	switch {
+	case hasPrefix("\xFF\xD8\xFF"):
+		return jpegContent
+	case hasPrefix("\x89PNG\r\n\x1A\n"):
+		return pngContent
+	case hasPrefix("GIF87a"), hasPrefix("GIF89a"):
+		return gifContent
+	case hasPrefix("II*\x00"), hasPrefix("MM\x00*"):
+		return tiffContent
+	case hasPrefix("IIRO"), hasPrefix("IIRS"), hasPrefix("IIU\x00"):
+		return rawTIFFContent
+	case hasAt(4, "ftyp"):
+		if len(header) < 12 {
+			return unknownContent
+		}
+		if kind, ok := bmffBrands[string(header[8:12])]; ok {
+			return kind
+		}
+		// Unknown brands are most likely some flavor of MP4.
+		return mp4Content
+	case len(header) >= 8 && quickTimeFirstBoxes[string(header[4:8])]:
+		return movContent
+	case hasPrefix("RIFF") && hasAt(8, "WAVE"):
+		return wavContent
+	case hasPrefix("RIFF") && hasAt(8, "AVI "):
+		return aviContent
+	case hasPrefix("RIFF") && hasAt(8, "WEBP"):
+		return webpContent
+	case hasPrefix("FORM") && (hasAt(8, "AIFF") || hasAt(8, "AIFC")):
+		return aiffContent
+	case hasPrefix("fLaC"):
+		return flacContent
+	case hasPrefix("OggS"):
+		return oggContent
+	case hasPrefix("ID3"):
+		return mp3Content
+	case hasPrefix("\x1A\x45\xDF\xA3"):
+		return matroskaContent
+	case hasPrefix("\x00\x00\x01\xBA"):
+		return mpegPSContent
+	case bytes.HasPrefix(header, mxfMagic):
+		return mxfContent
+	// AVCHD (`.mts`) uses 192-byte packets with a 4-byte timestamp prefix.
+	case isMPEGTS(header, 188, 0), isMPEGTS(header, 192, 4):
+		return mpegTSContent
+	// MPEG audio frame sync (without an ID3 tag), or AAC in ADTS.
+	case len(header) >= 2 && header[0] == 0xFF && mpegAudioSyncBytes[header[1]]:
+		return mp3Content
+	default:
+		return unknownContent
+	}
+}
+
+// sniffFile returns `unknownContent` for anything that can't be read,
+// including folders.
+func sniffFile(path string) contentKind {
+	f, err := os.Open(path)
+	if err != nil {
+		return unknownContent
+	}
+	defer f.Close()
+
+	header := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return unknownContent
+	}
+	return sniffContent(header[:n])
+}
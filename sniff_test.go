@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mpegTSHeader(packetSize int, syncOffset int) []byte {
+	header := make([]byte, 3*packetSize)
+	for i := 0; i < 3; i++ {
+		header[syncOffset+i*packetSize] = 0x47
+	}
+	return header
+}
+
+var sniffCases = []struct {
+	name     string
+	header   []byte
+	wantKind contentKind
+}{
+	{"JPEG", []byte("\xFF\xD8\xFF\xE1\x00\x10Exif"), jpegContent},
+	{"CR2", []byte("II*\x00\x10\x00\x00\x00CR\x02\x00"), tiffContent},
+	{"NEF", []byte("MM\x00*\x00\x00\x00\x08"), tiffContent},
+	{"RW2", []byte("IIU\x00\x18\x00\x00\x00"), rawTIFFContent},
+	{"CR3", []byte("\x00\x00\x00\x18ftypcrx \x00\x00\x00\x01crx isom"), crxContent},
+	{"HEIC", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic"), heicContent},
+	{"MP4", []byte("\x00\x00\x00\x1CftypXAVC\x00\x00\x01\x00XAVCmp42iso2"), mp4Content},
+	{"MOV", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00qt  "), movContent},
+	{"Old MOV", []byte("\x00\x00\x00\x08wide\x00\x00\x00\x00mdat"), movContent},
+	{"WAV", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), wavContent},
+	{"AVI", []byte("RIFF\x24\x00\x00\x00AVI LIST"), aviContent},
+	{"FLAC", []byte("fLaC\x00\x00\x00\x22"), flacContent},
+	{"Ogg", []byte("OggS\x00\x02"), oggContent},
+	{"MP3", []byte("ID3\x04\x00"), mp3Content},
+	{"MPEG-TS", mpegTSHeader(188, 0), mpegTSContent},
+	{"M2TS", mpegTSHeader(192, 4), mpegTSContent},
+	{"Text", []byte("Hello, world!"), unknownContent},
+	{"Empty", []byte{}, unknownContent},
+}
+
+func TestSniffContent(t *testing.T) {
+	for _, c := range sniffCases {
+		actual := sniffContent(c.header)
+		if actual != c.wantKind {
+			t.Errorf("[%s] Expected %#v, got %#v", c.name, c.wantKind, actual)
+		}
+	}
+}
+
+var classifyContentCases = []struct {
+	byExt              fileClassification
+	kind               contentKind
+	wantClassification fileClassification
+}{
+	{imageFile, jpegContent, imageFile},
+	{unclassifiedFile, jpegContent, imageFile},
+	{videoFile, jpegContent, imageFile},
+	{imageFile, crxContent, imageFile},
+	{rawVideoFile, crxContent, rawVideoFile},
+	{unclassifiedFile, crxContent, imageFile},
+	{audioFile, unknownContent, audioFile},
+	{unclassifiedFile, unknownContent, unclassifiedFile},
+}
+
+func TestClassifyContent(t *testing.T) {
+	for _, c := range classifyContentCases {
+		actual := builtinClassifications.classifyContent(c.byExt, c.kind)
+		if actual != c.wantClassification {
+			t.Errorf("[%d, %#v] Expected %d, got %d", c.byExt, c.kind, c.wantClassification, actual)
+		}
+	}
+}
+
+func TestClassifyPathMisnamed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "C0026")
+	err := os.WriteFile(path, bytes.Repeat([]byte("\x00\x00\x00\x1CftypXAVC"), 4), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := builtinClassifications.classifyPath(path)
+	if actual != videoFile {
+		t.Errorf("Expected extensionless MP4 to be classified as video, got %d", actual)
+	}
+
+	actual = builtinClassifications.classifyPath(dir)
+	if actual != unclassifiedFile {
+		t.Errorf("Expected folder to be unclassified, got %d", actual)
+	}
+}
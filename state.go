@@ -0,0 +1,75 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// State that `sd-card-backup` keeps about a destination lives in this folder
+// at the root of the destination.
+const stateFolderName = ".sd-card-backup"
+
+func stateFolder(destinationRoot string) string {
+	return filepath.Join(destinationRoot, stateFolderName)
+}
+
+// makeStateFolder creates the state folder of `destinationRoot`, if needed.
+func makeStateFolder(destinationRoot string) error {
+	// Deliberately not `os.MkdirAll()`, so that we never create a missing
+	// destination root.
+	err := os.Mkdir(stateFolder(destinationRoot), 0700)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomically replaces the file at `path` with `contents`, so that a
+// crash leaves either the old or the new contents.
+func writeFileAtomically(path string, contents []byte) error {
+	temp := path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(contents)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// readJSONLines decodes each line of `r` as a `T`, and passes it to `add`.
+// Lines that can't be parsed (e.g. one that was being written during a crash)
+// are skipped.
+func readJSONLines[T any](r io.Reader, add func(T)) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var value T
+			if json.Unmarshal(line, &value) == nil {
+				add(value)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
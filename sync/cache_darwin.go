@@ -0,0 +1,28 @@
+package sync
+
+import (
+	"os"
+	"syscall"
+)
+
+// VerifiesFromDisk is whether re-reading a copy (after it is fsynced) reads it
+// back from the device, rather than from the page cache.
+const VerifiesFromDisk = true
+
+func setNoCache(f *os.File) {
+	syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_NOCACHE, 1)
+}
+
+// bypassCacheForWrites keeps the pages written to `f` out of the unified buffer
+// cache. `F_NOCACHE` doesn't evict pages that are already cached, so this has
+// to be set before writing. (`f.Sync()` uses `F_FULLFSYNC` on macOS, so the
+// data has reached the device before it is read back.)
+func bypassCacheForWrites(f *os.File) {
+	setNoCache(f)
+}
+
+// dropFileCache turns off caching for further reads of `f`. Pages of files
+// written with `bypassCacheForWrites()` aren't cached in the first place.
+func dropFileCache(f *os.File) {
+	setNoCache(f)
+}
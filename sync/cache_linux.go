@@ -0,0 +1,24 @@
+//go:build linux && (amd64 || arm64 || riscv64)
+
+package sync
+
+import (
+	"os"
+	"syscall"
+)
+
+// VerifiesFromDisk is whether re-reading a copy (after it is fsynced) reads it
+// back from the device, rather than from the page cache.
+const VerifiesFromDisk = true
+
+const fadvDontNeed = 4
+
+// bypassCacheForWrites is not needed, since `dropFileCache()` evicts the pages
+// once they are written.
+func bypassCacheForWrites(f *os.File) {}
+
+// dropFileCache asks the kernel to evict the (already fsynced) pages of `f`,
+// so that re-reading it has to go back to the device.
+func dropFileCache(f *os.File) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+}
@@ -0,0 +1,15 @@
+//go:build !darwin && !(linux && (amd64 || arm64 || riscv64))
+
+package sync
+
+import "os"
+
+// VerifiesFromDisk is whether re-reading a copy (after it is fsynced) reads it
+// back from the device, rather than from the page cache. On this platform, it
+// may be served from the page cache, which only catches errors in the copy
+// itself.
+const VerifiesFromDisk = false
+
+func bypassCacheForWrites(f *os.File) {}
+
+func dropFileCache(f *os.File) {}
@@ -0,0 +1,253 @@
+package sync
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files are copied to `[dest][partialSuffix]` and only renamed to `[dest]`
+// once they are complete, so that an interrupted copy never leaves a
+// truncated file that looks like a valid backup.
+const partialSuffix = ".sd-card-backup.partial"
+
+const copyBufferSize = 1024 * 1024
+
+// PartialPath returns the path of the partial file for a copy to `dest`.
+func PartialPath(dest string) string {
+	return dest + partialSuffix
+}
+
+// IsPartialFile returns whether `path` is a partial file, left behind by an
+// interrupted copy (unless a copy is still in progress).
+func IsPartialFile(path string) bool {
+	return strings.HasSuffix(path, partialSuffix)
+}
+
+// VerificationError means that the bytes written to the destination don't
+// match the bytes read from the source.
+type VerificationError struct {
+	Dest       string
+	SourceHash string
+	DestHash   string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("copy verification failed for %s: source hash %s, destination hash %s", e.Dest, e.SourceHash, e.DestHash)
+}
+
+// copyFile streams `src` into a partial file next to `dest` (hashing it as it
+// is read), fsyncs it, re-reads it to check that the hash matches, carries
+// over the modification and access times, and then renames it into place.
+//
+// `onProgress` (if not `nil`) is called with the number of bytes written as the
+// copy progresses.
+//
+// Returns the hex-encoded hash of the contents.
+func copyFile(src string, dest string, algorithm HashAlgorithm, onProgress func(int64)) (hash string, err error) {
+	hash, _, err = copyFileToAll(src, []string{dest}, algorithm, onProgress, nil)
+	return hash, err
+}
+
+// partialTarget is one of the destinations of `copyFileToAll`.
+type partialTarget struct {
+	dest    string
+	partial string
+	file    *os.File
+	failed  bool
+}
+
+// copyFileToAll is like `copyFile`, but reads `src` once and writes it to all
+// of `dests`.
+//
+// If writing to a destination fails, `onFailure` is called. If it returns
+// `nil`, the copy continues for the other destinations. Otherwise (or if
+// `onFailure` is `nil`), the whole copy fails with the returned error.
+//
+// Returns the hash and the destinations that were written successfully.
+func copyFileToAll(src string, dests []string, algorithm HashAlgorithm, onProgress func(int64), onFailure func(dest string, err error) error) (hash string, copied []string, err error) {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", nil, err
+	}
+
+	targets := []*partialTarget{}
+	defer func() {
+		for _, t := range targets {
+			if t.file != nil {
+				t.file.Close()
+			}
+			if err != nil || t.failed {
+				os.Remove(t.partial)
+			}
+		}
+	}()
+	fail := func(t *partialTarget, err error) error {
+		t.failed = true
+		if t.file != nil {
+			t.file.Close()
+			t.file = nil
+		}
+		os.Remove(t.partial)
+		if onFailure == nil {
+			return err
+		}
+		return onFailure(t.dest, err)
+	}
+	live := func() []*partialTarget {
+		l := []*partialTarget{}
+		for _, t := range targets {
+			if !t.failed {
+				l = append(l, t)
+			}
+		}
+		return l
+	}
+
+	for _, dest := range dests {
+		t := &partialTarget{dest: dest, partial: dest + partialSuffix}
+		targets = append(targets, t)
+		err := os.MkdirAll(filepath.Dir(dest), 0700)
+		if err == nil {
+			t.file, err = os.OpenFile(t.partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, srcInfo.Mode().Perm())
+		}
+		if err == nil {
+			bypassCacheForWrites(t.file)
+		}
+		if err != nil {
+			if err := fail(t, err); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	srcHash, err := writePartials(src, live(), algorithm, onProgress, fail)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, t := range live() {
+		err := finishPartial(t, srcInfo, srcHash, algorithm)
+		if err != nil {
+			if err := fail(t, err); err != nil {
+				return "", nil, err
+			}
+			continue
+		}
+		copied = append(copied, t.dest)
+	}
+	return srcHash, copied, nil
+}
+
+// writePartials returns the hash of the bytes read from `src`, so that the
+// card only has to be read once.
+func writePartials(src string, targets []*partialTarget, algorithm HashAlgorithm, onProgress func(int64), fail func(*partialTarget, error) error) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	h := algorithm.New()
+	buffer := make([]byte, copyBufferSize)
+	for {
+		n, readErr := in.Read(buffer)
+		if n > 0 {
+			h.Write(buffer[:n])
+			for _, t := range targets {
+				if t.failed {
+					continue
+				}
+				_, err := t.file.Write(buffer[:n])
+				if err != nil {
+					if err := fail(t, err); err != nil {
+						return "", err
+					}
+				}
+			}
+			if onProgress != nil {
+				onProgress(int64(n))
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+
+	for _, t := range targets {
+		if t.failed {
+			continue
+		}
+		err := t.file.Sync()
+		if err == nil {
+			dropFileCache(t.file)
+			err = t.file.Close()
+			t.file = nil
+		}
+		if err != nil {
+			if err := fail(t, err); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// finishPartial verifies the partial file, and then moves it into place.
+func finishPartial(t *partialTarget, srcInfo os.FileInfo, srcHash string, algorithm HashAlgorithm) error {
+	destHash, err := HashFile(t.partial, algorithm)
+	if err != nil {
+		return err
+	}
+	if destHash != srcHash {
+		return &VerificationError{Dest: t.dest, SourceHash: srcHash, DestHash: destHash}
+	}
+
+	err = os.Chtimes(t.partial, accessTime(srcInfo), srcInfo.ModTime())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(t.partial, t.dest)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(t.dest))
+}
+
+// HashFile returns the hex-encoded hash of the contents of `path`, avoiding
+// the page cache where the platform allows.
+func HashFile(path string, algorithm HashAlgorithm) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dropFileCache(f)
+
+	h := algorithm.New()
+	_, err = io.CopyBuffer(h, f, make([]byte, copyBufferSize))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// syncDir makes a rename into `dir` durable. This is best-effort, since not
+// every platform supports fsyncing a directory.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,85 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "IMG_8868.CR2")
+	dest := filepath.Join(dir, "dest", "2018", "IMG_8868.CR2")
+
+	err := os.WriteFile(src, []byte("raw image bytes"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2018, 4, 21, 10, 30, 0, 0, time.UTC)
+	err = os.Chtimes(src, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var progress int64
+	hash, err := copyFile(src, dest, SHA256, func(n int64) { progress += n })
+	if err != nil {
+		t.Fatalf("Copy failed: %s", err)
+	}
+	if progress != int64(len("raw image bytes")) {
+		t.Errorf("Unexpected progress: %d bytes", progress)
+	}
+	wantHash := "e124131b47683650a5d21479b942e4963f577709bf3b6c3dd357e8d878e2a099"
+	if hash != wantHash {
+		t.Errorf("Unexpected hash: %s", hash)
+	}
+
+	contents, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "raw image bytes" {
+		t.Errorf("Unexpected contents: %#v", string(contents))
+	}
+
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !destInfo.ModTime().Equal(modTime) {
+		t.Errorf("Modification time not preserved: %s", destInfo.ModTime())
+	}
+
+	_, err = os.Stat(dest + partialSuffix)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected partial file to be renamed away.")
+	}
+}
+
+var hashCases = []struct {
+	algorithm HashAlgorithm
+	wantHash  string
+}{
+	{SHA256, "e124131b47683650a5d21479b942e4963f577709bf3b6c3dd357e8d878e2a099"},
+	{MD5, "be37e3bdb639de34eff3212f72a740b8"},
+	{CRC32C, "74828621"},
+}
+
+func TestHashFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "DSC07203.JPG")
+	err := os.WriteFile(path, []byte("raw image bytes"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range hashCases {
+		hash, err := HashFile(path, c.algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != c.wantHash {
+			t.Errorf("[%s] Expected %s, got %s", c.algorithm, c.wantHash, hash)
+		}
+	}
+}
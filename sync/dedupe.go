@@ -0,0 +1,116 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DedupeMode decides how a file is stored when the destination already has a
+// file with the same contents.
+type DedupeMode string
+
+const (
+	// Always store a separate copy.
+	NoDedupe DedupeMode = ""
+	// Hard link the existing file. Linked files share their times (and
+	// permissions) with the existing file.
+	DedupeHardLink DedupeMode = "hardlink"
+	// Clone the existing file (copy-on-write), falling back to a separate copy
+	// if the filesystem doesn't support it.
+	DedupeReflink DedupeMode = "reflink"
+)
+
+// ParseDedupeMode returns `NoDedupe` for an empty name.
+func ParseDedupeMode(name string) (DedupeMode, error) {
+	switch DedupeMode(name) {
+	case NoDedupe, DedupeHardLink, DedupeReflink:
+		return DedupeMode(name), nil
+	default:
+		return "", fmt.Errorf("unknown dedupe mode: %#v", name)
+	}
+}
+
+// DuplicateFinder finds files in the destination that may have the same
+// contents as a file that is about to be copied.
+type DuplicateFinder interface {
+	// HasSize returns whether there is any file with the given size in the same
+	// destination root as `dest`. Files are only hashed before they are copied
+	// if there is.
+	HasSize(dest string, size int64) bool
+	// Find returns a file with the given size and hash in the same destination
+	// root as `dest`. Its contents are trusted to match the recorded hash.
+	Find(dest string, size int64, hash string) (string, bool)
+	// Recorded returns the size and modification time of the source of `dest`,
+	// as recorded when it was backed up (or linked).
+	Recorded(dest string) (size int64, modTime time.Time, ok bool)
+}
+
+// sameAsRecorded compares `src` with what was recorded for `dest` when it was
+// backed up, without looking at the times of `dest` (which a hard link shares
+// with the file it links to). Only a file that wasn't recorded (e.g. one
+// backed up before the manifest existed) is compared by its contents.
+func sameAsRecorded(src string, srcInfo os.FileInfo, dest string, duplicates DuplicateFinder, algorithm HashAlgorithm) (bool, error) {
+	destInfo, err := os.Stat(dest)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if destInfo.Size() != srcInfo.Size() {
+		return false, nil
+	}
+	size, modTime, ok := duplicates.Recorded(dest)
+	if ok {
+		return size == srcInfo.Size() && modTime.Equal(srcInfo.ModTime()), nil
+	}
+	return contentsAreSame(src, dest, algorithm, io.Discard)
+}
+
+// linkDuplicate makes `dest` a hard link to (or clone of) `existing`, which
+// is trusted to have the hash recorded for it (`verify` checks that), as long
+// as it still has the same size. Returns `false` if the file has to be copied
+// instead.
+func linkDuplicate(existing string, dest string, srcInfo os.FileInfo, mode DedupeMode) (bool, error) {
+	existingInfo, err := os.Stat(existing)
+	if err != nil || existingInfo.Size() != srcInfo.Size() {
+		return false, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0700)
+	if err != nil {
+		return false, err
+	}
+	partial := dest + partialSuffix
+	switch mode {
+	case DedupeHardLink:
+		err = os.Link(existing, partial)
+	case DedupeReflink:
+		err = reflink(existing, partial)
+	default:
+		return false, fmt.Errorf("unknown dedupe mode: %#v", mode)
+	}
+	if err != nil {
+		// e.g. `existing` is on another filesystem, or the filesystem doesn't
+		// support reflinks.
+		os.Remove(partial)
+		return false, nil
+	}
+	if mode == DedupeReflink {
+		err = os.Chtimes(partial, accessTime(srcInfo), srcInfo.ModTime())
+		if err != nil {
+			os.Remove(partial)
+			return false, err
+		}
+	}
+
+	err = os.Rename(partial, dest)
+	if err != nil {
+		os.Remove(partial)
+		return false, err
+	}
+	return true, syncDir(filepath.Dir(dest))
+}
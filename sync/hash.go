@@ -0,0 +1,47 @@
+package sync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// HashAlgorithm names a content hash used to verify copies.
+type HashAlgorithm string
+
+const (
+	SHA256 HashAlgorithm = "sha256"
+	MD5    HashAlgorithm = "md5"
+	// CRC-32C is much faster than the cryptographic hashes on most CPUs, at
+	// the cost of only catching accidental corruption.
+	CRC32C HashAlgorithm = "crc32c"
+)
+
+// DefaultHashAlgorithm is used when the config doesn't specify one.
+const DefaultHashAlgorithm = SHA256
+
+// ParseHashAlgorithm returns `DefaultHashAlgorithm` for an empty name.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	switch HashAlgorithm(name) {
+	case "":
+		return DefaultHashAlgorithm, nil
+	case SHA256, MD5, CRC32C:
+		return HashAlgorithm(name), nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm: %#v", name)
+	}
+}
+
+// New returns a fresh hash for the algorithm.
+func (a HashAlgorithm) New() hash.Hash {
+	switch a {
+	case MD5:
+		return md5.New()
+	case CRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	default:
+		return sha256.New()
+	}
+}
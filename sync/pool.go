@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	gosync "sync"
+)
+
+// PoolOptions bound the number of concurrent copies.
+type PoolOptions struct {
+	// The maximum number of files being copied at the same time.
+	Workers int
+	// Per-key limits for `QueueOptions.SourceKey`, falling back to
+	// `DefaultSourceLimit`. A limit of 0 means no limit (other than `Workers`).
+	SourceLimits       map[string]int
+	DefaultSourceLimit int
+	// Per-key limits for `QueueOptions.DestinationKey`, falling back to
+	// `DefaultDestinationLimit`.
+	DestinationLimits       map[string]int
+	DefaultDestinationLimit int
+}
+
+// Pool is a Syncer that queues files for a bounded set of workers, which pass
+// them on to another Syncer.
+type Pool struct {
+	syncer  Syncer
+	options PoolOptions
+	workers chan struct{}
+
+	mutex            *gosync.Mutex
+	sourceSlots      map[string]chan struct{}
+	destinationSlots map[string]chan struct{}
+	pending          *gosync.WaitGroup
+	errs             []error
+}
+
+// NewPool requires `poolOptions.Workers` to be at least 1. The wrapped `syncer`
+// must be safe to use from multiple goroutines.
+func NewPool(syncer Syncer, poolOptions PoolOptions) *Pool {
+	return &Pool{
+		syncer:           syncer,
+		options:          poolOptions,
+		workers:          make(chan struct{}, poolOptions.Workers),
+		mutex:            &gosync.Mutex{},
+		sourceSlots:      map[string]chan struct{}{},
+		destinationSlots: map[string]chan struct{}{},
+		pending:          &gosync.WaitGroup{},
+	}
+}
+
+// slots returns the semaphore for `key`, or `nil` if it is unlimited.
+func (p *Pool) slots(all map[string]chan struct{}, limits map[string]int, defaultLimit int, key string) chan struct{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if slots, ok := all[key]; ok {
+		return slots
+	}
+	limit, ok := limits[key]
+	if !ok {
+		limit = defaultLimit
+	}
+	var slots chan struct{}
+	if limit > 0 {
+		slots = make(chan struct{}, limit)
+	}
+	all[key] = slots
+	return slots
+}
+
+func acquire(slots chan struct{}) {
+	if slots != nil {
+		slots <- struct{}{}
+	}
+}
+
+func release(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// Queue blocks until a worker is available, and then returns while the file
+// is copied in the background. Errors are returned from `Flush()`.
+func (p *Pool) Queue(src string, dest string, queueOptions QueueOptions) error {
+	sourceSlots := p.slots(p.sourceSlots, p.options.SourceLimits, p.options.DefaultSourceLimit, queueOptions.SourceKey)
+	destinationSlots := p.slots(p.destinationSlots, p.options.DestinationLimits, p.options.DefaultDestinationLimit, queueOptions.DestinationKey)
+
+	p.workers <- struct{}{}
+	p.pending.Add(1)
+	go func() {
+		defer func() {
+			<-p.workers
+			p.pending.Done()
+		}()
+
+		acquire(sourceSlots)
+		defer release(sourceSlots)
+		acquire(destinationSlots)
+		defer release(destinationSlots)
+
+		err := p.syncer.Queue(src, dest, queueOptions)
+		if err != nil {
+			p.mutex.Lock()
+			p.errs = append(p.errs, fmt.Errorf("%s: %w", src, err))
+			p.mutex.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Flush waits for all queued files, flushes the wrapped syncer, and returns
+// the combined errors of any that failed.
+func (p *Pool) Flush() error {
+	p.pending.Wait()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	errs := append(p.errs, p.syncer.Flush())
+	p.errs = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"errors"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSyncer records how many files it is copying at the same time.
+type countingSyncer struct {
+	mutex   *gosync.Mutex
+	current map[string]int
+	max     map[string]int
+	flushed atomic.Int32
+}
+
+func newCountingSyncer() *countingSyncer {
+	return &countingSyncer{
+		mutex:   &gosync.Mutex{},
+		current: map[string]int{},
+		max:     map[string]int{},
+	}
+}
+
+func (cs *countingSyncer) update(keys []string, delta int) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	for _, key := range keys {
+		cs.current[key] += delta
+		if cs.current[key] > cs.max[key] {
+			cs.max[key] = cs.current[key]
+		}
+	}
+}
+
+func (cs *countingSyncer) Queue(src string, dest string, queueOptions QueueOptions) (err error) {
+	defer func() { queueOptions.done(err) }()
+	keys := []string{"all", "src:" + queueOptions.SourceKey, "dest:" + queueOptions.DestinationKey}
+	cs.update(keys, 1)
+	time.Sleep(5 * time.Millisecond)
+	cs.update(keys, -1)
+	if strings.HasSuffix(src, ".bad") {
+		return errors.New("copy failed")
+	}
+	return nil
+}
+
+func (cs *countingSyncer) Flush() error {
+	cs.flushed.Add(1)
+	return nil
+}
+
+func TestPoolLimits(t *testing.T) {
+	inner := newCountingSyncer()
+	pool := NewPool(inner, PoolOptions{
+		Workers:            4,
+		SourceLimits:       map[string]int{"HERA": 1},
+		DefaultSourceLimit: 3,
+	})
+
+	for i := 0; i < 10; i++ {
+		pool.Queue("a", "b", QueueOptions{SourceKey: "HERA", DestinationKey: "/test"})
+		pool.Queue("a", "b", QueueOptions{SourceKey: "ZEUS", DestinationKey: "/test"})
+	}
+	err := pool.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limitCases := []struct {
+		key string
+		max int
+	}{
+		{"all", 4},
+		{"src:HERA", 1},
+		{"src:ZEUS", 3},
+	}
+	for _, c := range limitCases {
+		if inner.max[c.key] > c.max {
+			t.Errorf("[%s] Expected at most %d concurrent copies, got %d", c.key, c.max, inner.max[c.key])
+		}
+	}
+	if inner.max["all"] < 2 {
+		t.Errorf("Expected concurrent copies, got %d", inner.max["all"])
+	}
+	if inner.flushed.Load() != 1 {
+		t.Errorf("Expected the inner syncer to be flushed once, got %d", inner.flushed.Load())
+	}
+}
+
+func TestPoolErrors(t *testing.T) {
+	inner := newCountingSyncer()
+	pool := NewPool(inner, PoolOptions{Workers: 2})
+
+	var doneErrs atomic.Int32
+	onDone := func(err error) {
+		if err != nil {
+			doneErrs.Add(1)
+		}
+	}
+	for _, src := range []string{"1.jpg", "2.bad", "3.jpg", "4.bad"} {
+		pool.Queue(src, "dest", QueueOptions{OnDone: onDone})
+	}
+
+	err := pool.Flush()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, src := range []string{"2.bad", "4.bad"} {
+		if !strings.Contains(err.Error(), src) {
+			t.Errorf("[%s] Expected the error to mention the file, got %#v", src, err.Error())
+		}
+	}
+	if doneErrs.Load() != 2 {
+		t.Errorf("Expected 2 failed files, got %d", doneErrs.Load())
+	}
+	if inner.flushed.Load() != 1 {
+		t.Errorf("Expected the inner syncer to be flushed despite the errors, got %d", inner.flushed.Load())
+	}
+
+	err = pool.Flush()
+	if err != nil {
+		t.Errorf("Expected errors to be reset after `Flush()`, got %s", err)
+	}
+}
@@ -0,0 +1,14 @@
+package sync
+
+import (
+	"os"
+	"os/exec"
+)
+
+// reflink makes `dest` a copy-on-write clone of `src`, using `clonefile(2)`
+// through `cp -c`. This only works on APFS, and within a single volume.
+func reflink(src string, dest string) error {
+	cmd := exec.Command("cp", "-c", src, dest)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
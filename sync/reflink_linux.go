@@ -0,0 +1,31 @@
+package sync
+
+import (
+	"os"
+	"syscall"
+)
+
+// `FICLONE` from `linux/fs.h`.
+const ficlone = 0x40049409
+
+// reflink makes `dest` a copy-on-write clone of `src`. This only works on
+// filesystems that support it (e.g. Btrfs and XFS), and within a single
+// filesystem.
+func reflink(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	closeErr := out.Close()
+	if errno != 0 {
+		os.Remove(dest)
+		return &os.PathError{Op: "reflink", Path: dest, Err: errno}
+	}
+	return closeErr
+}
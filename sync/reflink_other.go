@@ -0,0 +1,10 @@
+//go:build !darwin && !linux
+
+package sync
+
+import "errors"
+
+// reflink is not supported on this platform.
+func reflink(src string, dest string) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,595 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 requires every part of a multipart upload except the last one to be at
+// least 5 MiB.
+const MinS3PartSize = 5 * 1024 * 1024
+
+const defaultS3PartSize = 16 * 1024 * 1024
+
+// Objects (and parts) larger than this can't be copied with a single request.
+const maxS3CopySize = 5 * 1024 * 1024 * 1024
+
+// Stored with each object, so that later runs can tell whether it is up to
+// date without downloading it.
+const (
+	s3HashAlgorithmHeader = "X-Amz-Meta-Sd-Card-Backup-Hash-Algorithm"
+	s3HashHeader          = "X-Amz-Meta-Sd-Card-Backup-Hash"
+	s3ModTimeHeader       = "X-Amz-Meta-Sd-Card-Backup-Mod-Time"
+)
+
+// S3Options describe an S3-compatible bucket.
+type S3Options struct {
+	// e.g. `https://s3.us-east-1.amazonaws.com`, or `http://localhost:9000` for
+	// MinIO. Buckets are always addressed path-style.
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// Prepended (with a `/`) to every key, if not empty.
+	Prefix string
+	// The `dest` paths passed to `Queue()` are relative to this folder, and
+	// are used as keys.
+	Root string
+	// Files larger than this are uploaded in parts of this size. Defaults to
+	// 16 MiB, and must be at least `MinS3PartSize`.
+	PartSize int64
+	// Defaults to `http.DefaultClient`.
+	Client *http.Client
+}
+
+// S3Error is an error response from the bucket.
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 request failed: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("S3 request failed: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// S3Syncer is a Syncer that uploads files to an S3-compatible bucket, using the
+// same layout as the local destination for the keys.
+//
+// Every request body is sent with `Content-MD5` and a signed SHA-256 payload
+// hash, so the bucket rejects anything that was corrupted on the way. The hash
+// of the whole file is stored in the object metadata, and checked after the
+// upload.
+type S3Syncer struct {
+	syncerOptions SyncerOptions
+	s3Options     S3Options
+	now           func() time.Time
+}
+
+func NewS3Syncer(syncerOptions SyncerOptions, s3Options S3Options) (S3Syncer, error) {
+	endpoint, err := url.Parse(s3Options.Endpoint)
+	if err != nil {
+		return S3Syncer{}, err
+	}
+	if (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return S3Syncer{}, fmt.Errorf("invalid S3 endpoint: %s", s3Options.Endpoint)
+	}
+	if s3Options.PartSize == 0 {
+		s3Options.PartSize = defaultS3PartSize
+	}
+	if s3Options.PartSize < MinS3PartSize {
+		return S3Syncer{}, fmt.Errorf("S3 part size must be at least %d bytes: %d", MinS3PartSize, s3Options.PartSize)
+	}
+	if s3Options.Client == nil {
+		s3Options.Client = http.DefaultClient
+	}
+	return S3Syncer{
+		syncerOptions: syncerOptions,
+		s3Options:     s3Options,
+		now:           time.Now,
+	}, nil
+}
+
+// key returns the object key for a destination path.
+func (s S3Syncer) key(dest string) (string, error) {
+	relPath, err := filepath.Rel(s.s3Options.Root, dest)
+	if err != nil {
+		return "", err
+	}
+	if relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("not in the S3 destination root: %s", dest)
+	}
+	return path.Join(s.s3Options.Prefix, filepath.ToSlash(relPath)), nil
+}
+
+// URL returns the URL of the object for `key`.
+func (s S3Syncer) URL(key string) string {
+	return s.objectURL(key, nil).String()
+}
+
+func (s S3Syncer) objectURL(key string, query url.Values) *url.URL {
+	endpoint, _ := url.Parse(s.s3Options.Endpoint)
+	objectPath := strings.TrimSuffix(endpoint.Path, "/") + "/" + s.s3Options.Bucket + "/" + key
+	escapedPath := strings.TrimSuffix(endpoint.EscapedPath(), "/") + "/" + s3Escape(s.s3Options.Bucket, false) + "/" + s3Escape(key, false)
+	return &url.URL{
+		Scheme:   endpoint.Scheme,
+		Host:     endpoint.Host,
+		Path:     objectPath,
+		RawPath:  escapedPath,
+		RawQuery: canonicalQuery(query),
+	}
+}
+
+// s3Escape percent-encodes everything except the unreserved characters (and
+// `/`, unless `encodeSlash` is set), as required for signing.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		values := append([]string{}, query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds an AWS Signature Version 4 `Authorization` header to `req`,
+// signing the host and every header that is already set.
+func (s S3Syncer) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.s3Options.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.s3Options.SecretAccessKey), date)
+	key = hmacSHA256(key, s.s3Options.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.s3Options.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// do sends a signed request. Bodies are always in memory (at most one part),
+// so that they can be hashed for the signature and `Content-MD5`.
+func (s S3Syncer) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, "", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL = s.objectURL(key, query)
+	req.Host = req.URL.Host
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	s.sign(req, sha256Hex(body), s.now())
+
+	resp, err := s.s3Options.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3Err := &S3Error{StatusCode: resp.StatusCode}
+		// HEAD responses have no body, and other errors may not be XML.
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(b, s3Err)
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+// s3Object is what we know about an object from its metadata.
+type s3Object struct {
+	Size          int64
+	HashAlgorithm HashAlgorithm
+	Hash          string
+}
+
+// head returns `false` if the object doesn't exist.
+func (s S3Syncer) head(key string) (s3Object, bool, error) {
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) && s3Err.StatusCode == http.StatusNotFound {
+		return s3Object{}, false, nil
+	}
+	if err != nil {
+		return s3Object{}, false, err
+	}
+	resp.Body.Close()
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return s3Object{}, false, fmt.Errorf("invalid size for S3 object %s: %s", key, err)
+	}
+	return s3Object{
+		Size:          size,
+		HashAlgorithm: HashAlgorithm(resp.Header.Get(s3HashAlgorithmHeader)),
+		Hash:          resp.Header.Get(s3HashHeader),
+	}, true, nil
+}
+
+// metadata returns the object metadata for `srcInfo`. The hash is left out if
+// it isn't known yet.
+func (s S3Syncer) metadata(srcInfo os.FileInfo, hash string) http.Header {
+	header := http.Header{}
+	header.Set(s3HashAlgorithmHeader, string(s.syncerOptions.HashAlgorithm))
+	if hash != "" {
+		header.Set(s3HashHeader, hash)
+	}
+	header.Set(s3ModTimeHeader, srcInfo.ModTime().UTC().Format(time.RFC3339Nano))
+	return header
+}
+
+// putObject uploads a file that fits in a single part. Returns the hash of the
+// uploaded contents.
+func (s S3Syncer) putObject(key string, src string, srcInfo os.FileInfo, onProgress func(int64)) (string, error) {
+	body, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	h := s.syncerOptions.HashAlgorithm.New()
+	h.Write(body)
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	resp, err := s.do(http.MethodPut, key, nil, s.metadata(srcInfo, hash), body)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if onProgress != nil {
+		onProgress(int64(len(body)))
+	}
+	return hash, nil
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// initiateMultipartUpload starts a multipart upload to `key`, and returns its
+// ID.
+func (s S3Syncer) initiateMultipartUpload(key string, header http.Header) (string, error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", err
+	}
+	initiated := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	if initiated.UploadID == "" {
+		return "", fmt.Errorf("no upload ID for S3 object: %s", key)
+	}
+	return initiated.UploadID, nil
+}
+
+// abortMultipartUpload is called if a multipart upload fails, and adds any
+// error aborting it to `*err`. Otherwise, the parts are kept (and billed)
+// until they expire.
+func (s S3Syncer) abortMultipartUpload(key string, uploadID string, err *error) {
+	if *err == nil {
+		return
+	}
+	resp, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if abortErr != nil {
+		*err = errors.Join(*err, abortErr)
+		return
+	}
+	resp.Body.Close()
+}
+
+// doAndCheckBody sends a request that can fail after a `200 OK` has been sent,
+// in which case the error is in the body.
+func (s S3Syncer) doAndCheckBody(method string, key string, query url.Values, header http.Header, body []byte) error {
+	resp, err := s.do(method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		s3Err := &S3Error{StatusCode: resp.StatusCode}
+		xml.Unmarshal(b, s3Err)
+		return s3Err
+	}
+	return nil
+}
+
+func (s S3Syncer) completeMultipartUpload(key string, uploadID string, complete completeMultipartUpload) error {
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	return s.doAndCheckBody(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+}
+
+// multipartUpload uploads a file in parts, reading it once. Each part is
+// hashed (for the signature and `Content-MD5`) as it is read, and the hash of
+// the whole file is computed from the same reads. Returns that hash.
+//
+// The object metadata has to be set when the upload starts. If `srcHash` is
+// known, it is set then (and the upload fails if the file changed in
+// between). Otherwise, the metadata is replaced once the upload is complete.
+func (s S3Syncer) multipartUpload(key string, src string, srcInfo os.FileInfo, srcHash string, onProgress func(int64)) (hash string, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	uploadID, err := s.initiateMultipartUpload(key, s.metadata(srcInfo, srcHash))
+	if err != nil {
+		return "", err
+	}
+	defer s.abortMultipartUpload(key, uploadID, &err)
+
+	h := s.syncerOptions.HashAlgorithm.New()
+	complete := completeMultipartUpload{}
+	buffer := make([]byte, s.s3Options.PartSize)
+	size := int64(0)
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(in, buffer)
+		if readErr == io.EOF && partNumber > 1 {
+			break
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return "", readErr
+		}
+		h.Write(buffer[:n])
+		size += int64(n)
+
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		resp, err := s.do(http.MethodPut, key, query, nil, buffer[:n])
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+		if onProgress != nil {
+			onProgress(int64(n))
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	hash = hex.EncodeToString(h.Sum(nil))
+	if srcHash != "" && hash != srcHash {
+		return "", &VerificationError{Dest: s.URL(key), SourceHash: srcHash, DestHash: hash}
+	}
+	err = s.completeMultipartUpload(key, uploadID, complete)
+	if err != nil {
+		return "", err
+	}
+	if srcHash == "" {
+		err = s.replaceMetadata(key, size, s.metadata(srcInfo, hash))
+		if err != nil {
+			return "", err
+		}
+	}
+	return hash, nil
+}
+
+// replaceMetadata copies the object at `key` onto itself (within the bucket)
+// with new metadata.
+func (s S3Syncer) replaceMetadata(key string, size int64, metadata http.Header) error {
+	copySource := "/" + s3Escape(s.s3Options.Bucket+"/"+key, false)
+	if size <= maxS3CopySize {
+		header := metadata.Clone()
+		header.Set("X-Amz-Copy-Source", copySource)
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+		return s.doAndCheckBody(http.MethodPut, key, nil, header, nil)
+	}
+	return s.multipartCopy(key, copySource, size, metadata)
+}
+
+// multipartCopy copies `copySource` to `key` in parts, since it is too large
+// to copy with a single request.
+func (s S3Syncer) multipartCopy(key string, copySource string, size int64, metadata http.Header) (err error) {
+	uploadID, err := s.initiateMultipartUpload(key, metadata)
+	if err != nil {
+		return err
+	}
+	defer s.abortMultipartUpload(key, uploadID, &err)
+
+	complete := completeMultipartUpload{}
+	for partNumber, start := 1, int64(0); start < size; partNumber, start = partNumber+1, start+maxS3CopySize {
+		end := min(start+maxS3CopySize, size) - 1
+		header := http.Header{}
+		header.Set("X-Amz-Copy-Source", copySource)
+		header.Set("X-Amz-Copy-Source-Range", fmt.Sprintf("bytes=%d-%d", start, end))
+		query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {uploadID}}
+		resp, err := s.do(http.MethodPut, key, query, header, nil)
+		if err != nil {
+			return err
+		}
+		result := struct {
+			ETag string `xml:"ETag"`
+		}{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: partNumber, ETag: result.ETag})
+	}
+	return s.completeMultipartUpload(key, uploadID, complete)
+}
+
+func (s S3Syncer) Queue(src string, dest string, queueOptions QueueOptions) (err error) {
+	defer func() { queueOptions.done(err) }()
+	out := queueOptions.output()
+	algorithm := s.syncerOptions.HashAlgorithm
+
+	if len(queueOptions.Mirrors) > 0 {
+		return errors.New("S3Syncer does not support mirrors")
+	}
+	key, err := s.key(dest)
+	if err != nil {
+		return err
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	object, exists, err := s.head(key)
+	if err != nil {
+		return err
+	}
+	srcHash := ""
+	if exists {
+		switch {
+		case object.Size != srcInfo.Size():
+			fmt.Fprintf(out, "\n↪️ file size differs: %d src bytes vs. %d dest bytes", srcInfo.Size(), object.Size)
+		case object.HashAlgorithm != algorithm:
+			fmt.Fprintf(out, "\n↪️ no %s hash in the object metadata", algorithm)
+		default:
+			srcHash, err = HashFile(src, algorithm)
+			if err != nil {
+				return err
+			}
+			if srcHash == object.Hash {
+				printAlreadyBackedUp(out)
+				return nil
+			}
+			fmt.Fprintf(out, "\n↪️ contents differ: %s src vs. %s dest", srcHash, object.Hash)
+		}
+	}
+
+	fmt.Fprintf(out, "\n↪ %s (%d MB)", s.URL(key), srcInfo.Size()/BYTES_IN_MEGABYTE)
+
+	err = queueOptions.start()
+	if err != nil {
+		return err
+	}
+
+	if srcInfo.Size() <= s.s3Options.PartSize {
+		srcHash, err = s.putObject(key, src, srcInfo, queueOptions.OnProgress)
+	} else {
+		srcHash, err = s.multipartUpload(key, src, srcInfo, srcHash, queueOptions.OnProgress)
+	}
+	if err != nil {
+		return err
+	}
+
+	object, exists, err = s.head(key)
+	if err != nil {
+		return err
+	}
+	if !exists || object.Size != srcInfo.Size() || object.Hash != srcHash {
+		return &VerificationError{Dest: s.URL(key), SourceHash: srcHash, DestHash: object.Hash}
+	}
+
+	return queueOptions.copied(src, dest, srcInfo, algorithm, srcHash, "")
+}
+
+// Flush is a no-op for S3Syncer, which uploads immediately.
+func (s S3Syncer) Flush() error {
+	return nil
+}
@@ -3,16 +3,15 @@ package sync
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"syscall"
+	gosync "sync"
 	"time"
-
-	"github.com/mostafah/fsync"
 )
 
 const SECONDS_IN_AN_HOUR = 60 * 60
@@ -20,33 +19,147 @@ const BYTES_IN_MEGABYTE = 1000 * 1000
 
 type QueueOptions struct {
 	RevealPathOSC8 bool
+	// Where to print progress for this file. Defaults to `os.Stdout`.
+	Output io.Writer
+	// Called after the file has been copied and verified (but not if it was
+	// skipped because it appears to be backed up already).
+	OnCopied func(Result) error
+	// Called with the number of bytes written as the file is copied.
+	OnProgress func(bytes int64)
+	// Called right before the file is copied (but not if it is skipped).
+	OnStart func() error
+	// Compare the hashes of the source and an existing destination, instead of
+	// trusting the size and time heuristic (e.g. after an interrupted copy).
+	Verify bool
+	// Called exactly once, when the syncer is done with the file (whether or
+	// not it was copied). This may be after `Queue()` returns.
+	OnDone func(err error)
+	// Used by `Pool` to limit concurrent copies from the same source and to the
+	// same destination.
+	SourceKey      string
+	DestinationKey string
+	// Additional destinations to write the file to. The source is only read
+	// once, however many destinations need a copy.
+	Mirrors []string
+	// Used to find existing copies of the file if `SyncerOptions.Dedupe` is
+	// set.
+	Duplicates DuplicateFinder
+	// Called if writing to one of the `Mirrors` fails. If it returns `nil`, the
+	// file is still copied to the other destinations. Defaults to failing the
+	// whole file.
+	OnMirrorFailed func(dest string, err error) error
+}
+
+// destinations returns `dest` followed by the mirrors.
+func (queueOptions QueueOptions) destinations(dest string) []string {
+	return append([]string{dest}, queueOptions.Mirrors...)
+}
+
+func (queueOptions QueueOptions) mirrorFailed(dest string, err error) error {
+	if queueOptions.OnMirrorFailed == nil {
+		return err
+	}
+	return queueOptions.OnMirrorFailed(dest, err)
+}
+
+func (queueOptions QueueOptions) output() io.Writer {
+	if queueOptions.Output == nil {
+		return os.Stdout
+	}
+	return queueOptions.Output
+}
+
+func (queueOptions QueueOptions) start() error {
+	if queueOptions.OnStart == nil {
+		return nil
+	}
+	return queueOptions.OnStart()
+}
+
+func (queueOptions QueueOptions) done(err error) {
+	if queueOptions.OnDone != nil {
+		queueOptions.OnDone(err)
+	}
+}
+
+// Result describes a completed copy.
+type Result struct {
+	Src           string
+	Dest          string
+	Size          int64
+	ModTime       time.Time
+	BirthTime     time.Time
+	HashAlgorithm HashAlgorithm
+	Hash          string
+	// The existing file that `Dest` was linked to (or cloned from) instead of
+	// being copied, if any.
+	LinkedTo string
+}
+
+func (queueOptions QueueOptions) copied(src string, dest string, srcInfo os.FileInfo, algorithm HashAlgorithm, hash string, linkedTo string) error {
+	if queueOptions.OnCopied == nil {
+		return nil
+	}
+	birthTime, err := BirthTime(src)
+	if err != nil {
+		return err
+	}
+	return queueOptions.OnCopied(Result{
+		Src:           src,
+		Dest:          dest,
+		Size:          srcInfo.Size(),
+		ModTime:       srcInfo.ModTime(),
+		BirthTime:     birthTime,
+		HashAlgorithm: algorithm,
+		Hash:          hash,
+		LinkedTo:      linkedTo,
+	})
+}
+
+// SyncerOptions are shared by every file that a Syncer copies.
+type SyncerOptions struct {
+	HashAlgorithm HashAlgorithm
+	// Requires `QueueOptions.Duplicates`.
+	Dedupe DedupeMode
 }
 
 // Syncer represents a way to sync a list of files.
 type Syncer interface {
 	Queue(src string, dest string, queueOptions QueueOptions) error
 	// Flushes any queued operations that are not completed, before returning.
-	// Flush() error
+	Flush() error
 }
 
-// GoSyncer is a Syncer implemented in Go.
-type GoSyncer struct{}
-
-// Queue syncs immediately using `fsync.Sync`.
-func (s GoSyncer) Queue(src string, dest string) error {
-	os.MkdirAll(filepath.Dir(dest), 0700)
-	err := fsync.Sync(dest, src)
-	if err != nil {
-		return err
+// NewSyncer returns the native Syncer for the current platform.
+func NewSyncer(syncerOptions SyncerOptions) (Syncer, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return NewMacOSNativeCpUsingFilesizeAndBirthTime(syncerOptions), nil
+	default:
+		return NewGoSyncer(syncerOptions), nil
 	}
+}
 
-	return fsync.Sync(dest, src)
+// GoSyncer is a portable Syncer implemented in Go, using `copyFile`.
+//
+// It can't set birth times, so it compares and preserves the modification
+// time instead.
+type GoSyncer struct {
+	syncerOptions SyncerOptions
 }
 
-// // Flush is a no-op for GoSyncer.
-// func (s GoSyncer) Flush() error {
-// 	return nil
-// }
+func NewGoSyncer(syncerOptions SyncerOptions) GoSyncer {
+	return GoSyncer{syncerOptions: syncerOptions}
+}
+
+func (s GoSyncer) Queue(src string, dest string, queueOptions QueueOptions) error {
+	return queueFile(src, dest, queueOptions, s.syncerOptions, modFileTime, nil)
+}
+
+// Flush is a no-op for GoSyncer, which copies immediately.
+func (s GoSyncer) Flush() error {
+	return nil
+}
 
 // ImmediateRsync shells out queued files to rsync.
 type ImmediateRsync struct{}
@@ -60,18 +173,29 @@ func (r ImmediateRsync) Queue(src string, dest string) error {
 	return cmd.Run()
 }
 
+// MacOSNativeCpUsingFilesizeAndBirthTime copies using `copyFile`, and then
+// uses the macOS developer tools to carry over the birth time.
 type MacOSNativeCpUsingFilesizeAndBirthTime struct {
+	syncerOptions SyncerOptions
 }
 
-func NewMacOSNativeCpUsingFilesizeAndBirthTime() MacOSNativeCpUsingFilesizeAndBirthTime {
+func NewMacOSNativeCpUsingFilesizeAndBirthTime(syncerOptions SyncerOptions) MacOSNativeCpUsingFilesizeAndBirthTime {
 	if runtime.GOOS != "darwin" {
 		fmt.Printf("Running a macOS-specific sync implementation outside macOS. Exiting.")
 		os.Exit(1)
 	}
-	return MacOSNativeCpUsingFilesizeAndBirthTime{}
+	return MacOSNativeCpUsingFilesizeAndBirthTime{syncerOptions: syncerOptions}
 }
 
-var alreadyBackedUpMessageShown = false
+var alreadyBackedUpMessage = gosync.Once{}
+
+func printAlreadyBackedUp(out io.Writer) {
+	fmt.Fprint(out, " ⏩")
+	alreadyBackedUpMessage.Do(func() {
+		fmt.Fprintf(out, "\n↪️ Skipping because the file appears to be backed up")
+		fmt.Fprintf(out, "\n  ↪️ (This message will not be shown again during this run, and only a `⏩` icon will be shown after the corresponding file instead.)")
+	})
+}
 
 // TODO: better argument handling.
 func RevealablePath(path string, revealPathOSC8 bool) string {
@@ -87,125 +211,264 @@ func RevealablePath(path string, revealPathOSC8 bool) string {
 }
 
 func (s MacOSNativeCpUsingFilesizeAndBirthTime) Queue(src string, dest string, queueOptions QueueOptions) error {
-	same, srcStat, err := s.fileIsSameHeuristic(src, dest)
+	return queueFile(src, dest, queueOptions, s.syncerOptions, birthFileTime, setBirthTime)
+}
+
+// setBirthTime carries over the birth time of `src` to `dest`.
+func setBirthTime(src string, dest string) error {
+	cmd := exec.Command("GetFileInfo", "-d", src)
+	cmd.Stderr = os.Stderr
+	birthTimeStringBytesFromMacOS, err := cmd.Output()
 	if err != nil {
+		// TODO: more info about the file we failed on?
 		return err
 	}
+	birthTimeStringFromMacOS := strings.TrimSuffix(string(birthTimeStringBytesFromMacOS), "\n")
 
-	if same {
-		fmt.Print(" ⏩")
-		if !(alreadyBackedUpMessageShown) {
-			fmt.Printf("\n↪️ Skipping because the file appears to be backed up")
-			fmt.Printf("\n  ↪️ (This message will not be shown again during this run, and only a `⏩` icon will be shown after the corresponding file instead.)")
-			alreadyBackedUpMessageShown = true
-		}
-		return nil
+	srcBirthTime, err := BirthTime(src)
+	if err != nil {
+		return err
 	}
+	formattedTimeFromStat := srcBirthTime.Format("01/02/2006 15:04:05")
 
-	fmt.Printf("\n↪ %s (%d MB)", RevealablePath(dest, queueOptions.RevealPathOSC8), srcStat.Size/BYTES_IN_MEGABYTE)
+	if birthTimeStringFromMacOS != formattedTimeFromStat {
+		// TODO: remove the `birthTimeStringFromMacOS` calculation once these have been stress tested across time zones.
+		return fmt.Errorf("incompatible times: (%v, %v)", birthTimeStringFromMacOS, formattedTimeFromStat)
+	}
 
-	os.MkdirAll(filepath.Dir(dest), 0700)
+	cmd2 := exec.Command("SetFile", "-d", string(birthTimeStringFromMacOS), dest)
+	cmd2.Stderr = os.Stderr
+	return cmd2.Run()
+}
 
-	{
-		// TODO: output progress using https://unix.stackexchange.com/questions/66795/how-to-check-progress-of-running-cp#:~:text=On%20recent%20versions%20of%20Mac,written%20to%20the%20standard%20output.%22
+// queueFile implements `Queue()` for the syncers that use `copyFile()`. `ft`
+// decides whether a destination is already backed up, and `finish` (if not
+// `nil`) is run on each destination after it has been copied.
+func queueFile(src string, dest string, queueOptions QueueOptions, syncerOptions SyncerOptions, ft fileTime, finish func(src string, dest string) error) (err error) {
+	defer func() { queueOptions.done(err) }()
+	out := queueOptions.output()
+	algorithm := syncerOptions.HashAlgorithm
+	dedupe := syncerOptions.Dedupe != NoDedupe && queueOptions.Duplicates != nil
+
+	// Failures for `dest` fail the file, but failures for a mirror may only
+	// drop that mirror.
+	failed := func(d string, err error) error {
+		if d == dest {
+			return err
+		}
+		return queueOptions.mirrorFailed(d, err)
+	}
 
-		// `-p` copies modification and access time, but not creation (birth) time.
-		cmd := exec.Command("cp", src, dest)
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+	var srcInfo os.FileInfo
+	needed := []string{}
+	for _, d := range queueOptions.destinations(dest) {
+		same, info, err := fileIsSameHeuristic(src, d, ft, out)
+		if err == nil && same && queueOptions.Verify {
+			same, err = contentsAreSame(src, d, algorithm, out)
+		}
+		if err == nil && !same && dedupe && syncerOptions.Dedupe == DedupeHardLink {
+			// Hard links share the times of the file they link to, so they are
+			// recognized by the manifest instead.
+			same, err = sameAsRecorded(src, info, d, queueOptions.Duplicates, algorithm)
+		}
 		if err != nil {
-			// TODO: more info about the file we failed on?
-			return err
+			if err := failed(d, err); err != nil {
+				return err
+			}
+			continue
+		}
+		// Always set by the first destination, since failures there return.
+		srcInfo = info
+		if !same {
+			needed = append(needed, d)
 		}
 	}
 
-	{
-		// TODO: output progress using https://unix.stackexchange.com/questions/66795/how-to-check-progress-of-running-cp#:~:text=On%20recent%20versions%20of%20Mac,written%20to%20the%20standard%20output.%22
+	if len(needed) == 0 {
+		printAlreadyBackedUp(out)
+		return nil
+	}
 
-		// `-p` copies modification and access time, but not creation (birth) time.
-		cmd := exec.Command("touch", "-r", src, dest)
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
-		if err != nil {
-			// TODO: more info about the file we failed on?
+	for _, d := range needed {
+		fmt.Fprintf(out, "\n↪ %s (%d MB)", RevealablePath(d, queueOptions.RevealPathOSC8), srcInfo.Size()/BYTES_IN_MEGABYTE)
+	}
+
+	err = queueOptions.start()
+	if err != nil {
+		return err
+	}
+
+	if dedupe {
+		needed, err = linkDuplicates(src, srcInfo, needed, queueOptions, syncerOptions, failed)
+		if err != nil || len(needed) == 0 {
 			return err
 		}
 	}
 
-	{
-		cmd := exec.Command("GetFileInfo", "-d", src)
-		cmd.Stderr = os.Stderr
-		birthTimeStringBytesFromMacOS, err := cmd.Output()
+	hash, copied, err := copyFileToAll(src, needed, algorithm, queueOptions.OnProgress, failed)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range copied {
+		if finish != nil {
+			err := finish(src, d)
+			if err != nil {
+				return err
+			}
+		}
+		err := queueOptions.copied(src, d, srcInfo, algorithm, hash, "")
 		if err != nil {
-			// TODO: more info about the file we failed on?
 			return err
 		}
-		birthTimeStringFromMacOS := strings.TrimSuffix(string(birthTimeStringBytesFromMacOS), "\n")
-
-		formattedTimeFromStat := time.Unix(srcStat.Birthtimespec.Sec, srcStat.Birthtimespec.Nsec).Format("01/02/2006 15:04:05")
+	}
+	return nil
+}
 
-		if birthTimeStringFromMacOS != formattedTimeFromStat {
-			// TODO: remove the `birthTimeStringFromMacOS` calculation once these have been stress tested across time zones.
-			return fmt.Errorf("incompatible times: (%v, %v)", birthTimeStringFromMacOS, formattedTimeFromStat)
+// linkDuplicates links each of `needed` to an existing file with the same
+// contents where possible, and returns the destinations that still need to be
+// copied. The source is only hashed (an extra read) if a file with the same
+// size exists.
+func linkDuplicates(src string, srcInfo os.FileInfo, needed []string, queueOptions QueueOptions, syncerOptions SyncerOptions, failed func(string, error) error) ([]string, error) {
+	hash := ""
+	remaining := []string{}
+	for _, d := range needed {
+		if !queueOptions.Duplicates.HasSize(d, srcInfo.Size()) {
+			remaining = append(remaining, d)
+			continue
 		}
-
-		{
-			cmd2 := exec.Command("SetFile", "-d", string(birthTimeStringFromMacOS), dest)
-			cmd2.Stderr = os.Stderr
-			err = cmd2.Run()
+		if hash == "" {
+			var err error
+			hash, err = HashFile(src, syncerOptions.HashAlgorithm)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
+		existing, ok := queueOptions.Duplicates.Find(d, srcInfo.Size(), hash)
+		linked := false
+		var err error
+		if ok {
+			linked, err = linkDuplicate(existing, d, srcInfo, syncerOptions.Dedupe)
+		}
+		if err != nil {
+			if err := failed(d, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !linked {
+			remaining = append(remaining, d)
+			continue
+		}
+		fmt.Fprintf(queueOptions.output(), " 🔗 %s", existing)
+		err = queueOptions.copied(src, d, srcInfo, syncerOptions.HashAlgorithm, hash, existing)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Otherwise, the copy reports the progress.
+	if len(remaining) == 0 && queueOptions.OnProgress != nil {
+		queueOptions.OnProgress(srcInfo.Size())
 	}
+	return remaining, nil
+}
 
+// Flush is a no-op for MacOSNativeCpUsingFilesizeAndBirthTime, which copies
+// immediately.
+func (s MacOSNativeCpUsingFilesizeAndBirthTime) Flush() error {
 	return nil
 }
 
-var daylightSavingsMessageShown = false
+var daylightSavingsMessage = gosync.Once{}
 
-// Returns src stat if there was no error.
-func (s MacOSNativeCpUsingFilesizeAndBirthTime) fileIsSameHeuristic(src string, dest string) (bool, *syscall.Stat_t, error) {
+// fileTime returns the timestamp that a Syncer compares (and preserves) to
+// decide whether two files are the same.
+type fileTime struct {
+	name string
+	of   func(path string, info os.FileInfo) (time.Time, error)
+}
+
+var birthFileTime = fileTime{
+	name: "birth time",
+	of: func(path string, info os.FileInfo) (time.Time, error) {
+		return BirthTime(path)
+	},
+}
+
+var modFileTime = fileTime{
+	name: "modification time",
+	of: func(path string, info os.FileInfo) (time.Time, error) {
+		return info.ModTime(), nil
+	},
+}
+
+// Returns src info if there was no error.
+func fileIsSameHeuristic(src string, dest string, ft fileTime, out io.Writer) (bool, os.FileInfo, error) {
 	if filepath.Base(src) != filepath.Base((dest)) {
 		return false, nil, errors.New("heuristic encountered two files with different base names")
 	}
 
-	srcStat := syscall.Stat_t{}
-	err := syscall.Stat(src, &srcStat)
+	srcInfo, err := os.Stat(src)
 	if err != nil {
 		return false, nil, err
 	}
 
-	destStat := syscall.Stat_t{}
-	err = syscall.Stat(dest, &destStat)
+	destInfo, err := os.Stat(dest)
 	if err != nil {
-		if err.Error() == "no such file or directory" {
-			return false, &srcStat, nil
+		if os.IsNotExist(err) {
+			return false, srcInfo, nil
 		}
 		return false, nil, err
 	}
 
-	if srcStat.Size != destStat.Size {
-		fmt.Printf("\n↪️ file size differs: %d src bytes vs. %d dest bytes", srcStat.Size, destStat.Size)
-		return false, &srcStat, nil
+	if srcInfo.Size() != destInfo.Size() {
+		fmt.Fprintf(out, "\n↪️ file size differs: %d src bytes vs. %d dest bytes", srcInfo.Size(), destInfo.Size())
+		return false, srcInfo, nil
+	}
+
+	srcTime, err := ft.of(src, srcInfo)
+	if err != nil {
+		return false, nil, err
+	}
+	destTime, err := ft.of(dest, destInfo)
+	if err != nil {
+		return false, nil, err
 	}
 
-	if srcStat.Birthtimespec.Sec != destStat.Birthtimespec.Sec {
-		if srcStat.Birthtimespec.Sec+SECONDS_IN_AN_HOUR == destStat.Birthtimespec.Sec || srcStat.Birthtimespec.Sec == destStat.Birthtimespec.Sec+SECONDS_IN_AN_HOUR {
+	srcSec := srcTime.Unix()
+	destSec := destTime.Unix()
+	if srcSec != destSec {
+		if srcSec+SECONDS_IN_AN_HOUR == destSec || srcSec == destSec+SECONDS_IN_AN_HOUR {
 			// https://github.com/lgarron/sd-card-backup/issues/3
-			fmt.Printf(" 🕐")
-			if !(daylightSavingsMessageShown) {
-				fmt.Printf("\n↪️ birth time differs by exactly one hour, assuming this is due to Daylight Savings and treating as the same: %d src vs. %d dest", srcStat.Birthtimespec.Sec, destStat.Birthtimespec.Sec)
-				fmt.Printf("\n  ↪️ (This message will not be shown again during this run, and only a `🕐` icon will be shown after the corresponding file instead.)")
-				daylightSavingsMessageShown = true
-			}
+			fmt.Fprintf(out, " 🕐")
+			daylightSavingsMessage.Do(func() {
+				fmt.Fprintf(out, "\n↪️ %s differs by exactly one hour, assuming this is due to Daylight Savings and treating as the same: %d src vs. %d dest", ft.name, srcSec, destSec)
+				fmt.Fprintf(out, "\n  ↪️ (This message will not be shown again during this run, and only a `🕐` icon will be shown after the corresponding file instead.)")
+			})
 		} else {
-			fmt.Printf("\n↪️ birth time differs: %d src vs. %d dest", srcStat.Birthtimespec.Sec, destStat.Birthtimespec.Sec)
-			return false, &srcStat, nil
+			fmt.Fprintf(out, "\n↪️ %s differs: %d src vs. %d dest", ft.name, srcSec, destSec)
+			return false, srcInfo, nil
 		}
 	}
 
-	return true, &srcStat, nil
+	return true, srcInfo, nil
+}
+
+// contentsAreSame compares the hashes of `src` and `dest`.
+func contentsAreSame(src string, dest string, algorithm HashAlgorithm, out io.Writer) (bool, error) {
+	srcHash, err := HashFile(src, algorithm)
+	if err != nil {
+		return false, err
+	}
+	destHash, err := HashFile(dest, algorithm)
+	if err != nil {
+		return false, err
+	}
+	if srcHash != destHash {
+		fmt.Fprintf(out, "\n↪️ contents differ: %s src vs. %s dest", srcHash, destHash)
+		return false, nil
+	}
+	return true, nil
 }
 
 // type fileToSync struct {
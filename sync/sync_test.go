@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGoSyncerVerify(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "C0001.MP4")
+	dest := filepath.Join(dir, "dest", "C0001.MP4")
+	modTime := time.Date(2018, 4, 21, 10, 30, 0, 0, time.UTC)
+	for path, contents := range map[string]string{src: "complete", dest: "trunc\x00\x00\x00"} {
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	syncer := NewGoSyncer(SyncerOptions{HashAlgorithm: SHA256})
+	verifyCases := []struct {
+		verify   bool
+		wantDest string
+	}{
+		// Same size and modification time, so the heuristic trusts it.
+		{false, "trunc\x00\x00\x00"},
+		{true, "complete"},
+	}
+	for _, c := range verifyCases {
+		started := false
+		err := syncer.Queue(src, dest, QueueOptions{
+			Output:  io.Discard,
+			Verify:  c.verify,
+			OnStart: func() error { started = true; return nil },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := os.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != c.wantDest {
+			t.Errorf("[verify: %v] Expected %#v, got %#v", c.verify, c.wantDest, string(contents))
+		}
+		if started != c.verify {
+			t.Errorf("[verify: %v] Expected `OnStart` to be called: %v", c.verify, c.verify)
+		}
+	}
+}
+
+func TestGoSyncerMirrors(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "IMG_0001.JPG")
+	dest := filepath.Join(dir, "primary", "IMG_0001.JPG")
+	mirror := filepath.Join(dir, "mirror", "IMG_0001.JPG")
+	// A file where the mirror's folder should be, so that writing to it fails.
+	brokenMirror := filepath.Join(dir, "broken", "IMG_0001.JPG")
+	for path, contents := range map[string]string{src: "jpeg", filepath.Dir(brokenMirror): "not a folder"} {
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	syncer := NewGoSyncer(SyncerOptions{HashAlgorithm: SHA256})
+	var read int64
+	copied := []string{}
+	failed := []string{}
+	err := syncer.Queue(src, dest, QueueOptions{
+		Output:     io.Discard,
+		Mirrors:    []string{brokenMirror, mirror},
+		OnProgress: func(n int64) { read += n },
+		OnCopied: func(result Result) error {
+			copied = append(copied, result.Dest)
+			return nil
+		},
+		OnMirrorFailed: func(dest string, err error) error {
+			failed = append(failed, dest)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != int64(len("jpeg")) {
+		t.Errorf("Expected the source to be read once, got %d bytes", read)
+	}
+	if len(copied) != 2 || copied[0] != dest || copied[1] != mirror {
+		t.Errorf("Expected %#v, got %#v", []string{dest, mirror}, copied)
+	}
+	if len(failed) != 1 || failed[0] != brokenMirror {
+		t.Errorf("Expected %#v, got %#v", []string{brokenMirror}, failed)
+	}
+
+	// Without `OnMirrorFailed`, a failing mirror fails the file.
+	err = os.Remove(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncer.Queue(src, dest, QueueOptions{Output: io.Discard, Mirrors: []string{brokenMirror}})
+	if err == nil {
+		t.Errorf("Expected an error for the broken mirror")
+	}
+
+	// Only the destinations that are missing the file are written to.
+	copied = []string{}
+	err = syncer.Queue(src, dest, QueueOptions{
+		Output:  io.Discard,
+		Mirrors: []string{mirror},
+		OnCopied: func(result Result) error {
+			copied = append(copied, result.Dest)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(copied) != 1 || copied[0] != dest {
+		t.Errorf("Expected %#v, got %#v", []string{dest}, copied)
+	}
+}
@@ -0,0 +1,25 @@
+package sync
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// BirthTime returns the birth (creation) time of the file at `path`.
+func BirthTime(path string) (time.Time, error) {
+	stat := syscall.Stat_t{}
+	err := syscall.Stat(path, &stat)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(stat.Birthtimespec.Sec, stat.Birthtimespec.Nsec), nil
+}
+
+// accessTime returns the access time recorded in `info`.
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atimespec.Unix())
+	}
+	return info.ModTime()
+}
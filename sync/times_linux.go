@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// `syscall` predates `statx(2)`, so we carry the few constants we need.
+const (
+	atFDCWD    = -0x64
+	statxBTime = 0x800
+)
+
+// Syscall numbers for `statx(2)`. Architectures missing from this table always
+// fall back to the modification time.
+var statxTrap = map[string]uintptr{
+	"386":     383,
+	"amd64":   332,
+	"arm":     397,
+	"arm64":   291,
+	"loong64": 291,
+	"ppc64":   383,
+	"ppc64le": 383,
+	"riscv64": 291,
+	"s390x":   379,
+}[runtime.GOARCH]
+
+type statxTimestamp struct {
+	Sec      int64
+	Nsec     uint32
+	reserved int32
+}
+
+// Mirrors `struct statx` from `linux/stat.h`.
+type statxT struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	UID            uint32
+	GID            uint32
+	Mode           uint16
+	_              uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          statxTimestamp
+	Btime          statxTimestamp
+	Ctime          statxTimestamp
+	Mtime          statxTimestamp
+	RdevMajor      uint32
+	RdevMinor      uint32
+	DevMajor       uint32
+	DevMinor       uint32
+	_              [14]uint64
+}
+
+// statxBirthTime returns `ok == false` if the kernel or filesystem doesn't
+// report a birth time for `path`.
+func statxBirthTime(path string) (t time.Time, ok bool) {
+	if statxTrap == 0 {
+		return time.Time{}, false
+	}
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	stx := statxT{}
+	dirfd := atFDCWD
+	_, _, errno := syscall.Syscall6(
+		statxTrap,
+		uintptr(dirfd),
+		uintptr(unsafe.Pointer(pathBytes)),
+		0,
+		statxBTime,
+		uintptr(unsafe.Pointer(&stx)),
+		0,
+	)
+	if errno != 0 || stx.Mask&statxBTime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec)), true
+}
+
+// BirthTime returns the birth (creation) time of the file at `path`, using
+// `statx(2)` where the filesystem supports it. Otherwise, it falls back to
+// the modification time.
+func BirthTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if t, ok := statxBirthTime(path); ok {
+		return t, nil
+	}
+	return info.ModTime(), nil
+}
+
+// accessTime returns the access time recorded in `info`.
+func accessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Unix())
+	}
+	return info.ModTime()
+}
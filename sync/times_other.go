@@ -0,0 +1,23 @@
+//go:build !darwin && !linux
+
+package sync
+
+import (
+	"os"
+	"time"
+)
+
+// BirthTime falls back to the modification time of the file at `path`, since
+// this platform has no portable way to read the birth time.
+func BirthTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// accessTime falls back to the modification time in `info`.
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The first sector of a FAT or exFAT filesystem.
+const bootSectorSize = 512
+
+// bootSectorSerial returns the volume serial number of a FAT12/16/32, exFAT,
+// or NTFS boot sector, formatted the same way as `blkid` and
+// `/dev/disk/by-uuid` (e.g. `1234-ABCD`).
+func bootSectorSerial(sector []byte) (string, error) {
+	if len(sector) < bootSectorSize || sector[510] != 0x55 || sector[511] != 0xAA {
+		return "", errors.New("not a boot sector")
+	}
+	oemName := string(sector[3:11])
+	fatSerial := func(offset int) string {
+		serial := binary.LittleEndian.Uint32(sector[offset : offset+4])
+		return fmt.Sprintf("%04X-%04X", serial>>16, serial&0xFFFF)
+	}
+
+	switch {
+	case oemName == "EXFAT   ":
+		return fatSerial(100), nil
+	case oemName == "NTFS    ":
+		return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(sector[72:80])), nil
+	// FAT32 has an extended boot signature at offset 66, and FAT12/16 at 38.
+	case sector[66] == 0x29 && bytes.HasPrefix(sector[82:90], []byte("FAT32")):
+		return fatSerial(67), nil
+	case sector[38] == 0x29 && bytes.HasPrefix(sector[54:62], []byte("FAT1")):
+		return fatSerial(39), nil
+	default:
+		return "", errors.New("unknown filesystem")
+	}
+}
+
+// deviceSerial reads the boot sector of a block device. This usually needs
+// more permissions than reading the mounted filesystem.
+func deviceSerial(device string) (string, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sector := make([]byte, bootSectorSize)
+	_, err = io.ReadFull(f, sector)
+	if err != nil {
+		return "", err
+	}
+	return bootSectorSerial(sector)
+}
+
+// Replaced in tests.
+var lookupVolumeUUID = volumeUUID
+
+// cardConfigForUUID returns the entry in `Cards` with the given UUID, compared
+// case-insensitively.
+func (op Operation) cardConfigForUUID(uuid string) (cardConfig, bool) {
+	for _, cc := range op.Cards {
+		if strings.EqualFold(cc.UUID, uuid) {
+			return cc, true
+		}
+	}
+	return cardConfig{}, false
+}
@@ -0,0 +1,23 @@
+package backup
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+)
+
+var diskutilVolumeUUID = regexp.MustCompile(`<key>VolumeUUID</key>\s*<string>([^<]+)</string>`)
+
+// volumeUUID returns the volume UUID that `diskutil info` reports for the
+// filesystem mounted at `mountPath`.
+func volumeUUID(mountPath string) (string, error) {
+	output, err := exec.Command("diskutil", "info", "-plist", mountPath).Output()
+	if err != nil {
+		return "", err
+	}
+	match := diskutilVolumeUUID.FindSubmatch(output)
+	if match == nil {
+		return "", fmt.Errorf("no volume UUID for: %s", mountPath)
+	}
+	return string(match[1]), nil
+}
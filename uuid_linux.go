@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const byUUIDFolder = "/dev/disk/by-uuid"
+
+// unescapeMountinfo decodes the octal escapes (e.g. `\040` for a space) in
+// `/proc/self/mountinfo`.
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountSource returns the device mounted at `mountPath`, according to
+// `/proc/self/mountinfo`.
+func mountSource(mountPath string) (string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	source := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || separator+2 >= len(fields) {
+			continue
+		}
+		// Later mounts on the same path hide earlier ones.
+		if unescapeMountinfo(fields[4]) == mountPath {
+			source = unescapeMountinfo(fields[separator+2])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if source == "" {
+		return "", fmt.Errorf("not a mount point: %s", mountPath)
+	}
+	return source, nil
+}
+
+// volumeUUID returns the filesystem UUID (or volume serial number) of the
+// filesystem mounted at `mountPath`. It is looked up in `/dev/disk/by-uuid`,
+// falling back to reading the boot sector of the device.
+func volumeUUID(mountPath string) (string, error) {
+	mountPath, err := filepath.Abs(mountPath)
+	if err != nil {
+		return "", err
+	}
+	source, err := mountSource(filepath.Clean(mountPath))
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(source) {
+		return "", fmt.Errorf("not mounted from a device: %s", mountPath)
+	}
+	device, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(byUUIDFolder)
+	if err == nil {
+		for _, entry := range entries {
+			target, err := filepath.EvalSymlinks(filepath.Join(byUUIDFolder, entry.Name()))
+			if err == nil && target == device {
+				return entry.Name(), nil
+			}
+		}
+	}
+
+	serial, err := deviceSerial(device)
+	if err != nil {
+		return "", errors.Join(fmt.Errorf("could not find the UUID of %s", device), err)
+	}
+	return serial, nil
+}
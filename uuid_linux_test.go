@@ -0,0 +1,23 @@
+package backup
+
+import (
+	"testing"
+)
+
+var mountinfoEscapeCases = []struct {
+	escaped string
+	want    string
+}{
+	{`/media/lgarron/EOS_DIGITAL`, "/media/lgarron/EOS_DIGITAL"},
+	{`/media/lgarron/NO\040NAME`, "/media/lgarron/NO NAME"},
+	{`/media/back\134slash`, `/media/back\slash`},
+	{`/media/trailing\04`, `/media/trailing\04`},
+}
+
+func TestUnescapeMountinfo(t *testing.T) {
+	for _, c := range mountinfoEscapeCases {
+		if got := unescapeMountinfo(c.escaped); got != c.want {
+			t.Errorf("[%s] Expected %#v, got %#v", c.escaped, c.want, got)
+		}
+	}
+}
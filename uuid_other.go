@@ -0,0 +1,11 @@
+//go:build !darwin && !linux
+
+package backup
+
+import (
+	"errors"
+)
+
+func volumeUUID(mountPath string) (string, error) {
+	return "", errors.New("looking up volume UUIDs is not supported on this platform")
+}
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testBootSector(oemName string, patch func(sector []byte)) []byte {
+	sector := make([]byte, bootSectorSize)
+	copy(sector[3:11], oemName)
+	sector[510] = 0x55
+	sector[511] = 0xAA
+	patch(sector)
+	return sector
+}
+
+var bootSectorCases = []struct {
+	name   string
+	sector []byte
+	want   string
+}{
+	{"FAT32", testBootSector("MSDOS5.0", func(s []byte) {
+		s[66] = 0x29
+		binary.LittleEndian.PutUint32(s[67:], 0x1234ABCD)
+		copy(s[82:], "FAT32   ")
+	}), "1234-ABCD"},
+	{"FAT16", testBootSector("MSDOS5.0", func(s []byte) {
+		s[38] = 0x29
+		binary.LittleEndian.PutUint32(s[39:], 0x00C0FFEE)
+		copy(s[54:], "FAT16   ")
+	}), "00C0-FFEE"},
+	{"exFAT", testBootSector("EXFAT   ", func(s []byte) {
+		binary.LittleEndian.PutUint32(s[100:], 0x5E6F7A8B)
+	}), "5E6F-7A8B"},
+	{"NTFS", testBootSector("NTFS    ", func(s []byte) {
+		binary.LittleEndian.PutUint64(s[72:], 0x0123456789ABCDEF)
+	}), "0123456789ABCDEF"},
+	{"ext4", make([]byte, bootSectorSize), ""},
+	{"unknown", testBootSector("MKFS    ", func(s []byte) {}), ""},
+}
+
+func TestBootSectorSerial(t *testing.T) {
+	for _, c := range bootSectorCases {
+		serial, err := bootSectorSerial(c.sector)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("[%s] Expected an error, got %#v", c.name, serial)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%s] Unexpected error: %s", c.name, err)
+		}
+		if serial != c.want {
+			t.Errorf("[%s] Expected %#v, got %#v", c.name, c.want, serial)
+		}
+	}
+}
+
+func TestCardsByUUID(t *testing.T) {
+	mountPoint := t.TempDir()
+	uuids := map[string]string{
+		"Untitled":   "1234-ABCD",
+		"Untitled 1": "5E6F-7A8B",
+		"EXTERNAL":   "0000-0000",
+	}
+	for volume := range uuids {
+		err := os.Mkdir(filepath.Join(mountPoint, volume), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(original func(string) (string, error)) { lookupVolumeUUID = original }(lookupVolumeUUID)
+	lookupVolumeUUID = func(mountPath string) (string, error) {
+		if uuid, ok := uuids[filepath.Base(mountPath)]; ok {
+			return uuid, nil
+		}
+		return "", errors.New("not a mount point")
+	}
+
+	op := Operation{
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"Untitled", "ZEUS"},
+		Cards: []cardConfig{
+			{Name: "FX3 Card 1", UUID: "1234-abcd"},
+			{Name: "FX3 Card 2", UUID: "5E6F-7A8B"},
+		},
+	}
+	cards, err := op.cards()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []card{
+		{Volume: "Untitled", Name: "FX3 Card 1", UUID: "1234-ABCD"},
+		{Volume: "ZEUS", Name: "ZEUS"},
+		{Volume: "Untitled 1", Name: "FX3 Card 2", UUID: "5E6F-7A8B"},
+	}
+	if len(cards) != len(want) {
+		t.Fatalf("Expected %d cards, got %+v", len(want), cards)
+	}
+	for i, c := range cards {
+		if c != want[i] {
+			t.Errorf("[%d] Expected %+v, got %+v", i, want[i], c)
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/lgarron/sd-card-backup/progress"
+	"github.com/lgarron/sd-card-backup/sync"
+)
+
+// Records which files have been checked in the current pass over the archive,
+// so that `verify` can resume where an earlier invocation stopped. It is
+// removed once the pass is complete.
+const verifyProgressFileName = "verify.jsonl"
+
+type verifyResult string
+
+const (
+	verifyOK verifyResult = "ok"
+	// The contents (or size) no longer match the manifest.
+	verifyCorrupt verifyResult = "corrupt"
+	// In the manifest, but not in the archive.
+	verifyMissing verifyResult = "missing"
+)
+
+type verifyRecord struct {
+	// Relative to the destination root.
+	DestinationPath string       `json:"destination_path"`
+	Result          verifyResult `json:"result"`
+	Detail          string       `json:"detail,omitempty"`
+	At              time.Time    `json:"at"`
+}
+
+// VerifyOptions control how fast the archive is verified.
+type VerifyOptions struct {
+	Workers int
+	// Shared by all workers. 0 means no limit.
+	BytesPerSecond int64
+	// Stop (to resume later) after this long. 0 means no limit.
+	MaxDuration time.Duration
+	// Discard the progress of an earlier, unfinished pass.
+	Restart bool
+}
+
+// RootVerification is the result of verifying a destination root against its
+// own manifest. `Unexpected` is only filled in once a pass is `Complete`.
+type RootVerification struct {
+	Root     string
+	Complete bool
+	Verified int
+	Corrupt  []string
+	Missing  []string
+	// Files in the root that aren't in its manifest.
+	Unexpected []string
+}
+
+func (rv RootVerification) String() string {
+	state := "Verification paused (run `verify` again to resume)"
+	if rv.Complete {
+		state = "Verification complete"
+	}
+	return fmt.Sprintf("%s for %s: %d files verified, %d corrupt, %d missing, %d unexpected", state, rv.Root, rv.Verified, len(rv.Corrupt), len(rv.Missing), len(rv.Unexpected))
+}
+
+// ArchiveVerification is the result of verifying each destination root.
+type ArchiveVerification struct {
+	Roots []RootVerification
+}
+
+// Complete returns whether the current pass is complete for every root.
+func (av ArchiveVerification) Complete() bool {
+	for _, rv := range av.Roots {
+		if !rv.Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// Failed returns whether any root has corrupt or missing files.
+func (av ArchiveVerification) Failed() bool {
+	for _, rv := range av.Roots {
+		if len(rv.Corrupt) > 0 || len(rv.Missing) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter spreads reads over time so that they don't exceed
+// `bytesPerSecond` on average.
+type rateLimiter struct {
+	mutex          *gosync.Mutex
+	bytesPerSecond int64
+	next           time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{mutex: &gosync.Mutex{}, bytesPerSecond: bytesPerSecond}
+}
+
+// wait blocks until `n` more bytes may be read.
+func (l *rateLimiter) wait(n int) {
+	if l.bytesPerSecond <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	l.mutex.Unlock()
+	time.Sleep(delay)
+}
+
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+	onRead  func(int64)
+}
+
+func (rr rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.limiter.wait(n)
+	rr.onRead(int64(n))
+	return n, err
+}
+
+func verifyProgressPath(destinationRoot string) string {
+	return filepath.Join(stateFolder(destinationRoot), verifyProgressFileName)
+}
+
+// readVerifyProgress returns the records of the current pass, by destination
+// path.
+func readVerifyProgress(destinationRoot string) (map[string]verifyRecord, error) {
+	records := map[string]verifyRecord{}
+	file, err := os.Open(verifyProgressPath(destinationRoot))
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	err = readJSONLines(file, func(record verifyRecord) {
+		records[record.DestinationPath] = record
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// latestManifestEntries returns the most recent manifest entry for each
+// destination path, sorted by path.
+func latestManifestEntries(destinationRoot string) ([]ManifestEntry, error) {
+	entries, err := ReadManifest(destinationRoot)
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]ManifestEntry{}
+	for _, entry := range entries {
+		latest[entry.DestinationPath] = entry
+	}
+	sorted := []ManifestEntry{}
+	for _, entry := range latest {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].DestinationPath < sorted[j].DestinationPath
+	})
+	return sorted, nil
+}
+
+type archiveVerifier struct {
+	root     string
+	limiter  *rateLimiter
+	tracker  *progress.Tracker
+	mutex    *gosync.Mutex
+	progress *os.File
+	// Records of the current pass, by destination path.
+	done map[string]verifyRecord
+}
+
+func (av archiveVerifier) check(entry ManifestEntry) verifyRecord {
+	record := verifyRecord{DestinationPath: entry.DestinationPath, Result: verifyOK}
+	file := av.tracker.StartFile(entry.DestinationPath, entry.Size)
+	defer file.Done()
+
+	path := filepath.Join(av.root, entry.DestinationPath)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		record.Result = verifyMissing
+		return record
+	}
+	if err != nil {
+		record.Result, record.Detail = verifyCorrupt, err.Error()
+		return record
+	}
+	defer f.Close()
+
+	algorithm, err := sync.ParseHashAlgorithm(entry.HashAlgorithm)
+	if err != nil {
+		record.Result, record.Detail = verifyCorrupt, err.Error()
+		return record
+	}
+	h := algorithm.New()
+	size, err := io.Copy(h, rateLimitedReader{r: f, limiter: av.limiter, onRead: file.Add})
+	if err != nil {
+		record.Result, record.Detail = verifyCorrupt, err.Error()
+		return record
+	}
+	if size != entry.Size {
+		record.Result, record.Detail = verifyCorrupt, fmt.Sprintf("%d bytes, expected %d", size, entry.Size)
+		return record
+	}
+	if hash := fmt.Sprintf("%x", h.Sum(nil)); hash != entry.Hash {
+		record.Result, record.Detail = verifyCorrupt, fmt.Sprintf("%s hash %s, expected %s", algorithm, hash, entry.Hash)
+	}
+	return record
+}
+
+func (av archiveVerifier) record(record verifyRecord) error {
+	record.At = time.Now()
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	av.mutex.Lock()
+	defer av.mutex.Unlock()
+	if record.Result != verifyOK {
+		message := fmt.Sprintf("❌ %s: %s", filepath.Join(av.root, record.DestinationPath), record.Result)
+		if record.Detail != "" {
+			message += fmt.Sprintf(" (%s)", record.Detail)
+		}
+		av.tracker.Print(message + "\n")
+	}
+	av.done[record.DestinationPath] = record
+	_, err = av.progress.Write(append(line, '\n'))
+	return err
+}
+
+// copiesInProgress returns the destination paths of the copies that journals
+// record as in progress (or interrupted, which the next backup cleans up).
+func (op Operation) copiesInProgress() (map[string]bool, error) {
+	journals, err := readJournals(op.DestinationRoot)
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]bool{}
+	for _, entry := range journals.inProgress() {
+		paths[entry.DestinationPath] = true
+	}
+	return paths, nil
+}
+
+// unexpectedFiles returns the files in `root` that aren't in its manifest
+// (other than the state folder). Partial files of copies in `inProgress` are
+// left to the backup, but other partial files are unexpected. Files that are
+// moved or removed while walking the root (e.g. by a backup) are skipped.
+func (op Operation) unexpectedFiles(root string, expected map[string]bool, inProgress map[string]bool) ([]string, error) {
+	unexpected := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if relPath == stateFolderName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if sync.IsPartialFile(path) && inProgress[strings.TrimSuffix(relPath, sync.PartialPath(""))] {
+			return nil
+		}
+		if !expected[relPath] {
+			unexpected = append(unexpected, relPath)
+		}
+		return nil
+	})
+	return unexpected, err
+}
+
+// rootVerification is the plan for verifying a single root.
+type rootVerification struct {
+	root    string
+	entries []ManifestEntry
+	// Records of the current pass so far, by destination path.
+	done           map[string]verifyRecord
+	remaining      []ManifestEntry
+	remainingBytes int64
+}
+
+// planRootVerification reads the manifest of `root`, and the progress of the
+// current pass.
+func planRootVerification(root string, restart bool) (rootVerification, error) {
+	plan := rootVerification{root: root}
+	var err error
+	plan.entries, err = latestManifestEntries(root)
+	if err != nil {
+		return rootVerification{}, err
+	}
+	if restart {
+		err := os.Remove(verifyProgressPath(root))
+		if err != nil && !os.IsNotExist(err) {
+			return rootVerification{}, err
+		}
+	}
+	plan.done, err = readVerifyProgress(root)
+	if err != nil {
+		return rootVerification{}, err
+	}
+	for _, entry := range plan.entries {
+		if _, ok := plan.done[entry.DestinationPath]; !ok {
+			plan.remaining = append(plan.remaining, entry)
+			plan.remainingBytes += entry.Size
+		}
+	}
+	if len(plan.done) > 0 {
+		fmt.Printf("Resuming verification of %s: %d of %d files already checked\n", root, len(plan.done), len(plan.entries))
+	}
+	return plan, nil
+}
+
+// rootsToVerify returns the roots that have a manifest: the destination roots
+// (skipping missing secondary roots if `secondary_roots` allows it), followed
+// by the roots set for individual cards.
+func (op Operation) rootsToVerify() ([]string, error) {
+	roots := []string{}
+	for i, root := range op.destinationRoots() {
+		exists, err := folderExists(root)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			roots = append(roots, root)
+			continue
+		}
+		if i == 0 || !op.SecondaryRoots.Missing.skips() {
+			return nil, fmt.Errorf("destination folder does not exist: %s", root)
+		}
+		fmt.Printf("⚠️ Not verifying missing destination root: %s\n", root)
+	}
+	for _, root := range op.cardDestinationRoots() {
+		exists, err := folderExists(root)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("destination folder does not exist: %s", root)
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// verifyRoot checks the remaining files of `plan` (until `deadline`, if set).
+// `inProgress` is from `copiesInProgress()`.
+func (op Operation) verifyRoot(plan rootVerification, options VerifyOptions, limiter *rateLimiter, tracker *progress.Tracker, deadline time.Time, inProgress map[string]bool) (RootVerification, error) {
+	err := makeStateFolder(plan.root)
+	if err != nil {
+		return RootVerification{}, err
+	}
+	progressFile, err := os.OpenFile(verifyProgressPath(plan.root), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return RootVerification{}, err
+	}
+	defer progressFile.Close()
+
+	tracker.StartCard(plan.root, len(plan.remaining), plan.remainingBytes)
+	av := archiveVerifier{
+		root:     plan.root,
+		limiter:  limiter,
+		tracker:  tracker,
+		mutex:    &gosync.Mutex{},
+		progress: progressFile,
+		done:     plan.done,
+	}
+
+	workers := options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan ManifestEntry)
+	errs := make(chan error, workers)
+	wg := &gosync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range jobs {
+				record := av.check(entry)
+				err := av.record(record)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	complete := true
+	for _, entry := range plan.remaining {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			complete = false
+			break
+		}
+		select {
+		case jobs <- entry:
+		case err := <-errs:
+			close(jobs)
+			wg.Wait()
+			return RootVerification{}, err
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	tracker.FinishCard()
+	select {
+	case err := <-errs:
+		return RootVerification{}, err
+	default:
+	}
+
+	result := RootVerification{Root: plan.root, Complete: complete}
+	expected := map[string]bool{}
+	for _, entry := range plan.entries {
+		expected[entry.DestinationPath] = true
+	}
+	for path, record := range plan.done {
+		if !expected[path] {
+			continue
+		}
+		result.Verified++
+		switch record.Result {
+		case verifyCorrupt:
+			result.Corrupt = append(result.Corrupt, path)
+		case verifyMissing:
+			result.Missing = append(result.Missing, path)
+		}
+	}
+	sort.Strings(result.Corrupt)
+	sort.Strings(result.Missing)
+
+	if complete {
+		result.Unexpected, err = op.unexpectedFiles(plan.root, expected, inProgress)
+		if err != nil {
+			return RootVerification{}, err
+		}
+		for _, path := range result.Unexpected {
+			fmt.Printf("❓ %s: not in the manifest\n", filepath.Join(plan.root, path))
+		}
+		// Start a new pass next time.
+		err = os.Remove(verifyProgressPath(plan.root))
+		if err != nil {
+			return RootVerification{}, err
+		}
+	}
+
+	fmt.Println(result)
+	return result, nil
+}
+
+// VerifyArchive re-hashes the files in each destination root, and compares
+// them with the hashes recorded in the manifest of that root. Files checked by
+// an earlier invocation that didn't complete are skipped (unless
+// `options.Restart` is set).
+func (op Operation) VerifyArchive(options VerifyOptions) (ArchiveVerification, error) {
+	if op.S3 != nil {
+		return ArchiveVerification{}, errors.New("`verify` does not support `s3` destinations")
+	}
+	roots, err := op.rootsToVerify()
+	if err != nil {
+		return ArchiveVerification{}, err
+	}
+
+	plans := []rootVerification{}
+	for _, root := range roots {
+		plan, err := planRootVerification(root, options.Restart)
+		if err != nil {
+			return ArchiveVerification{}, err
+		}
+		plans = append(plans, plan)
+	}
+
+	tracker := progress.NewTracker(os.Stdout, progress.IsTerminal(os.Stdout))
+	defer tracker.Close()
+	for _, plan := range plans {
+		tracker.AddTotal(len(plan.remaining), plan.remainingBytes)
+	}
+	limiter := newRateLimiter(options.BytesPerSecond)
+	var deadline time.Time
+	if options.MaxDuration > 0 {
+		deadline = time.Now().Add(options.MaxDuration)
+	}
+
+	// Read once for the whole pass.
+	inProgress, err := op.copiesInProgress()
+	if err != nil {
+		return ArchiveVerification{}, err
+	}
+	result := ArchiveVerification{}
+	for _, plan := range plans {
+		rv, err := op.verifyRoot(plan, options, limiter, tracker, deadline, inProgress)
+		if err != nil {
+			return ArchiveVerification{}, err
+		}
+		result.Roots = append(result.Roots, rv)
+	}
+	return result, nil
+}
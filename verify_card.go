@@ -0,0 +1,377 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lgarron/sd-card-backup/progress"
+	"github.com/lgarron/sd-card-backup/sync"
+)
+
+type cardProblemKind string
+
+const (
+	missingDestination cardProblemKind = "missing from the destination"
+	sizeDiffers        cardProblemKind = "size differs"
+	contentDiffers     cardProblemKind = "content differs"
+	unreadable         cardProblemKind = "could not be checked"
+	// Not in any `folder_mapping`, so it is never backed up.
+	unmappedFile cardProblemKind = "not in a mapped folder"
+	// In one of the card's `exclude_classifications`, so it is never backed
+	// up.
+	excludedFile cardProblemKind = "in an excluded classification"
+	// Excluded by a filter rule, so it is never backed up.
+	filteredOutFile cardProblemKind = "excluded by a filter rule"
+)
+
+// CardProblem is a file that would be lost if the card were formatted.
+type CardProblem struct {
+	// Relative to the root of the card.
+	Path   string
+	Kind   cardProblemKind
+	Detail string
+}
+
+func (p CardProblem) String() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%s: %s", p.Path, p.Kind)
+	}
+	return fmt.Sprintf("%s: %s (%s)", p.Path, p.Kind, p.Detail)
+}
+
+// CardVerification is the result of checking that every file on a card has
+// been backed up.
+type CardVerification struct {
+	Card     string
+	Files    int
+	Bytes    int64
+	Problems []CardProblem
+}
+
+// Safe returns whether the card can be formatted without losing any files.
+func (cv CardVerification) Safe() bool {
+	return len(cv.Problems) == 0
+}
+
+func (cv CardVerification) String() string {
+	if cv.Safe() {
+		return fmt.Sprintf("[%s] ✅ SAFE to format: all %d files (%s) are backed up", cv.Card, cv.Files, progress.FormatBytes(cv.Bytes))
+	}
+	counts := map[cardProblemKind]int{}
+	for _, p := range cv.Problems {
+		counts[p.Kind]++
+	}
+	parts := []string{}
+	for _, kind := range []cardProblemKind{missingDestination, sizeDiffers, contentDiffers, unreadable, unmappedFile, excludedFile, filteredOutFile} {
+		if counts[kind] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+		}
+	}
+	return fmt.Sprintf("[%s] ❌ NOT SAFE to format: %s", cv.Card, strings.Join(parts, ", "))
+}
+
+// Files and folders that operating systems create on cards, which don't need
+// to be backed up.
+var cardSystemFiles = map[string]bool{
+	cardIdentityFileName:        true,
+	".DS_Store":                 true,
+	".Spotlight-V100":           true,
+	".Trashes":                  true,
+	".TemporaryItems":           true,
+	".fseventsd":                true,
+	"System Volume Information": true,
+}
+
+func isCardSystemFile(name string) bool {
+	// AppleDouble files, e.g. `._IMG_1234.JPG`.
+	return cardSystemFiles[name] || strings.HasPrefix(name, "._")
+}
+
+type cardVerifier struct {
+	op  Operation
+	run *backupRun
+	// The secondary roots that are checked as well as `op.DestinationRoot`.
+	mirrors       []string
+	card          card
+	hashAlgorithm sync.HashAlgorithm
+	result        *CardVerification
+}
+
+func (cv cardVerifier) problem(path string, kind cardProblemKind, detail string) {
+	relPath, err := filepath.Rel(cv.op.cardRoot(cv.card), path)
+	if err != nil {
+		relPath = path
+	}
+	problem := CardProblem{Path: relPath, Kind: kind, Detail: detail}
+	fmt.Printf("[%s] %s\n", cv.card.Name, problem)
+	cv.result.Problems = append(cv.result.Problems, problem)
+}
+
+// checkFile compares a file on the card with its backup in each root.
+func (cv cardVerifier) checkFile(fo folderOperation, path string, info os.FileInfo) {
+	cv.result.Files++
+	cv.result.Bytes += info.Size()
+
+	classificationFolder, err := cv.run.Classifier.table.folder(fo.classifyPath(path))
+	if err != nil {
+		cv.problem(path, unreadable, err.Error())
+		return
+	}
+	if cv.op.excludesClassification(cv.card.Name, classificationFolder) {
+		cv.problem(path, excludedFile, classificationFolder)
+		return
+	}
+	rule, err := fo.filteredOut(path, info)
+	if err != nil {
+		cv.problem(path, unreadable, err.Error())
+		return
+	}
+	if rule != "" {
+		cv.problem(path, filteredOutFile, rule)
+		return
+	}
+	dest, err := fo.targetPath(path, classificationFolder)
+	if err != nil {
+		cv.problem(path, unreadable, err.Error())
+		return
+	}
+	relPath, err := filepath.Rel(cv.op.DestinationRoot, dest)
+	if err != nil {
+		cv.problem(path, unreadable, err.Error())
+		return
+	}
+	dests := []string{dest}
+	for _, root := range cv.mirrors {
+		dests = append(dests, filepath.Join(root, relPath))
+	}
+
+	// Only hashed if some destination has the right size.
+	srcHash := ""
+	for _, dest := range dests {
+		destInfo, err := os.Stat(dest)
+		if os.IsNotExist(err) {
+			cv.problem(path, missingDestination, dest)
+			continue
+		}
+		if err != nil {
+			cv.problem(path, unreadable, err.Error())
+			continue
+		}
+		if destInfo.Size() != info.Size() {
+			cv.problem(path, sizeDiffers, fmt.Sprintf("%d bytes on the card, %d bytes in %s", info.Size(), destInfo.Size(), dest))
+			continue
+		}
+
+		if srcHash == "" {
+			srcHash, err = sync.HashFile(path, cv.hashAlgorithm)
+			if err != nil {
+				cv.problem(path, unreadable, err.Error())
+				return
+			}
+		}
+		destHash, err := sync.HashFile(dest, cv.hashAlgorithm)
+		if err != nil {
+			cv.problem(path, unreadable, err.Error())
+			continue
+		}
+		if srcHash != destHash {
+			cv.problem(path, contentDiffers, dest)
+		}
+	}
+}
+
+// checkMappedFolders checks every file in the mapped folders, using the same
+// `targetPath()` logic as the backup.
+func (cv cardVerifier) checkMappedFolders(folders []mappedFolder) error {
+	for _, mf := range folders {
+		fo := folderOperation{
+			Operation:     cv.op,
+			SourceRoot:    mf.RelativeTo,
+			CardRoot:      cv.op.cardRoot(cv.card),
+			CardName:      cv.card.Name,
+			FolderMapping: mf.FolderMapping,
+			Run:           cv.run,
+		}
+		err := filepath.Walk(mf.Path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				cv.problem(path, unreadable, err.Error())
+				return nil
+			}
+			if !info.IsDir() {
+				cv.checkFile(fo, path, info)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isMapped(path string, folders []mappedFolder) bool {
+	for _, mf := range folders {
+		if path == mf.Path || strings.HasPrefix(path, mf.Path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUnmappedFiles flags the files on the card that are not backed up
+// because they are outside the mapped folders.
+func (cv cardVerifier) checkUnmappedFiles(folders []mappedFolder) error {
+	return filepath.Walk(cv.op.cardRoot(cv.card), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			cv.problem(path, unreadable, err.Error())
+			return nil
+		}
+		if isCardSystemFile(info.Name()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isMapped(path, folders) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			cv.problem(path, unmappedFile, "")
+		}
+		return nil
+	})
+}
+
+func (op Operation) verifyCard(run *backupRun, c card) (CardVerification, error) {
+	exists, err := folderExists(op.cardRoot(c))
+	if err != nil {
+		return CardVerification{}, err
+	}
+	if !exists {
+		return CardVerification{}, fmt.Errorf("card is not mounted: %s", op.cardRoot(c))
+	}
+	hashAlgorithm, err := sync.ParseHashAlgorithm(op.HashAlgorithm)
+	if err != nil {
+		return CardVerification{}, err
+	}
+	cardOp := op.forCard(c)
+	exists, err = folderExists(cardOp.DestinationRoot)
+	if err != nil {
+		return CardVerification{}, err
+	}
+	if !exists {
+		return CardVerification{}, fmt.Errorf("destination folder does not exist: %s", cardOp.DestinationRoot)
+	}
+
+	mirrors, err := op.mirrorsToVerify(cardOp, c)
+	if err != nil {
+		return CardVerification{}, err
+	}
+
+	fmt.Printf("[%s] Verifying card\n", c.Name)
+	cv := cardVerifier{
+		op:            cardOp,
+		run:           run,
+		mirrors:       mirrors,
+		card:          c,
+		hashAlgorithm: hashAlgorithm,
+		result:        &CardVerification{Card: c.Name},
+	}
+	folders, err := cardOp.mappedFolders(c)
+	if err != nil {
+		return CardVerification{}, err
+	}
+	err = cv.checkMappedFolders(folders)
+	if err != nil {
+		return CardVerification{}, err
+	}
+	err = cv.checkUnmappedFiles(folders)
+	if err != nil {
+		return CardVerification{}, err
+	}
+	fmt.Println(cv.result)
+	return *cv.result, nil
+}
+
+// mirrorsToVerify returns the secondary roots that the files of `c` are backed
+// up to, as well as `cardOp.DestinationRoot`. Files in the root of an
+// individual card aren't mirrored. A missing secondary root is an error, unless
+// `secondary_roots` allows it to be skipped.
+func (op Operation) mirrorsToVerify(cardOp Operation, c card) ([]string, error) {
+	if cardOp.DestinationRoot != op.DestinationRoot {
+		return nil, nil
+	}
+	mirrors := []string{}
+	for _, root := range op.destinationRoots()[1:] {
+		exists, err := folderExists(root)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			mirrors = append(mirrors, root)
+			continue
+		}
+		if !op.SecondaryRoots.Missing.skips() {
+			return nil, fmt.Errorf("destination folder does not exist: %s", root)
+		}
+		fmt.Printf("[%s] ⚠️ Not checking missing destination root: %s\n", c.Name, root)
+	}
+	return mirrors, nil
+}
+
+// VerifyCards checks that every file on the given cards (by volume name, or
+// all mounted cards if there are none) has been backed up, and prints a
+// SAFE / NOT SAFE verdict for each card.
+func (op Operation) VerifyCards(volumes []string) ([]CardVerification, error) {
+	if op.S3 != nil {
+		return nil, errors.New("`verify-card` does not support `s3` destinations")
+	}
+	exists, err := folderExists(op.DestinationRoot)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("destination folder does not exist: %s", op.DestinationRoot)
+	}
+
+	cards := []card{}
+	if len(volumes) == 0 {
+		all, err := op.cards()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range all {
+			mounted, err := folderExists(op.cardRoot(c))
+			if err != nil {
+				return nil, err
+			}
+			if mounted {
+				cards = append(cards, c)
+			}
+		}
+	}
+	for _, volume := range volumes {
+		c, err := op.cardForVolume(volume)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, c)
+	}
+
+	run := op.newReadOnlyRun()
+	verifications := []CardVerification{}
+	for _, c := range cards {
+		verification, err := op.verifyCard(run, c)
+		if err != nil {
+			return nil, err
+		}
+		verifications = append(verifications, verification)
+	}
+	return verifications, nil
+}
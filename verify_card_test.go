@@ -0,0 +1,147 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyCards(t *testing.T) {
+	mountPoint := t.TempDir()
+	destinationRoot := t.TempDir()
+	files := map[string]string{
+		"HERA/DCIM/100CANON/IMG_0001.JPG": "\xFF\xD8\xFF first",
+		"HERA/DCIM/100CANON/IMG_0002.JPG": "\xFF\xD8\xFF second",
+		"HERA/.DS_Store":                  "ignored",
+	}
+	for path, contents := range files {
+		fullPath := filepath.Join(mountPoint, path)
+		err := os.MkdirAll(filepath.Dir(fullPath), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fullPath, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op := Operation{
+		DestinationRoot:  destinationRoot,
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+	err := op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifications, err := op.VerifyCards(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 1 || !verifications[0].Safe() || verifications[0].Files != 2 {
+		t.Fatalf("Expected a safe card with 2 files, got %+v", verifications)
+	}
+
+	// Change the card after the backup.
+	err = os.WriteFile(filepath.Join(mountPoint, "HERA/DCIM/100CANON/IMG_0003.JPG"), []byte("\xFF\xD8\xFF third"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(mountPoint, "HERA/DCIM/100CANON/IMG_0002.JPG"), []byte("\xFF\xD8\xFF SECOND"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(filepath.Join(mountPoint, "HERA/MISC"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(mountPoint, "HERA/MISC/PRINT.DPOF"), []byte("print order"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifications, err = op.VerifyCards([]string{"HERA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifications[0].Safe() {
+		t.Fatalf("Expected the card to be unsafe")
+	}
+	want := map[string]cardProblemKind{
+		"DCIM/100CANON/IMG_0002.JPG": contentDiffers,
+		"DCIM/100CANON/IMG_0003.JPG": missingDestination,
+		"MISC/PRINT.DPOF":            unmappedFile,
+	}
+	if len(verifications[0].Problems) != len(want) {
+		t.Errorf("Expected %d problems, got %+v", len(want), verifications[0].Problems)
+	}
+	for _, problem := range verifications[0].Problems {
+		if want[problem.Path] != problem.Kind {
+			t.Errorf("[%s] Expected %#v, got %#v", problem.Path, want[problem.Path], problem.Kind)
+		}
+	}
+}
+
+func TestVerifyCardsMirrors(t *testing.T) {
+	mountPoint := t.TempDir()
+	primary := t.TempDir()
+	mirror := t.TempDir()
+	missing := filepath.Join(t.TempDir(), "unmounted")
+	path := filepath.Join(mountPoint, "HERA/DCIM/100CANON/IMG_0001.JPG")
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte("\xFF\xD8\xFF IMG_0001.JPG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := Operation{
+		DestinationRoot:  primary,
+		DestinationRoots: []string{primary, missing, mirror},
+		SecondaryRoots:   secondaryRootPolicy{Missing: skipRoot},
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+	err = op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifications, err := op.VerifyCards(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifications) != 1 || !verifications[0].Safe() {
+		t.Fatalf("Expected a safe card, got %+v", verifications)
+	}
+
+	// Bit rot in the mirror.
+	entries, err := latestManifestEntries(mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(mirror, entries[0].DestinationPath), []byte("\xFF\xD8\xFF IMG_0009.JPG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifications, err = op.VerifyCards(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := verifications[0].Problems
+	if len(problems) != 1 || problems[0].Kind != contentDiffers || problems[0].Detail != filepath.Join(mirror, entries[0].DestinationPath) {
+		t.Errorf("Expected the file in the mirror to differ, got %+v", problems)
+	}
+
+	// Missing secondary roots fail the verification by default.
+	op.SecondaryRoots = secondaryRootPolicy{}
+	_, err = op.VerifyCards(nil)
+	if err == nil {
+		t.Errorf("Expected an error for the missing root")
+	}
+}
@@ -0,0 +1,234 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVerifyArchive(t *testing.T) {
+	mountPoint := t.TempDir()
+	destinationRoot := t.TempDir()
+	for _, name := range []string{"IMG_0001.JPG", "IMG_0002.JPG", "IMG_0003.JPG", "IMG_0004.JPG"} {
+		path := filepath.Join(mountPoint, "HERA/DCIM/100CANON", name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte("\xFF\xD8\xFF "+name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op := Operation{
+		DestinationRoot:  destinationRoot,
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+	err := op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := latestManifestEntries(destinationRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 manifest entries, got %d", len(entries))
+	}
+	archived := func(i int) string {
+		return filepath.Join(destinationRoot, entries[i].DestinationPath)
+	}
+
+	// Bit rot (same size), a deleted file, and a file that was never backed up.
+	err = os.WriteFile(archived(0), []byte("\xFF\xD8\xFF IMG_0009.JPG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(archived(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(filepath.Dir(archived(2)), "IMG_0005.JPG"), []byte("unexpected"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Left by a copy that was interrupted before journals existed, and by one
+	// that is recorded in a journal.
+	partial := filepath.Join(filepath.Dir(archived(2)), "IMG_0006.JPG.sd-card-backup.partial")
+	err = os.WriteFile(partial, []byte("\xFF\xD8"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted, err := openJournal(destinationRoot, "20180421T103000Z-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inProgress := filepath.Join(filepath.Dir(entries[2].DestinationPath), "IMG_0007.JPG")
+	err = interrupted.record(JournalEntry{State: journalInProgress, Card: "HERA", SourcePath: "DCIM/100CANON/IMG_0007.JPG", DestinationPath: inProgress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	interrupted.close()
+	err = os.WriteFile(filepath.Join(destinationRoot, inProgress+".sd-card-backup.partial"), []byte("\xFF\xD8"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend that an earlier invocation checked the last file, but was
+	// interrupted. Corrupting it shows that it isn't checked again.
+	err = os.WriteFile(verifyProgressPath(destinationRoot), []byte(`{"destination_path":"`+entries[3].DestinationPath+`","result":"ok"}`+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(archived(3), []byte("\xFF\xD8\xFF IMG_0000.JPG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := op.VerifyArchive(VerifyOptions{Workers: 2, BytesPerSecond: 1000 * 1000, MaxDuration: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ArchiveVerification{Roots: []RootVerification{{
+		Root:     destinationRoot,
+		Complete: true,
+		Verified: 4,
+		Corrupt:  []string{entries[0].DestinationPath},
+		Missing:  []string{entries[1].DestinationPath},
+		Unexpected: []string{
+			filepath.Join(filepath.Dir(entries[2].DestinationPath), "IMG_0005.JPG"),
+			filepath.Join(filepath.Dir(entries[2].DestinationPath), "IMG_0006.JPG.sd-card-backup.partial"),
+		},
+	}}}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Expected %+v, got %+v", want, result)
+	}
+	if _, err := os.Stat(partial); err != nil {
+		t.Errorf("Expected the partial file to be kept, got %v", err)
+	}
+
+	// The next pass starts from scratch.
+	result, err = op.VerifyArchive(VerifyOptions{Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Roots) != 1 || len(result.Roots[0].Corrupt) != 2 {
+		t.Errorf("Expected 2 corrupt files in a new pass, got %+v", result.Roots)
+	}
+}
+
+func TestVerifyArchiveRoots(t *testing.T) {
+	mountPoint := t.TempDir()
+	primary := t.TempDir()
+	mirror := t.TempDir()
+	missing := filepath.Join(t.TempDir(), "unmounted")
+	path := filepath.Join(mountPoint, "HERA/DCIM/100CANON/IMG_0001.JPG")
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte("\xFF\xD8\xFF IMG_0001.JPG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := Operation{
+		DestinationRoot:  primary,
+		DestinationRoots: []string{primary, missing, mirror},
+		SecondaryRoots:   secondaryRootPolicy{Missing: skipRoot},
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+	err = op.BackupCard("HERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bit rot in the mirror only.
+	entries, err := latestManifestEntries(mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(mirror, entries[0].DestinationPath), []byte("\xFF\xD8\xFF IMG_0009.JPG"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := op.VerifyArchive(VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ArchiveVerification{Roots: []RootVerification{
+		{Root: primary, Complete: true, Verified: 1, Unexpected: []string{}},
+		{Root: mirror, Complete: true, Verified: 1, Corrupt: []string{entries[0].DestinationPath}, Unexpected: []string{}},
+	}}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Expected %+v, got %+v", want, result)
+	}
+
+	// Missing secondary roots fail the verification by default.
+	op.SecondaryRoots = secondaryRootPolicy{}
+	_, err = op.VerifyArchive(VerifyOptions{})
+	if err == nil {
+		t.Errorf("Expected an error for the missing root")
+	}
+}
+
+func TestVerifyArchiveCardRoots(t *testing.T) {
+	mountPoint := t.TempDir()
+	primary := t.TempDir()
+	zeusRoot := t.TempDir()
+	for _, volume := range []string{"HERA", "ZEUS"} {
+		path := filepath.Join(mountPoint, volume, "DCIM/100CANON/IMG_0001.JPG")
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte("\xFF\xD8\xFF "+volume), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	op := Operation{
+		DestinationRoot:  primary,
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA", "ZEUS"},
+		Cards:            []cardConfig{{Name: "ZEUS", DestinationRoot: zeusRoot}},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+	for _, volume := range []string{"HERA", "ZEUS"} {
+		err := op.BackupCard(volume)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Bit rot in the card's own root.
+	entries, err := latestManifestEntries(zeusRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 manifest entry in the card's root, got %d", len(entries))
+	}
+	err = os.WriteFile(filepath.Join(zeusRoot, entries[0].DestinationPath), []byte("\xFF\xD8\xFF HERA"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := op.VerifyArchive(VerifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ArchiveVerification{Roots: []RootVerification{
+		{Root: primary, Complete: true, Verified: 1, Unexpected: []string{}},
+		{Root: zeusRoot, Complete: true, Verified: 1, Corrupt: []string{entries[0].DestinationPath}, Unexpected: []string{}},
+	}}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Expected %+v, got %+v", want, result)
+	}
+}
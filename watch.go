@@ -0,0 +1,390 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"time"
+)
+
+// WatchOptions configure `Operation.Watch()`.
+type WatchOptions struct {
+	// How long a volume must stay mounted (without being remounted) before it
+	// is backed up.
+	SettleDelay time.Duration
+	// A card that is mounted again within this long after it was last backed
+	// up successfully is not backed up again.
+	Debounce time.Duration
+	// Poll `SDCardMountPoint` instead of watching it with inotify. Polling is
+	// also used if inotify isn't available.
+	Poll         bool
+	PollInterval time.Duration
+}
+
+// volumeWatcher reports possible changes to the volumes mounted in a folder.
+type volumeWatcher interface {
+	// Receives after each change (changes in quick succession may be
+	// coalesced).
+	Changes() <-chan struct{}
+	// Receives an error if the watcher stops reporting changes.
+	Errors() <-chan error
+	Close() error
+}
+
+// pollingWatcher reports a possible change at a fixed interval.
+type pollingWatcher struct {
+	changes chan struct{}
+	done    chan struct{}
+}
+
+func newPollingWatcher(interval time.Duration) *pollingWatcher {
+	w := &pollingWatcher{
+		changes: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				notifyChange(w.changes)
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *pollingWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Errors returns `nil`, since polling can't fail.
+func (w *pollingWatcher) Errors() <-chan error {
+	return nil
+}
+
+func (w *pollingWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+// notifyChange sends on `changes` unless a change is already pending.
+func notifyChange(changes chan struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// mountedVolumes returns the folders in `mountPoint`, by name.
+func mountedVolumes(mountPoint string) (map[string]os.FileInfo, error) {
+	entries, err := os.ReadDir(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	volumes := map[string]os.FileInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		// Not `entry.Info()`, which describes the folder the volume is mounted
+		// on rather than the root of the volume.
+		info, err := os.Stat(filepath.Join(mountPoint, entry.Name()))
+		if err != nil {
+			// Unmounted in the meantime.
+			continue
+		}
+		volumes[entry.Name()] = info
+	}
+	return volumes, nil
+}
+
+// watchedVolume is a folder in `SDCardMountPoint`.
+type watchedVolume struct {
+	Info os.FileInfo
+	// When the volume has settled. Zero once it has been handled.
+	Due time.Time
+	// Set if the volume was still empty when it settled (e.g. because it was
+	// still being mounted), so that it is checked again after the next change.
+	Empty bool
+}
+
+// volumeTracker keeps track of when each volume was mounted, so that volumes
+// are only backed up once they have settled.
+type volumeTracker struct {
+	settleDelay time.Duration
+	volumes     map[string]*watchedVolume
+}
+
+func newVolumeTracker(settleDelay time.Duration) *volumeTracker {
+	return &volumeTracker{settleDelay: settleDelay, volumes: map[string]*watchedVolume{}}
+}
+
+// update records the volumes that are mounted at `now`. A volume that is new,
+// or that is a different folder than before (because it was remounted), has
+// to settle again.
+func (t *volumeTracker) update(volumes map[string]os.FileInfo, now time.Time) {
+	for name := range t.volumes {
+		if _, ok := volumes[name]; !ok {
+			delete(t.volumes, name)
+		}
+	}
+	for name, info := range volumes {
+		if w, ok := t.volumes[name]; ok && os.SameFile(w.Info, info) {
+			if w.Empty {
+				w.Due, w.Empty = now, false
+			}
+			continue
+		}
+		t.volumes[name] = &watchedVolume{Info: info, Due: now.Add(t.settleDelay)}
+	}
+}
+
+// settled returns the volumes that have settled by `now` (in lexical order),
+// and marks them as handled.
+func (t *volumeTracker) settled(now time.Time) []string {
+	names := []string{}
+	for name, w := range t.volumes {
+		if !w.Due.IsZero() && !w.Due.After(now) {
+			names = append(names, name)
+			w.Due = time.Time{}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recheck marks a settled volume that was still empty, so that it settles
+// again on the next `update()`.
+func (t *volumeTracker) recheck(name string) {
+	if w, ok := t.volumes[name]; ok {
+		w.Empty = true
+	}
+}
+
+// next returns when the next volume settles, or zero if none are waiting.
+func (t *volumeTracker) next() time.Time {
+	next := time.Time{}
+	for _, w := range t.volumes {
+		if !w.Due.IsZero() && (next.IsZero() || w.Due.Before(next)) {
+			next = w.Due
+		}
+	}
+	return next
+}
+
+// watchRunner backs up the cards queued by `Operation.Watch()`, one at a time.
+type watchRunner struct {
+	op       Operation
+	debounce time.Duration
+
+	mutex *gosync.Mutex
+	cond  *gosync.Cond
+	queue []card
+	// Cards that are queued or being backed up, by name.
+	pending map[string]bool
+	// When each card was last backed up successfully, by name.
+	finished map[string]time.Time
+	sessions int
+	stopped  bool
+	done     chan struct{}
+}
+
+func newWatchRunner(op Operation, debounce time.Duration) *watchRunner {
+	mutex := &gosync.Mutex{}
+	r := &watchRunner{
+		op:       op,
+		debounce: debounce,
+		mutex:    mutex,
+		cond:     gosync.NewCond(mutex),
+		pending:  map[string]bool{},
+		finished: map[string]time.Time{},
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// enqueue queues `c` to be backed up, unless it already is (or is being backed
+// up), or it was backed up very recently.
+func (r *watchRunner) enqueue(c card) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.pending[c.Name] {
+		fmt.Printf("[%s] ⏩ Mounted again while queued or being backed up\n", c.Name)
+		return
+	}
+	if last, ok := r.finished[c.Name]; ok && time.Since(last) < r.debounce {
+		fmt.Printf("[%s] ⏩ Mounted again within %s of its last backup\n", c.Name, r.debounce)
+		return
+	}
+	r.pending[c.Name] = true
+	r.queue = append(r.queue, c)
+	r.cond.Signal()
+}
+
+func (r *watchRunner) run() {
+	defer close(r.done)
+	for {
+		r.mutex.Lock()
+		for len(r.queue) == 0 && !r.stopped {
+			r.cond.Wait()
+		}
+		if r.stopped {
+			for _, c := range r.queue {
+				fmt.Printf("[%s] ⏩ Not backing up (stopping)\n", c.Name)
+			}
+			r.mutex.Unlock()
+			return
+		}
+		c := r.queue[0]
+		r.queue = r.queue[1:]
+		r.sessions++
+		session := r.sessions
+		r.mutex.Unlock()
+
+		ok := r.backup(c, session)
+
+		r.mutex.Lock()
+		delete(r.pending, c.Name)
+		if ok {
+			r.finished[c.Name] = time.Now()
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// backup backs up `c`, and logs the session. Returns whether it succeeded.
+func (r *watchRunner) backup(c card, session int) bool {
+	start := time.Now()
+	fmt.Printf("--------\n")
+	fmt.Printf("[%s] Session %d: backing up card (mounted at %s) at %s\n", c.Name, session, r.op.cardRoot(c), start.Format(time.DateTime))
+	err := r.op.BackupCard(c.Volume)
+	elapsed := time.Since(start).Round(time.Second)
+	if err != nil {
+		fmt.Printf("[%s] ❌ Session %d failed after %s: %s\n", c.Name, session, elapsed, err)
+		return false
+	}
+	fmt.Printf("[%s] ✅ Session %d finished in %s\n", c.Name, session, elapsed)
+	return true
+}
+
+// stop waits for the current backup (if any) to finish, and drops the rest of
+// the queue.
+func (r *watchRunner) stop() {
+	r.mutex.Lock()
+	r.stopped = true
+	r.cond.Broadcast()
+	r.mutex.Unlock()
+	<-r.done
+}
+
+// volumeIsEmpty returns whether `volume` has no files (yet). An empty folder
+// is usually left over from an earlier mount, but a slow mount can also be
+// empty for a while.
+func (op Operation) volumeIsEmpty(volume string) bool {
+	entries, err := os.ReadDir(filepath.Join(op.SDCardMountPoint, volume))
+	return err != nil || len(entries) == 0
+}
+
+// settledCard returns the configured card mounted at `volume`, if there is one.
+func (op Operation) settledCard(volume string) (card, bool, error) {
+	cards, err := op.cards()
+	if err != nil {
+		return card{}, false, err
+	}
+	for _, c := range cards {
+		if c.Volume == volume {
+			return c, true, nil
+		}
+	}
+	return card{}, false, nil
+}
+
+// Watch backs up each card in `op.SDCardMountPoint` (as in `BackupAllCards()`)
+// once it has been mounted for `options.SettleDelay`, until `ctx` is done.
+// Cards that are already mounted when it starts are also backed up. Cards are
+// backed up one at a time, and a backup that is in progress when `ctx` is done
+// is finished before returning.
+func (op Operation) Watch(ctx context.Context, options WatchOptions) error {
+	if options.PollInterval <= 0 {
+		return errors.New("the poll interval must be positive")
+	}
+	exists, err := folderExists(op.SDCardMountPoint)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("card mount point does not exist: %s", op.SDCardMountPoint)
+	}
+	exists, err = folderExists(op.DestinationRoot)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("destination folder does not exist: %s", op.DestinationRoot)
+	}
+
+	var watcher volumeWatcher
+	if !options.Poll {
+		watcher, err = newNativeWatcher(op.SDCardMountPoint)
+		if err != nil {
+			fmt.Printf("⚠️ Could not watch for cards (%s), polling every %s instead\n", err, options.PollInterval)
+			watcher = nil
+		}
+	}
+	if watcher == nil {
+		watcher = newPollingWatcher(options.PollInterval)
+	}
+	defer func() { watcher.Close() }()
+
+	fmt.Printf("Watching for cards in:\n  %s\n", op.SDCardMountPoint)
+	runner := newWatchRunner(op, options.Debounce)
+	tracker := newVolumeTracker(options.SettleDelay)
+	for {
+		volumes, err := mountedVolumes(op.SDCardMountPoint)
+		if err != nil {
+			fmt.Printf("⚠️ Could not list volumes: %s\n", err)
+		} else {
+			tracker.update(volumes, time.Now())
+		}
+		for _, volume := range tracker.settled(time.Now()) {
+			if op.volumeIsEmpty(volume) {
+				tracker.recheck(volume)
+				continue
+			}
+			c, ok, err := op.settledCard(volume)
+			if err != nil {
+				fmt.Printf("[%s] ❌ Could not identify card: %s\n", volume, err)
+				continue
+			}
+			if ok {
+				runner.enqueue(c)
+			}
+		}
+
+		var wake <-chan time.Time
+		if next := tracker.next(); !next.IsZero() {
+			wake = time.After(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Printf("Stopping (after the current backup, if any)\n")
+			runner.stop()
+			return nil
+		case <-watcher.Changes():
+		case err := <-watcher.Errors():
+			fmt.Printf("⚠️ Stopped watching for cards (%s), polling every %s instead\n", err, options.PollInterval)
+			watcher.Close()
+			watcher = newPollingWatcher(options.PollInterval)
+		case <-wake:
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// inotifyWatcher watches a folder for volume folders being added or removed
+// (with inotify), and `/proc/self/mountinfo` for filesystems being mounted or
+// unmounted (e.g. on a folder that already exists).
+type inotifyWatcher struct {
+	epollFD     int
+	inotifyFD   int
+	mountinfoFD int
+	changes     chan struct{}
+	errs        chan error
+	done        chan struct{}
+	stopped     chan struct{}
+}
+
+// How long `epoll_wait()` blocks before checking whether the watcher was
+// closed, in milliseconds.
+const epollTimeout = 500
+
+func newNativeWatcher(folder string) (volumeWatcher, error) {
+	w := &inotifyWatcher{epollFD: -1, inotifyFD: -1, mountinfoFD: -1}
+	err := w.open(folder)
+	if err != nil {
+		w.closeFDs()
+		return nil, err
+	}
+	w.changes = make(chan struct{}, 1)
+	w.errs = make(chan error, 1)
+	w.done = make(chan struct{})
+	w.stopped = make(chan struct{})
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) open(folder string) error {
+	var err error
+	w.inotifyFD, err = syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("inotify: %s", err)
+	}
+	_, err = syscall.InotifyAddWatch(w.inotifyFD, folder, syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO)
+	if err != nil {
+		return fmt.Errorf("inotify: %s", err)
+	}
+	w.mountinfoFD, err = syscall.Open("/proc/self/mountinfo", syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	w.epollFD, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("epoll: %s", err)
+	}
+	err = syscall.EpollCtl(w.epollFD, syscall.EPOLL_CTL_ADD, w.inotifyFD, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(w.inotifyFD)})
+	if err != nil {
+		return fmt.Errorf("epoll: %s", err)
+	}
+	// `mountinfo` is always readable, and signals a change in the mount table
+	// with `EPOLLPRI` (once per change).
+	err = syscall.EpollCtl(w.epollFD, syscall.EPOLL_CTL_ADD, w.mountinfoFD, &syscall.EpollEvent{Events: syscall.EPOLLPRI, Fd: int32(w.mountinfoFD)})
+	if err != nil {
+		return fmt.Errorf("epoll: %s", err)
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.stopped)
+	events := make([]syscall.EpollEvent, 2)
+	buffer := make([]byte, 4096)
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		n, err := syscall.EpollWait(w.epollFD, events, epollTimeout)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			w.errs <- fmt.Errorf("epoll: %s", err)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		// Drain the inotify events, which only matter as a whole.
+		for {
+			_, err := syscall.Read(w.inotifyFD, buffer)
+			if err != nil {
+				break
+			}
+		}
+		notifyChange(w.changes)
+	}
+}
+
+func (w *inotifyWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Errors() <-chan error {
+	return w.errs
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	<-w.stopped
+	return w.closeFDs()
+}
+
+func (w *inotifyWatcher) closeFDs() error {
+	errs := []error{}
+	for _, fd := range []int{w.epollFD, w.inotifyFD, w.mountinfoFD} {
+		if fd >= 0 {
+			errs = append(errs, syscall.Close(fd))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,27 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInotifyWatcher(t *testing.T) {
+	mountPoint := t.TempDir()
+	watcher, err := newNativeWatcher(mountPoint)
+	if err != nil {
+		t.Skipf("inotify is not available: %s", err)
+	}
+	defer watcher.Close()
+
+	err = os.Mkdir(filepath.Join(mountPoint, "HERA"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-watcher.Changes():
+	case <-time.After(5 * time.Second):
+		t.Error("Expected a change when a volume folder is added")
+	}
+}
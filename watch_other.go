@@ -0,0 +1,11 @@
+//go:build !linux
+
+package backup
+
+import (
+	"errors"
+)
+
+func newNativeWatcher(folder string) (volumeWatcher, error) {
+	return nil, errors.New("watching folders is not supported on this platform")
+}
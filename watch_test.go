@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVolumeTracker(t *testing.T) {
+	stat := func(path string) os.FileInfo {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	hera := stat(t.TempDir())
+	remounted := stat(t.TempDir())
+	zeus := stat(t.TempDir())
+
+	start := time.Date(2018, 4, 21, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	tracker := newVolumeTracker(5 * time.Second)
+	volumeTrackerCases := []struct {
+		description string
+		now         time.Time
+		volumes     map[string]os.FileInfo
+		settled     []string
+		next        time.Time
+	}{
+		{"mounted", at(0), map[string]os.FileInfo{"HERA": hera}, []string{}, at(5)},
+		{"still settling", at(3), map[string]os.FileInfo{"HERA": hera, "ZEUS": zeus}, []string{}, at(5)},
+		{"remounted", at(4), map[string]os.FileInfo{"HERA": remounted, "ZEUS": zeus}, []string{}, at(8)},
+		{"settled", at(9), map[string]os.FileInfo{"HERA": remounted, "ZEUS": zeus}, []string{"HERA", "ZEUS"}, time.Time{}},
+		{"handled", at(20), map[string]os.FileInfo{"HERA": remounted, "ZEUS": zeus}, []string{}, time.Time{}},
+		{"unmounted", at(21), map[string]os.FileInfo{"ZEUS": zeus}, []string{}, time.Time{}},
+		{"mounted again", at(22), map[string]os.FileInfo{"HERA": remounted, "ZEUS": zeus}, []string{}, at(27)},
+		{"unmounted while settling", at(23), map[string]os.FileInfo{"ZEUS": zeus}, []string{}, time.Time{}},
+	}
+	for _, c := range volumeTrackerCases {
+		tracker.update(c.volumes, c.now)
+		if got := tracker.settled(c.now); !reflect.DeepEqual(got, c.settled) {
+			t.Errorf("[%s] Expected %#v to settle, got %#v", c.description, c.settled, got)
+		}
+		if got := tracker.next(); !got.Equal(c.next) {
+			t.Errorf("[%s] Expected next at %s, got %s", c.description, c.next, got)
+		}
+	}
+
+	// A volume that was still empty when it settled is checked again after the
+	// next change, without waiting to settle again.
+	tracker.update(map[string]os.FileInfo{"HERA": hera}, at(30))
+	if got := tracker.settled(at(35)); !reflect.DeepEqual(got, []string{"HERA"}) {
+		t.Errorf("Expected HERA to settle, got %#v", got)
+	}
+	tracker.recheck("HERA")
+	tracker.update(map[string]os.FileInfo{"HERA": hera}, at(36))
+	if got := tracker.settled(at(36)); !reflect.DeepEqual(got, []string{"HERA"}) {
+		t.Errorf("Expected the empty volume to be checked again, got %#v", got)
+	}
+	tracker.update(map[string]os.FileInfo{"HERA": hera}, at(37))
+	if got := tracker.settled(at(37)); !reflect.DeepEqual(got, []string{}) {
+		t.Errorf("Expected the volume to be handled, got %#v", got)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	mountPoint := t.TempDir()
+	op := Operation{
+		DestinationRoot:  t.TempDir(),
+		SDCardMountPoint: mountPoint,
+		SDCardNames:      []string{"HERA"},
+		FolderMapping:    []folderMapping{{Source: "DCIM", Destination: "DCIM"}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchErr := make(chan error)
+	go func() {
+		watchErr <- op.Watch(ctx, WatchOptions{
+			SettleDelay:  50 * time.Millisecond,
+			Debounce:     time.Minute,
+			Poll:         true,
+			PollInterval: 10 * time.Millisecond,
+		})
+	}()
+
+	// Volumes that aren't configured cards are ignored.
+	for _, path := range []string{"HERA/DCIM/100CANON/IMG_0001.JPG", "OTHER/DCIM/100CANON/IMG_0001.JPG"} {
+		path = filepath.Join(mountPoint, path)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte("\xFF\xD8\xFF IMG_0001.JPG"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []ManifestEntry
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		var err error
+		entries, err = latestManifestEntries(op.DestinationRoot)
+		if err == nil && len(entries) > 0 {
+			break
+		}
+	}
+	cancel()
+	err := <-watchErr
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Card != "HERA" {
+		t.Errorf("Expected HERA to be backed up, got %+v", entries)
+	}
+}